@@ -0,0 +1,112 @@
+package backends
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy - Rules for deciding which previous versions of an object should be kept
+// Any version matched by at least one rule is kept, the current version of a file is always kept
+type RetentionPolicy struct {
+	KeepLast        int `json:"keepLast"`        // Keep the N most recent versions
+	KeepDaily       int `json:"keepDaily"`       // Keep the newest version of each day, for the last N days
+	KeepMonthly     int `json:"keepMonthly"`     // Keep the newest version of each month, for the last N months
+	KeepDeletedDays int `json:"keepDeletedDays"` // Keep files which have been removed locally for N days
+}
+
+// Validate - Ensure that none of the limits are negative
+func (p *RetentionPolicy) Validate() error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepMonthly < 0 || p.KeepDeletedDays < 0 {
+		return errors.New("retention limits can't be negative")
+	}
+	return nil
+}
+
+// ObjectVersion - A single version (or delete marker) of an object stored in a backend
+type ObjectVersion struct {
+	Key          string
+	VersionID    string
+	LastModified time.Time
+	Size         int64
+	IsLatest     bool
+	DeleteMarker bool
+	Metadata     *ObjectMetadata
+}
+
+// hasKeepRules - Returns whether or not the policy restricts the number of versions to keep
+func (p *RetentionPolicy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepMonthly > 0
+}
+
+// Expired - Returns the versions of a single object which fall outside of the retention policy
+func (p *RetentionPolicy) Expired(versions []ObjectVersion, now time.Time) []ObjectVersion {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	// Newest versions first
+	sorted := make([]ObjectVersion, len(versions))
+	copy(sorted, versions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].IsLatest != sorted[j].IsLatest {
+			return sorted[i].IsLatest
+		}
+		return sorted[i].LastModified.After(sorted[j].LastModified)
+	})
+
+	// If the file has been deleted for long enough, everything goes, including the delete marker
+	latest := sorted[0]
+	if latest.DeleteMarker && p.KeepDeletedDays > 0 {
+		if latest.LastModified.Before(now.AddDate(0, 0, -p.KeepDeletedDays)) {
+			return sorted
+		}
+	}
+
+	if !p.hasKeepRules() {
+		return nil
+	}
+
+	keep := make(map[int]bool)
+	// Always keep the current version (or delete marker)
+	keep[0] = true
+
+	dailyCutoff := now.AddDate(0, 0, -p.KeepDaily)
+	monthlyCutoff := now.AddDate(0, -p.KeepMonthly, 0)
+	days := make(map[string]bool)
+	months := make(map[string]bool)
+	dataVersions := 0
+	for idx, version := range sorted {
+		if version.DeleteMarker {
+			continue
+		}
+		if dataVersions < p.KeepLast {
+			keep[idx] = true
+		}
+		dataVersions++
+
+		modified := version.LastModified.UTC()
+		if p.KeepDaily > 0 && modified.After(dailyCutoff) {
+			day := modified.Format("2006-01-02")
+			if !days[day] {
+				days[day] = true
+				keep[idx] = true
+			}
+		}
+		if p.KeepMonthly > 0 && modified.After(monthlyCutoff) {
+			month := modified.Format("2006-01")
+			if !months[month] {
+				months[month] = true
+				keep[idx] = true
+			}
+		}
+	}
+
+	var expired []ObjectVersion
+	for idx, version := range sorted {
+		if !keep[idx] {
+			expired = append(expired, version)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,87 @@
+package backends
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionKeepLast(t *testing.T) {
+	now := time.Date(2018, 6, 15, 12, 0, 0, 0, time.UTC)
+	versions := buildVersions(now, 5)
+
+	policy := &RetentionPolicy{KeepLast: 2}
+	expired := policy.Expired(versions, now)
+	assert.Equal(t, 3, len(expired), "Should expire all but the last 2 versions")
+	for _, version := range expired {
+		assert.NotEqual(t, "v0", version.VersionID, "Should never expire the latest version")
+		assert.NotEqual(t, "v1", version.VersionID, "Should keep the second version")
+	}
+
+	// An empty policy keeps everything
+	empty := &RetentionPolicy{}
+	assert.Empty(t, empty.Expired(versions, now), "Should not expire anything")
+}
+
+func TestRetentionDailyMonthly(t *testing.T) {
+	now := time.Date(2018, 6, 15, 12, 0, 0, 0, time.UTC)
+	versions := []ObjectVersion{
+		{Key: "file", VersionID: "today-new", LastModified: now.Add(-1 * time.Hour), IsLatest: true},
+		{Key: "file", VersionID: "today-old", LastModified: now.Add(-2 * time.Hour)},
+		{Key: "file", VersionID: "yesterday", LastModified: now.AddDate(0, 0, -1)},
+		{Key: "file", VersionID: "last-month", LastModified: now.AddDate(0, -1, 0)},
+		{Key: "file", VersionID: "last-year", LastModified: now.AddDate(-1, -1, 0)},
+	}
+
+	policy := &RetentionPolicy{KeepDaily: 7}
+	expired := versionIDs(policy.Expired(versions, now))
+	assert.Equal(t, []string{"today-old", "last-month", "last-year"}, expired, "Should keep one version per day")
+
+	policy = &RetentionPolicy{KeepDaily: 7, KeepMonthly: 12}
+	expired = versionIDs(policy.Expired(versions, now))
+	assert.Equal(t, []string{"today-old", "last-year"}, expired, "Should keep one version per month")
+}
+
+func TestRetentionDeleted(t *testing.T) {
+	now := time.Date(2018, 6, 15, 12, 0, 0, 0, time.UTC)
+	versions := append([]ObjectVersion{{
+		Key:          "file",
+		VersionID:    "marker",
+		LastModified: now.AddDate(0, 0, -10),
+		IsLatest:     true,
+		DeleteMarker: true,
+	}}, buildVersions(now.AddDate(0, 0, -11), 3)...)
+	versions[1].IsLatest = false
+
+	// Still within the window, apply the normal rules
+	policy := &RetentionPolicy{KeepLast: 1, KeepDeletedDays: 30}
+	expired := versionIDs(policy.Expired(versions, now))
+	assert.Equal(t, []string{"v1", "v2"}, expired, "Should keep the marker and the last version")
+
+	// Outside of the window, remove everything
+	policy = &RetentionPolicy{KeepLast: 1, KeepDeletedDays: 7}
+	assert.Equal(t, 4, len(policy.Expired(versions, now)), "Should remove all versions of the deleted file")
+}
+
+func buildVersions(latest time.Time, count int) []ObjectVersion {
+	versions := make([]ObjectVersion, count)
+	for i := 0; i < count; i++ {
+		versions[i] = ObjectVersion{
+			Key:          "file",
+			VersionID:    "v" + strconv.Itoa(i),
+			LastModified: latest.Add(time.Duration(-i) * time.Hour),
+			IsLatest:     i == 0,
+		}
+	}
+	return versions
+}
+
+func versionIDs(versions []ObjectVersion) []string {
+	ids := make([]string, len(versions))
+	for idx, version := range versions {
+		ids[idx] = version.VersionID
+	}
+	return ids
+}
@@ -1,21 +1,35 @@
 package backends
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
 	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-// This needs to be capitalized
-const checksumKey = "Checksum"
+// These need to be capitalized
+const (
+	checksumKey      = "Checksum"
+	hostnameKey      = "Hostname"
+	machineIDKey     = "Machine-Id"
+	watcherKey       = "Watcher"
+	eventKey         = "Event"
+	modTimeKey       = "Mtime"
+	backerVersionKey = "Backer-Version"
+)
 
 // S3Uploader struct which contains configuration settings for managing S3 Buckets
 type S3Uploader struct {
@@ -26,60 +40,134 @@ type S3Uploader struct {
 
 // S3Options - Options struct for S3 backend
 type S3Options struct {
-	Region            string        `json:"region"`
-	Bucket            string        `json:"bucket"`
-	BucketRoot        string        `json:"bucketRoot"`
-	Credentials       S3Credentials `json:"credentials"`
-	Versioning        bool          `json:"versioning"`
-	ReducedRedundancy bool          `json:"reducedRedundancy"`
+	Name              string             `json:"name"` // Identifies the backend in status and results, defaults to S3
+	Region            string             `json:"region"`
+	Bucket            string             `json:"bucket"`
+	BucketRoot        string             `json:"bucketRoot"`
+	CreateBucket      bool               `json:"createBucket"` // Let backer backend apply create the bucket and enable versioning
+	Credentials       S3Credentials      `json:"credentials"`
+	Versioning        bool               `json:"versioning"`
+	ReducedRedundancy bool               `json:"reducedRedundancy"` // Deprecated, use storageClass
+	StorageClass      string             `json:"storageClass"`      // Defaults to STANDARD, watchers may override it
+	Encryption        *EncryptionOptions `json:"encryption,omitempty"`
+	Tags              map[string]string  `json:"tags,omitempty"` // Object tags, values are templates of TagVariables
+	Retention         *RetentionPolicy   `json:"retention,omitempty"`
+	ContentAddressed  bool               `json:"contentAddressed"`
+	Lifecycle         []LifecycleRule    `json:"lifecycle"`            // Rules of the bucket, left alone when unset
+	ObjectLock        *ObjectLockOptions `json:"objectLock,omitempty"` // Default retention of new versions, needs versioning
 }
 
 // S3Credentials - Credentials for S3
+// Static keys are optional, without them the standard AWS credential chain is used
 type S3Credentials struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	SessionToken    string
 	ProviderName    string
+	Profile         string             `json:"profile"` // Shared credentials or config profile, defaults to AWS_PROFILE or default
+	AssumeRole      *AssumeRoleOptions `json:"assumeRole,omitempty"`
+}
+
+// Bucket names must be DNS compatible, see https://docs.aws.amazon.com/AmazonS3/latest/dev/BucketRestrictions.html
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Validate - Ensure that the options are usable, without contacting S3
+func (o *S3Options) Validate() error {
+	if o.Region == "" {
+		return errors.New("region is required")
+	}
+	if o.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if !bucketName.MatchString(o.Bucket) || strings.Contains(o.Bucket, "..") {
+		return errors.New("invalid bucket name: " + o.Bucket)
+	}
+	if (o.Credentials.AccessKeyID == "") != (o.Credentials.SecretAccessKey == "") {
+		return errors.New("credentials need both an AccessKeyID and a SecretAccessKey")
+	}
+	if o.Credentials.AssumeRole != nil {
+		if err := o.Credentials.AssumeRole.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := o.validateStorage(); err != nil {
+		return err
+	}
+	// Blobs are shared by every host, which may not have the same key, and are named by the checksum of the plain text
+	if o.ContentAddressed && o.Encryption != nil && o.Encryption.Type == EncryptionCustomer {
+		return errors.New("contentAddressed can't be used with " + EncryptionCustomer)
+	}
+	if err := o.validateBucket(); err != nil {
+		return err
+	}
+	if o.Retention != nil {
+		return o.Retention.Validate()
+	}
+	return nil
 }
 
-// NewS3Uploader creates a new S3 manager to sync objects
-func NewS3Uploader(options *S3Options) *S3Uploader {
+// NewS3Uploader - Connect to the bucket of the backend, and check that it can be used
+// The bucket is never changed, settings which don't match the config are logged, backer backend apply changes them
+func NewS3Uploader(options *S3Options) (*S3Uploader, error) {
+	return newS3Uploader(options)
+}
+
+// newS3Uploader - NewS3Uploader, with extra AWS config such as the endpoint of a test server
+func newS3Uploader(options *S3Options, configs ...*aws.Config) (*S3Uploader, error) {
 	log.Println("Creating new S3 Client")
-	sess := session.New(&aws.Config{
-		Region:      aws.String(options.Region),
-		Credentials: credentials.NewStaticCredentials(options.Credentials.AccessKeyID, options.Credentials.SecretAccessKey, options.Credentials.SessionToken),
-	})
+	s3Uploader, err := newS3Client(options, configs...)
+	if err != nil {
+		return nil, &PreflightError{Backend: options.GetName(), Bucket: options.Bucket, Check: PreflightCredentials, Err: err}
+	}
+	if err = s3Uploader.Preflight(); err != nil {
+		return nil, err
+	}
+	s3Uploader.warnBucketSettings()
+	return s3Uploader, nil
+}
 
-	s3Uploader := &S3Uploader{
+// NewS3Client - Connect to the bucket of the backend, without creating it or changing its settings
+func NewS3Client(options *S3Options) (*S3Uploader, error) {
+	return newS3Client(options)
+}
+
+func newS3Client(options *S3Options, configs ...*aws.Config) (*S3Uploader, error) {
+	sess, err := newSession(options, configs...)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Uploader{
 		session: sess,
 		client:  s3.New(sess),
 		config:  options,
-	}
-
-	// Create the bucket
-	s3Uploader.createBucket()
-
-	return s3Uploader
+	}, nil
 }
 
 // GetName - Specifies that this is an S3 backend
 func (s *S3Uploader) GetName() string {
+	return s.config.GetName()
+}
+
+// GetName - Name of the backend, defaults to S3
+func (o *S3Options) GetName() string {
+	if o.Name != "" {
+		return o.Name
+	}
 	return "S3"
 }
 
 // DeleteFile from S3 Bucket
-func (s *S3Uploader) DeleteFile(name string, remoteRoot string) {
+func (s *S3Uploader) DeleteFile(name string, key string) error {
 	if s.config.Versioning {
-		s.deleteVersionedObject(s.buildObjectKey(name, remoteRoot))
-	} else {
-		s.deleteObject(s.buildObjectKey(name, remoteRoot))
+		return s.deleteVersionedObject(s.buildObjectKey(key))
 	}
+	return s.deleteObject(s.buildObjectKey(key))
 }
 
 // UploadFile to S3 Bucket
-func (s *S3Uploader) UploadFile(name string, data io.Reader, remoteRoot string, checksum string) {
+func (s *S3Uploader) UploadFile(name string, data io.Reader, key string, metadata *ObjectMetadata) error {
 	// Check if the file exists and if it matches what I need
-	// objectHead := s.getObjectDetails(s.buildObjectKey(name, remoteRoot))
+	// objectHead := s.getObjectDetails(s.buildObjectKey(key))
 	// if objectHead != nil {
 	// 	log.Println("Object exists")
 	// 	log.Println(objectHead.Metadata)
@@ -95,68 +183,88 @@ func (s *S3Uploader) UploadFile(name string, data io.Reader, remoteRoot string,
 	// go func() {
 	// 	checksumChannel <- generateSHA256Hash(data)
 	// }()
-	err := s.uploadObject(name, remoteRoot, data, checksum)
+	err := s.uploadObject(name, key, data, metadata)
 	if err != nil {
-		log.Println(err)
+		log.Errorln(err)
 	}
+	return err
 }
 
 // FileInSync - Check that S3 has the latest version of the file, and upload if not. Returns whether or not the file is in sync
-func (s *S3Uploader) FileInSync(name string, remotePath string, data io.Reader, checksum string) (bool, error) {
+func (s *S3Uploader) FileInSync(name string, key string, data io.Reader, metadata *ObjectMetadata) (bool, error) {
 
-	objectKey := s.buildObjectKey(name, remotePath)
-	head, err := s.client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(s.config.Bucket),
-		Key:    aws.String(objectKey),
-	})
+	head, err := s.headObject(s.buildObjectKey(key), "")
 	if err != nil {
 		if requestErr, ok := err.(s3.RequestFailure); ok {
 			// If the code is 404, that's fine, continue
 			if requestErr.StatusCode() == 404 {
-				s.UploadFile(name, data, remotePath, checksum)
-				return false, nil
+				return false, s.UploadFile(name, data, key, metadata)
 			}
 			return false, err
 		}
 		return false, err
 	}
-	oldChecksum := head.Metadata[checksumKey]
+	oldChecksum := aws.StringValue(head.Metadata[checksumKey])
 	// Upload the file
-	if *oldChecksum != checksum {
-		s.UploadFile(name, data, remotePath, checksum)
-		return false, nil
+	if oldChecksum != metadata.Checksum {
+		return false, s.UploadFile(name, data, key, metadata)
 	}
 	return true, nil
 }
 
-func (s *S3Uploader) createBucket() {
+// GetVersion - Retrieve a stored copy of the file, an empty versionID returns the latest version
+func (s *S3Uploader) GetVersion(key string, versionID string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.buildObjectKey(key)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	var err error
+	input.SSECustomerAlgorithm, input.SSECustomerKey, err = s.customerKey()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	return s.resolveBlob(resp)
+}
+
+// createBucket - Create the bucket if it doesn't exist yet, and enable versioning if it's configured
+func (s *S3Uploader) createBucket() error {
 	log.Println("Creating bucket:", s.config.Bucket)
 	_, err := s.client.CreateBucket(&s3.CreateBucketInput{
 		Bucket: aws.String(s.config.Bucket),
 	})
-
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case "BucketAlreadyExists":
-				log.Fatalf("Bucket %s already exists in the S3 system\nBuckets must have unique names.", s.config.Bucket)
-			case "BucketAlreadyOwnedByYou":
-				log.Printf("Bucket %s already exists", s.config.Bucket)
-			default:
-				log.Panicln(awsErr)
-			}
+		awsErr, ok := err.(awserr.Error)
+		switch {
+		case ok && awsErr.Code() == "BucketAlreadyOwnedByYou":
+			log.Printf("Bucket %s already exists\n", s.config.Bucket)
+		case ok && awsErr.Code() == "BucketAlreadyExists":
+			return s.preflightError(PreflightCreate, errors.New("the name is taken by another account, bucket names must be globally unique"))
+		default:
+			return s.preflightError(PreflightCreate, err)
 		}
 	}
 
 	// Enable Versioning of S3 Bucket, if enabled in config
 	if s.config.Versioning {
-		s.client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		_, err = s.client.PutBucketVersioning(&s3.PutBucketVersioningInput{
 			Bucket: aws.String(s.config.Bucket),
 			VersioningConfiguration: &s3.VersioningConfiguration{
 				Status: aws.String(s3.BucketVersioningStatusEnabled),
 			},
 		})
+		if err != nil {
+			return s.preflightError(PreflightCreate, err)
+		}
 	}
+	return nil
 }
 
 // func (s *S3Uploader) GetObject(name string) error {
@@ -171,35 +279,51 @@ func (s *S3Uploader) createBucket() {
 // 	return nil
 // }
 
-func (s *S3Uploader) uploadObject(name string, remoteRoot string, object io.Reader, checksum string) error {
+func (s *S3Uploader) uploadObject(name string, key string, object io.Reader, objectMetadata *ObjectMetadata) error {
 	// Setup the metadata
-	log.Debugln("Metadata:", checksum)
-	metadata := make(map[string]*string)
-	metadata[checksumKey] = aws.String(checksum)
-
-	// Set the redundency
-	var storage string
-	if s.config.ReducedRedundancy {
-		storage = "REDUCED_REDUNDANCY"
-	} else {
-		storage = "STANDARD"
+	log.Debugln("Metadata:", objectMetadata)
+	if s.config.ContentAddressed {
+		return s.uploadContentAddressed(name, key, object, objectMetadata)
 	}
 
-	uploader := s3manager.NewUploader(s.session)
-	objectKey := s.buildObjectKey(name, remoteRoot)
+	tags, err := s.tagging(objectMetadata)
+	if err != nil {
+		return err
+	}
+	objectKey := s.buildObjectKey(key)
 	log.Println("Uploading:", objectKey)
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Body:         object,
+	location, err := s.putObject(objectKey, object, toS3Metadata(objectMetadata), s.storageClass(objectMetadata), tags)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Uploaded %s to %s\n", name, location)
+	return nil
+}
+
+// putObject - Upload the body to the given bucket key, returning its location
+// Objects are encrypted as configured for the backend, tags may be nil
+func (s *S3Uploader) putObject(objectKey string, body io.Reader, metadata map[string]*string, storageClass string, tags *string) (string, error) {
+	input := &s3manager.UploadInput{
+		Body:         body,
 		Bucket:       aws.String(s.config.Bucket),
 		Key:          aws.String(objectKey),
 		Metadata:     metadata,
-		StorageClass: aws.String(storage),
-	})
+		StorageClass: aws.String(storageClass),
+		Tagging:      tags,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s.encryption()
+	var err error
+	input.SSECustomerAlgorithm, input.SSECustomerKey, err = s.customerKey()
 	if err != nil {
-		return err
+		return "", err
 	}
-	log.Debugf("Uploaded %s to %s\n", name, result.Location)
-	return nil
+
+	uploader := s3manager.NewUploader(s.session)
+	result, err := uploader.Upload(input)
+	if err != nil {
+		return "", err
+	}
+	return result.Location, nil
 }
 
 func (s *S3Uploader) getObjectDetails(key string) *s3.HeadObjectOutput {
@@ -220,7 +344,7 @@ func (s *S3Uploader) getObjectDetails(key string) *s3.HeadObjectOutput {
 	return resp
 }
 
-func (s *S3Uploader) deleteObject(key string) {
+func (s *S3Uploader) deleteObject(key string) error {
 	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.config.Bucket),
 		Key:    aws.String(key),
@@ -229,61 +353,421 @@ func (s *S3Uploader) deleteObject(key string) {
 	if err != nil {
 		log.Errorln(err)
 	}
+	return err
 }
 
-func (s *S3Uploader) deleteVersionedObject(key string) {
+func (s *S3Uploader) deleteVersionedObject(key string) error {
 	log.Println("Removing versioned object:", key)
-	// Get the first page of versions
-	var versions []*string
-	isTruncated := true
-	var nextVersion *string
-	for isTruncated {
-		resp, err := s.client.ListObjectVersions(&s3.ListObjectVersionsInput{
-			Bucket:          aws.String(s.config.Bucket),
-			Prefix:          aws.String(key),
-			VersionIdMarker: nextVersion,
-		})
-		if err != nil {
-			log.Errorln(err)
+	// Get all the versions of the object
+	versions, err := s.listVersions(key)
+	if err != nil {
+		log.Errorln(err)
+		return err
+	}
+
+	var objectVersions []ObjectVersion
+	for _, version := range versions {
+		if version.Key == key && !version.DeleteMarker {
+			objectVersions = append(objectVersions, version)
 		}
-		for _, version := range resp.Versions {
-			if *version.Key == key {
-				versions = append(versions, version.VersionId)
-			}
+	}
+	log.Debugln(objectVersions)
+
+	// Now, delete them
+	err = s.deleteVersions(objectVersions)
+	if err != nil {
+		log.Errorln(err)
+	}
+	return err
+}
+
+// Prune - Removes the versions of each object under the prefix which fall outside of the retention policy
+// If no policy is given, the policy from the backend config is used.
+func (s *S3Uploader) Prune(prefix string, policy *RetentionPolicy, dryRun bool) ([]ObjectVersion, error) {
+	if policy == nil {
+		policy = s.config.Retention
+	}
+	if policy == nil {
+		log.Debugf("No retention policy for %s, skipping\n", prefix)
+		return nil, nil
+	}
+
+	versions, err := s.listVersions(s.buildPrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the versions by object
+	objects := make(map[string][]ObjectVersion)
+	for _, version := range versions {
+		objects[version.Key] = append(objects[version.Key], version)
+	}
+
+	now := time.Now()
+	var expired []ObjectVersion
+	for _, objectVersions := range objects {
+		expired = append(expired, policy.Expired(objectVersions, now)...)
+	}
+	log.Debugf("Found %d expired versions under %s\n", len(expired), prefix)
+
+	if dryRun {
+		return expired, nil
+	}
+	return expired, s.deleteVersions(expired)
+}
+
+// ListVersions - Returns every version and delete marker of the file, newest first
+// Only the listing is used, HeadVersion fills in the metadata of the versions which need it
+func (s *S3Uploader) ListVersions(key string) ([]ObjectVersion, error) {
+	key = s.buildObjectKey(key)
+	versions, err := s.listVersions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var objectVersions []ObjectVersion
+	for _, version := range versions {
+		if version.Key == key {
+			objectVersions = append(objectVersions, version)
 		}
-		isTruncated = *resp.IsTruncated
-		nextVersion = resp.NextVersionIdMarker
 	}
 
-	// Delete all the versions
-	deleteObjects := []*s3.ObjectIdentifier{}
+	sort.SliceStable(objectVersions, func(i, j int) bool {
+		return objectVersions[i].LastModified.After(objectVersions[j].LastModified)
+	})
+	return objectVersions, nil
+}
+
+// ListObjects - Returns the current version of each object stored under the prefix
+// Only the listing is used, HeadVersion fills in the metadata of the objects which need it
+func (s *S3Uploader) ListObjects(prefix string) ([]ObjectVersion, error) {
+	versions, err := s.listVersions(s.buildPrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectVersion
 	for _, version := range versions {
-		deleteObjects = append(deleteObjects, &s3.ObjectIdentifier{
-			Key:       aws.String(key),
-			VersionId: version,
-		})
+		if version.IsLatest && !version.DeleteMarker {
+			objects = append(objects, version)
+		}
+	}
+	return objects, nil
+}
+
+// HeadVersion - Fill in the metadata of a listed version, which costs a request per version
+// Pointers report the size of the blob they point to. Delete markers don't have any metadata
+func (s *S3Uploader) HeadVersion(version *ObjectVersion) error {
+	if version.DeleteMarker {
+		return nil
+	}
+	head, err := s.headObject(version.Key, version.VersionID)
+	if err != nil {
+		return err
+	}
+	version.Metadata = fromS3Metadata(head.Metadata)
+	applyBlobSize(version, head.Metadata)
+	return nil
+}
+
+// Checksums - Returns the checksum of the current version of each object under the prefix
+// Checksums are only stored in the object metadata, so each object needs a HEAD request
+func (s *S3Uploader) Checksums(prefix string) (map[string]string, error) {
+	objects, err := s.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	root := s.buildPrefix("")
+	checksums := make(map[string]string, len(objects))
+	for _, object := range objects {
+		if err = s.HeadVersion(&object); err != nil {
+			return nil, err
+		}
+		checksums[strings.TrimPrefix(object.Key, root)] = object.Metadata.Checksum
+	}
+	return checksums, nil
+}
+
+// listVersions - Returns all the versions and delete markers stored under the given prefix
+func (s *S3Uploader) listVersions(prefix string) ([]ObjectVersion, error) {
+	var versions []ObjectVersion
+	err := s.client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			versions = append(versions, ObjectVersion{
+				Key:          aws.StringValue(version.Key),
+				VersionID:    aws.StringValue(version.VersionId),
+				LastModified: aws.TimeValue(version.LastModified),
+				Size:         aws.Int64Value(version.Size),
+				IsLatest:     aws.BoolValue(version.IsLatest),
+			})
+		}
+		for _, marker := range page.DeleteMarkers {
+			versions = append(versions, ObjectVersion{
+				Key:          aws.StringValue(marker.Key),
+				VersionID:    aws.StringValue(marker.VersionId),
+				LastModified: aws.TimeValue(marker.LastModified),
+				IsLatest:     aws.BoolValue(marker.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
-	log.Debugln(deleteObjects)
-	if len(deleteObjects) > 0 {
-		deleteRequest := &s3.DeleteObjectsInput{
+	return versions, nil
+}
+
+// deleteVersions - Deletes the given object versions, in batches that S3 will accept
+func (s *S3Uploader) deleteVersions(versions []ObjectVersion) error {
+	const maxBatch = 1000
+	var failed []*s3.Error
+	for start := 0; start < len(versions); start += maxBatch {
+		end := start + maxBatch
+		if end > len(versions) {
+			end = len(versions)
+		}
+
+		deleteObjects := []*s3.ObjectIdentifier{}
+		for _, version := range versions[start:end] {
+			deleteObjects = append(deleteObjects, &s3.ObjectIdentifier{
+				Key:       aws.String(version.Key),
+				VersionId: aws.String(version.VersionID),
+			})
+		}
+		output, err := s.client.DeleteObjects(&s3.DeleteObjectsInput{
 			Bucket: aws.String(s.config.Bucket),
 			Delete: &s3.Delete{
 				Objects: deleteObjects,
 			},
+		})
+		if err != nil {
+			return err
+		}
+		// The request succeeds even when some of the versions can't be deleted, such as those under object lock
+		failed = append(failed, output.Errors...)
+	}
+	if len(failed) > 0 {
+		first := failed[0]
+		return fmt.Errorf("unable to delete %d of %d versions, %s version %s: %s", len(failed), len(versions),
+			aws.StringValue(first.Key), aws.StringValue(first.VersionId), aws.StringValue(first.Message))
+	}
+	return nil
+}
+
+func toS3Metadata(objectMetadata *ObjectMetadata) map[string]*string {
+	metadata := make(map[string]*string)
+	metadata[checksumKey] = aws.String(objectMetadata.Checksum)
+
+	optional := map[string]string{
+		hostnameKey:      objectMetadata.Hostname,
+		machineIDKey:     objectMetadata.MachineID,
+		watcherKey:       objectMetadata.Watcher,
+		eventKey:         objectMetadata.Event,
+		backerVersionKey: objectMetadata.BackerVersion,
+	}
+	if !objectMetadata.ModTime.IsZero() {
+		optional[modTimeKey] = objectMetadata.ModTime.UTC().Format(time.RFC3339)
+	}
+	for key, value := range optional {
+		if value != "" {
+			metadata[key] = aws.String(value)
+		}
+	}
+	return metadata
+}
+
+func fromS3Metadata(metadata map[string]*string) *ObjectMetadata {
+	objectMetadata := &ObjectMetadata{
+		Checksum:      aws.StringValue(metadata[checksumKey]),
+		Hostname:      aws.StringValue(metadata[hostnameKey]),
+		MachineID:     aws.StringValue(metadata[machineIDKey]),
+		Watcher:       aws.StringValue(metadata[watcherKey]),
+		Event:         aws.StringValue(metadata[eventKey]),
+		BackerVersion: aws.StringValue(metadata[backerVersionKey]),
+	}
+	modTime, err := time.Parse(time.RFC3339, aws.StringValue(metadata[modTimeKey]))
+	if err == nil {
+		objectMetadata.ModTime = modTime
+	}
+	return objectMetadata
+}
+
+// Largest object which CopyObject accepts, larger objects are copied in parts
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// Size of each part of a multipart copy, grown when needed to stay within the part limit of S3
+const (
+	copyPartSize = 512 * 1024 * 1024
+	maxCopyParts = 10000
+)
+
+// MoveObject - Copy every version of an object to a new key, oldest first, and remove them from the old one
+// Returns the number of versions which were moved, which is zero if there is nothing to move
+func (s *S3Uploader) MoveObject(from string, to string) (int, error) {
+	versions, err := s.ListVersions(from)
+	if err != nil {
+		return 0, err
+	}
+
+	toKey := s.buildObjectKey(to)
+	moved := 0
+	// Listed newest first, copying them the other way around keeps the latest version on top
+	for idx := len(versions) - 1; idx >= 0; idx-- {
+		version := versions[idx]
+		if version.DeleteMarker {
+			continue
+		}
+		head, err := s.headObject(version.Key, version.VersionID)
+		if err != nil {
+			return moved, err
+		}
+
+		log.Printf("Moving %s version %s to %s\n", version.Key, version.VersionID, toKey)
+		source := url.PathEscape(s.config.Bucket+"/"+version.Key) + "?versionId=" + url.QueryEscape(version.VersionID)
+		if aws.Int64Value(head.ContentLength) > maxCopySize {
+			err = s.copyParts(source, version.Key, toKey, head)
+		} else {
+			err = s.copyObject(source, toKey, head)
 		}
-		// Now, delete them
-		_, err := s.client.DeleteObjects(deleteRequest)
 		if err != nil {
-			log.Errorln(err)
+			return moved, err
 		}
+		moved++
 	}
+	if moved == 0 {
+		return 0, nil
+	}
+
+	// The delete markers go as well, so the old key is gone from the history entirely
+	if err = s.deleteVersions(versions); err != nil {
+		return moved, err
+	}
+	return moved, nil
 }
 
-func (s *S3Uploader) buildObjectKey(file string, watcherPath string) string {
-	// if !s.config.Versioning {
-	// 	// Build versioned string
-	// 	versionedFileName := path.Base(file) + time.Now().String()
-	// 	return path.Join(s.config.BucketRoot, watcherPath, versionedFileName)
-	// }
-	return path.Join(s.config.BucketRoot, watcherPath, path.Base(file))
+// copyObject - Copy an object of up to 5GB in a single request
+func (s *S3Uploader) copyObject(source string, toKey string, head *s3.HeadObjectOutput) error {
+	algorithm, customerKey, err := s.customerKey()
+	if err != nil {
+		return err
+	}
+	// Copies are made in the standard class unless told otherwise, tags and metadata come along by default
+	input := &s3.CopyObjectInput{
+		Bucket:       aws.String(s.config.Bucket),
+		CopySource:   aws.String(source),
+		Key:          aws.String(toKey),
+		StorageClass: head.StorageClass,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s.encryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = algorithm, customerKey
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = algorithm, customerKey
+	_, err = s.client.CopyObject(input)
+	return err
+}
+
+// copyParts - Copy a large object with a multipart upload, the metadata and tags have to be carried over by hand
+func (s *S3Uploader) copyParts(source string, fromKey string, toKey string, head *s3.HeadObjectOutput) error {
+	algorithm, customerKey, err := s.customerKey()
+	if err != nil {
+		return err
+	}
+	tagging, err := s.client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket:    aws.String(s.config.Bucket),
+		Key:       aws.String(fromKey),
+		VersionId: head.VersionId,
+	})
+	if err != nil {
+		return err
+	}
+	tags := url.Values{}
+	for _, tag := range tagging.TagSet {
+		tags.Set(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+	}
+
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(s.config.Bucket),
+		Key:          aws.String(toKey),
+		ContentType:  head.ContentType,
+		Metadata:     head.Metadata,
+		StorageClass: head.StorageClass,
+	}
+	if len(tags) > 0 {
+		create.Tagging = aws.String(tags.Encode())
+	}
+	create.ServerSideEncryption, create.SSEKMSKeyId = s.encryption()
+	create.SSECustomerAlgorithm, create.SSECustomerKey = algorithm, customerKey
+	upload, err := s.client.CreateMultipartUpload(create)
+	if err != nil {
+		return err
+	}
+
+	size := aws.Int64Value(head.ContentLength)
+	partSize := int64(copyPartSize)
+	if size/maxCopyParts >= partSize {
+		partSize = size/maxCopyParts + 1
+	}
+	var parts []*s3.CompletedPart
+	for number, start := int64(1), int64(0); start < size; number, start = number+1, start+partSize {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		input := &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.config.Bucket),
+			Key:             aws.String(toKey),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      aws.Int64(number),
+			UploadId:        upload.UploadId,
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = algorithm, customerKey
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = algorithm, customerKey
+		part, err := s.client.UploadPartCopy(input)
+		if err != nil {
+			s.abortUpload(toKey, upload.UploadId)
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+	}
+
+	_, err = s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.Bucket),
+		Key:             aws.String(toKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortUpload(toKey, upload.UploadId)
+	}
+	return err
+}
+
+// abortUpload - Remove the parts of a failed multipart upload, so they aren't billed
+func (s *S3Uploader) abortUpload(key string, uploadID *string) {
+	_, err := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Errorf("Unable to abort the upload of %s: %s\n", key, err)
+	}
+}
+
+func (s *S3Uploader) buildObjectKey(key string) string {
+	return path.Join(s.config.BucketRoot, key)
+}
+
+// buildPrefix - Returns the listing prefix for all the objects under the given directory
+func (s *S3Uploader) buildPrefix(prefix string) string {
+	fullPrefix := path.Join(s.config.BucketRoot, prefix)
+	if fullPrefix == "" {
+		return ""
+	}
+	return fullPrefix + "/"
 }
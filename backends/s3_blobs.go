@@ -0,0 +1,254 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Location of the content addressed file bodies, relative to the bucket root
+const blobPrefix = "blobs/sha256"
+
+// Unreferenced blobs younger than this are never collected,
+// so that uploads which are still writing their pointers are not left dangling
+const blobGracePeriod = 24 * time.Hour
+
+// Blobs older than this are copied onto themselves when they're reused, so they stay within the grace period
+// until the new pointer is written
+const blobRefreshAge = blobGracePeriod / 2
+
+// These need to be capitalized
+const (
+	blobKey     = "Blob"
+	blobSizeKey = "Blob-Size"
+)
+
+// blobPointer - Body of the object stored at the key of each file, when content addressing is enabled
+type blobPointer struct {
+	Blob     string `json:"blob"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+}
+
+// uploadContentAddressed - Store the file body once under its checksum, and point the file key at it
+// If the body already exists anywhere in the bucket, this only costs two HEAD requests and the pointer upload
+func (s *S3Uploader) uploadContentAddressed(name string, key string, object io.Reader, objectMetadata *ObjectMetadata) error {
+	blob := path.Join(blobPrefix, objectMetadata.Checksum)
+	blobObjectKey := s.buildObjectKey(blob)
+
+	head, err := s.headBlob(blobObjectKey)
+	if err != nil {
+		return err
+	}
+	exists := head != nil
+	var size int64
+	if exists {
+		size = aws.Int64Value(head.ContentLength)
+		// Garbage collection may already consider the blob unreferenced, refreshing it keeps it for another grace period
+		if time.Since(aws.TimeValue(head.LastModified)) > blobRefreshAge {
+			if err = s.refreshBlob(blobObjectKey, head); err != nil {
+				return err
+			}
+		}
+	} else if size, err = s.uploadBlob(blobObjectKey, object, objectMetadata); err != nil {
+		return err
+	}
+
+	pointer, err := json.Marshal(&blobPointer{
+		Blob:     blob,
+		Checksum: objectMetadata.Checksum,
+		Size:     size,
+	})
+	if err != nil {
+		return err
+	}
+
+	metadata := toS3Metadata(objectMetadata)
+	metadata[blobKey] = aws.String(blob)
+	metadata[blobSizeKey] = aws.String(strconv.FormatInt(size, 10))
+
+	tags, err := s.tagging(objectMetadata)
+	if err != nil {
+		return err
+	}
+	objectKey := s.buildObjectKey(key)
+	log.Println("Uploading pointer:", objectKey)
+	_, err = s.putObject(objectKey, bytes.NewReader(pointer), metadata, s.storageClass(objectMetadata), tags)
+	if err != nil || !exists {
+		return err
+	}
+
+	// Garbage collection may have removed the blob after it was checked, but before the pointer was written
+	// The body hasn't been read yet, so the blob can still be uploaded again
+	head, err = s.headBlob(blobObjectKey)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		log.Warnf("Blob %s was removed while uploading %s, uploading it again\n", blobObjectKey, name)
+		_, err = s.uploadBlob(blobObjectKey, object, objectMetadata)
+		return err
+	}
+	log.Debugf("Blob %s already exists, skipped upload of %s\n", blobObjectKey, name)
+	// Drain the reader, otherwise the file can't be sent to the other backends
+	_, err = io.Copy(ioutil.Discard, object)
+	return err
+}
+
+// uploadBlob - Store the file body under its checksum, returning its size
+func (s *S3Uploader) uploadBlob(blobObjectKey string, object io.Reader, objectMetadata *ObjectMetadata) (int64, error) {
+	log.Println("Uploading blob:", blobObjectKey)
+	counter := NewCountingReader(object)
+	// Blobs may be shared by files from other watchers and hosts, so they aren't tagged
+	_, err := s.putObject(blobObjectKey, counter, map[string]*string{
+		checksumKey: aws.String(objectMetadata.Checksum),
+	}, s.storageClass(objectMetadata), nil)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Count(), nil
+}
+
+// headBlob - Returns the headers of the blob, or nil if it doesn't exist
+func (s *S3Uploader) headBlob(blobObjectKey string) (*s3.HeadObjectOutput, error) {
+	head, err := s.headObject(blobObjectKey, "")
+	if err != nil {
+		if requestErr, ok := err.(s3.RequestFailure); ok && requestErr.StatusCode() == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return head, nil
+}
+
+// refreshBlob - Copy the blob onto itself, so garbage collection sees it as a new upload
+// Collection only deletes the versions it listed, so the copy survives even if the blob was already picked
+func (s *S3Uploader) refreshBlob(blobObjectKey string, head *s3.HeadObjectOutput) error {
+	log.Debugln("Refreshing blob:", blobObjectKey)
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.config.Bucket),
+		CopySource: aws.String(url.PathEscape(s.config.Bucket + "/" + blobObjectKey)),
+		Key:        aws.String(blobObjectKey),
+		// S3 refuses to copy an object onto itself unless something changes
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          head.Metadata,
+		StorageClass:      head.StorageClass,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s.encryption()
+	_, err := s.client.CopyObject(input)
+	return err
+}
+
+// resolveBlob - If the object is a pointer, return the body of the blob it points to
+func (s *S3Uploader) resolveBlob(object *s3.GetObjectOutput) (io.ReadCloser, error) {
+	blob := aws.StringValue(object.Metadata[blobKey])
+	if blob == "" {
+		return object.Body, nil
+	}
+	object.Body.Close()
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.buildObjectKey(blob)),
+	}
+	var err error
+	input.SSECustomerAlgorithm, input.SSECustomerKey, err = s.customerKey()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// applyBlobSize - Pointers are tiny, so report the size of the blob instead
+func applyBlobSize(version *ObjectVersion, metadata map[string]*string) {
+	size, err := strconv.ParseInt(aws.StringValue(metadata[blobSizeKey]), 10, 64)
+	if err == nil {
+		version.Size = size
+	}
+}
+
+// CollectGarbage - Removes blobs which are no longer referenced by any version of any object in the bucket
+// This should run after the retention policies have been applied, so expired versions no longer hold references.
+func (s *S3Uploader) CollectGarbage(dryRun bool) ([]ObjectVersion, error) {
+	if !s.config.ContentAddressed {
+		return nil, nil
+	}
+
+	// Pointers from every host count, not just the ones from this machine
+	versions, err := s.listVersions(s.buildPrefix(""))
+	if err != nil {
+		return nil, err
+	}
+
+	blobRoot := s.buildPrefix(blobPrefix)
+	blobs := make(map[string][]ObjectVersion)
+	referenced := make(map[string]bool)
+	for _, version := range versions {
+		if strings.HasPrefix(version.Key, blobRoot) {
+			blobs[version.Key] = append(blobs[version.Key], version)
+			continue
+		}
+		if version.DeleteMarker {
+			continue
+		}
+		head, err := s.headObject(version.Key, version.VersionID)
+		if err != nil {
+			return nil, err
+		}
+		if blob := aws.StringValue(head.Metadata[blobKey]); blob != "" {
+			referenced[s.buildObjectKey(blob)] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-blobGracePeriod)
+	var garbage []ObjectVersion
+	for key, blobVersions := range blobs {
+		recent := false
+		for _, version := range blobVersions {
+			if version.LastModified.After(cutoff) {
+				recent = true
+			}
+		}
+		if referenced[key] || recent {
+			// Refreshing a blob leaves its previous versions behind, they hold the same body
+			for _, version := range blobVersions {
+				if !version.IsLatest && version.LastModified.Before(cutoff) {
+					garbage = append(garbage, version)
+				}
+			}
+			continue
+		}
+
+		// The blob may have been reused since it was listed, which refreshes it
+		head, err := s.headBlob(key)
+		if err != nil {
+			return nil, err
+		}
+		if head != nil && aws.TimeValue(head.LastModified).After(cutoff) {
+			log.Debugf("Blob %s was reused while collecting garbage\n", key)
+			continue
+		}
+		garbage = append(garbage, blobVersions...)
+	}
+	log.Debugf("Found %d unreferenced blob versions\n", len(garbage))
+
+	if dryRun {
+		return garbage, nil
+	}
+	return garbage, s.deleteVersions(garbage)
+}
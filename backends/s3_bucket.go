@@ -0,0 +1,582 @@
+package backends
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Object lock retention modes
+const (
+	LockGovernance = "GOVERNANCE" // Users with s3:BypassGovernanceRetention may still delete versions
+	LockCompliance = "COMPLIANCE" // Nobody can delete versions until their retention has passed
+)
+
+// Values of bucket settings which aren't applied
+const (
+	settingMissing  = "missing"
+	settingAbsent   = "absent"
+	settingDisabled = "disabled"
+)
+
+// transitionClasses - Classes lifecycle rules may move objects to
+var transitionClasses = map[string]bool{
+	s3.TransitionStorageClassStandardIa: true,
+	"ONEZONE_IA":                        true,
+	"INTELLIGENT_TIERING":               true,
+	"GLACIER_IR":                        true,
+	s3.TransitionStorageClassGlacier:    true,
+	"DEEP_ARCHIVE":                      true,
+}
+
+// LifecycleRule - Lifecycle rule of the bucket, managed from the config and matched to the bucket rules by ID
+type LifecycleRule struct {
+	ID                        string                `json:"id"`
+	Prefix                    string                `json:"prefix"` // Relative to the bucket root
+	Tags                      map[string]string     `json:"tags,omitempty"`
+	ExpireDays                int64                 `json:"expireDays"`
+	ExpireNoncurrentDays      int64                 `json:"expireNoncurrentDays"`
+	Transitions               []LifecycleTransition `json:"transitions,omitempty"`
+	NoncurrentTransitions     []LifecycleTransition `json:"noncurrentTransitions,omitempty"`
+	AbortIncompleteUploadDays int64                 `json:"abortIncompleteUploadDays"`
+}
+
+// LifecycleTransition - Move objects to another storage class, a number of days after they're created or replaced
+type LifecycleTransition struct {
+	Days         int64  `json:"days"`
+	StorageClass string `json:"storageClass"`
+}
+
+// ObjectLockOptions - Default retention of new object versions, which can't be deleted until it has passed
+type ObjectLockOptions struct {
+	Mode  string `json:"mode"` // GOVERNANCE or COMPLIANCE
+	Days  int64  `json:"days"`
+	Years int64  `json:"years"`
+}
+
+// BucketSetting - A bucket setting managed from the config, as configured and as applied to the bucket
+type BucketSetting struct {
+	Setting  string
+	Expected string
+	Actual   string
+	InSync   bool
+}
+
+func newBucketSetting(setting string, expected string, actual string) BucketSetting {
+	return BucketSetting{Setting: setting, Expected: expected, Actual: actual, InSync: expected == actual}
+}
+
+// Validate - Ensure the rule can be applied, without contacting S3
+func (r *LifecycleRule) Validate() error {
+	if r.ID == "" || len(r.ID) > 255 {
+		return errors.New("lifecycle rule IDs must be between 1 and 255 characters")
+	}
+	if r.ExpireDays == 0 && r.ExpireNoncurrentDays == 0 && len(r.Transitions) == 0 && len(r.NoncurrentTransitions) == 0 && r.AbortIncompleteUploadDays == 0 {
+		return fmt.Errorf("lifecycle rule %s has no actions", r.ID)
+	}
+	if r.ExpireDays < 0 || r.ExpireNoncurrentDays < 0 || r.AbortIncompleteUploadDays < 0 {
+		return fmt.Errorf("lifecycle rule %s has a negative number of days", r.ID)
+	}
+	if r.AbortIncompleteUploadDays > 0 && len(r.Tags) > 0 {
+		return fmt.Errorf("lifecycle rule %s can't abort incomplete uploads of tagged objects", r.ID)
+	}
+	for _, transition := range append(append([]LifecycleTransition(nil), r.Transitions...), r.NoncurrentTransitions...) {
+		if !transitionClasses[transition.StorageClass] {
+			return fmt.Errorf("lifecycle rule %s can't transition to storage class %s", r.ID, transition.StorageClass)
+		}
+		if transition.Days < 0 {
+			return fmt.Errorf("lifecycle rule %s has a negative number of days", r.ID)
+		}
+	}
+	return nil
+}
+
+// Validate - Ensure the default retention is complete
+func (o *ObjectLockOptions) Validate() error {
+	if o.Mode != LockGovernance && o.Mode != LockCompliance {
+		return fmt.Errorf("unknown object lock mode %q, expected %s or %s", o.Mode, LockGovernance, LockCompliance)
+	}
+	if (o.Days > 0) == (o.Years > 0) {
+		return errors.New("object lock needs a number of days or years, but not both")
+	}
+	if o.Days < 0 || o.Years < 0 {
+		return errors.New("object lock retention can't be negative")
+	}
+	return nil
+}
+
+// validateBucket - Check the lifecycle rules and object lock of the backend
+func (o *S3Options) validateBucket() error {
+	ids := make(map[string]bool)
+	for idx := range o.Lifecycle {
+		rule := &o.Lifecycle[idx]
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if ids[rule.ID] {
+			return fmt.Errorf("lifecycle rule %s is defined more than once", rule.ID)
+		}
+		ids[rule.ID] = true
+	}
+	if o.ObjectLock != nil {
+		if !o.Versioning {
+			return errors.New("object lock needs versioning")
+		}
+		return o.ObjectLock.Validate()
+	}
+	return nil
+}
+
+// CheckBucket - Compare the versioning, lifecycle rules and object lock of the bucket with the config
+// Settings which aren't in the config aren't managed by backer, and aren't reported
+func (s *S3Uploader) CheckBucket() ([]BucketSetting, error) {
+	var settings []BucketSetting
+	if s.config.Versioning {
+		versioning, err := s.client.GetBucketVersioning(&s3.GetBucketVersioningInput{
+			Bucket: aws.String(s.config.Bucket),
+		})
+		if err != nil {
+			return nil, err
+		}
+		status := aws.StringValue(versioning.Status)
+		if status == "" {
+			status = settingDisabled
+		}
+		settings = append(settings, newBucketSetting("versioning", s3.BucketVersioningStatusEnabled, status))
+	}
+
+	lifecycle, err := s.lifecycleSettings()
+	if err != nil {
+		return nil, err
+	}
+	settings = append(settings, lifecycle...)
+
+	lock, err := s.objectLockSetting()
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		settings = append(settings, *lock)
+	}
+	return settings, nil
+}
+
+// ApplyBucketSettings - Create the bucket if the config asks for it, and bring its lifecycle rules in line with the config
+// Only backer backend apply changes the bucket, object lock is applied separately by ApplyObjectLock
+func (s *S3Uploader) ApplyBucketSettings() error {
+	if s.config.CreateBucket {
+		if err := s.createBucket(); err != nil {
+			return err
+		}
+	}
+	lifecycle, err := s.lifecycleSettings()
+	if err != nil {
+		return err
+	}
+	if !allInSync(lifecycle) {
+		if err = s.putLifecycle(); err != nil {
+			return fmt.Errorf("unable to update lifecycle rules: %s", err)
+		}
+	}
+	return nil
+}
+
+// warnBucketSettings - Log the settings of the bucket which don't match the config, without changing any of them
+// Hosts which are only allowed to upload may not be able to read the settings, which doesn't stop them from uploading
+func (s *S3Uploader) warnBucketSettings() {
+	settings, err := s.CheckBucket()
+	if err != nil {
+		log.Warnf("Unable to check the settings of bucket %s: %s\n", s.config.Bucket, err)
+		return
+	}
+	for _, setting := range settings {
+		if !setting.InSync {
+			log.Warnf("The %s of bucket %s is %s rather than %s, run backer backend apply to change it\n", setting.Setting, s.config.Bucket, setting.Actual, setting.Expected)
+		}
+	}
+}
+
+// ApplyObjectLock - Set the default object lock of the bucket to match the config
+// Versions written afterwards can't be deleted until their retention has passed
+func (s *S3Uploader) ApplyObjectLock() error {
+	lock, err := s.objectLockSetting()
+	if err != nil {
+		return err
+	}
+	if lock != nil && !lock.InSync {
+		log.Printf("Setting default object lock of bucket %s to %s\n", s.config.Bucket, lock.Expected)
+		if err = s.putObjectLock(); err != nil {
+			return fmt.Errorf("unable to update object lock: %s", err)
+		}
+	}
+	return nil
+}
+
+func allInSync(settings []BucketSetting) bool {
+	for _, setting := range settings {
+		if !setting.InSync {
+			return false
+		}
+	}
+	return true
+}
+
+// lifecycleSettings - Compare each rule of the bucket with the config, by ID
+// An empty list of rules in the config removes every rule from the bucket
+func (s *S3Uploader) lifecycleSettings() ([]BucketSetting, error) {
+	if s.config.Lifecycle == nil {
+		return nil, nil
+	}
+	actual := make(map[string]string)
+	output, err := s.client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.config.Bucket),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NoSuchLifecycleConfiguration" {
+			return nil, err
+		}
+	} else {
+		for _, rule := range output.Rules {
+			actual[aws.StringValue(rule.ID)] = s.fromS3Rule(rule).describe(aws.StringValue(rule.Status))
+		}
+	}
+
+	var settings []BucketSetting
+	for _, rule := range s.config.Lifecycle {
+		applied, ok := actual[rule.ID]
+		if !ok {
+			applied = settingMissing
+		}
+		settings = append(settings, newBucketSetting("lifecycle/"+rule.ID, rule.describe(s3.ExpirationStatusEnabled), applied))
+		delete(actual, rule.ID)
+	}
+
+	// Rules which aren't in the config are removed when the rules are applied
+	extra := make([]string, 0, len(actual))
+	for id := range actual {
+		extra = append(extra, id)
+	}
+	sort.Strings(extra)
+	for _, id := range extra {
+		settings = append(settings, newBucketSetting("lifecycle/"+id, settingAbsent, actual[id]))
+	}
+	return settings, nil
+}
+
+func (s *S3Uploader) putLifecycle() error {
+	if len(s.config.Lifecycle) == 0 {
+		log.Printf("Removing lifecycle rules of bucket %s\n", s.config.Bucket)
+		_, err := s.client.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(s.config.Bucket),
+		})
+		return err
+	}
+
+	log.Printf("Updating lifecycle rules of bucket %s\n", s.config.Bucket)
+	rules := make([]*s3.LifecycleRule, len(s.config.Lifecycle))
+	for idx, rule := range s.config.Lifecycle {
+		rules[idx] = s.toS3Rule(rule)
+	}
+	_, err := s.client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.config.Bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	return err
+}
+
+// toS3Rule - The rule as sent to S3, with the prefix under the bucket root
+func (s *S3Uploader) toS3Rule(rule LifecycleRule) *s3.LifecycleRule {
+	prefix := s.buildPrefix("") + rule.Prefix
+	s3Rule := &s3.LifecycleRule{
+		ID:     aws.String(rule.ID),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{},
+	}
+
+	keys := sortedKeys(rule.Tags)
+	switch {
+	case len(keys) == 0:
+		s3Rule.Filter.Prefix = aws.String(prefix)
+	case len(keys) == 1 && prefix == "":
+		s3Rule.Filter.Tag = &s3.Tag{Key: aws.String(keys[0]), Value: aws.String(rule.Tags[keys[0]])}
+	default:
+		and := &s3.LifecycleRuleAndOperator{}
+		if prefix != "" {
+			and.Prefix = aws.String(prefix)
+		}
+		for _, key := range keys {
+			and.Tags = append(and.Tags, &s3.Tag{Key: aws.String(key), Value: aws.String(rule.Tags[key])})
+		}
+		s3Rule.Filter.And = and
+	}
+
+	if rule.ExpireDays > 0 {
+		s3Rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(rule.ExpireDays)}
+	}
+	if rule.ExpireNoncurrentDays > 0 {
+		s3Rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(rule.ExpireNoncurrentDays)}
+	}
+	for _, transition := range rule.Transitions {
+		s3Rule.Transitions = append(s3Rule.Transitions, &s3.Transition{
+			Days:         aws.Int64(transition.Days),
+			StorageClass: aws.String(transition.StorageClass),
+		})
+	}
+	for _, transition := range rule.NoncurrentTransitions {
+		s3Rule.NoncurrentVersionTransitions = append(s3Rule.NoncurrentVersionTransitions, &s3.NoncurrentVersionTransition{
+			NoncurrentDays: aws.Int64(transition.Days),
+			StorageClass:   aws.String(transition.StorageClass),
+		})
+	}
+	if rule.AbortIncompleteUploadDays > 0 {
+		s3Rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(rule.AbortIncompleteUploadDays),
+		}
+	}
+	return s3Rule
+}
+
+// fromS3Rule - A rule of the bucket, in the form used by the config
+func (s *S3Uploader) fromS3Rule(s3Rule *s3.LifecycleRule) LifecycleRule {
+	rule := LifecycleRule{ID: aws.StringValue(s3Rule.ID)}
+	prefix := aws.StringValue(s3Rule.Prefix)
+	var tags []*s3.Tag
+	if filter := s3Rule.Filter; filter != nil {
+		switch {
+		case filter.And != nil:
+			prefix = aws.StringValue(filter.And.Prefix)
+			tags = filter.And.Tags
+		case filter.Tag != nil:
+			tags = []*s3.Tag{filter.Tag}
+		default:
+			prefix = aws.StringValue(filter.Prefix)
+		}
+	}
+	rule.Prefix = strings.TrimPrefix(prefix, s.buildPrefix(""))
+	if len(tags) > 0 {
+		rule.Tags = make(map[string]string, len(tags))
+		for _, tag := range tags {
+			rule.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+
+	if s3Rule.Expiration != nil {
+		rule.ExpireDays = aws.Int64Value(s3Rule.Expiration.Days)
+	}
+	if s3Rule.NoncurrentVersionExpiration != nil {
+		rule.ExpireNoncurrentDays = aws.Int64Value(s3Rule.NoncurrentVersionExpiration.NoncurrentDays)
+	}
+	for _, transition := range s3Rule.Transitions {
+		rule.Transitions = append(rule.Transitions, LifecycleTransition{
+			Days:         aws.Int64Value(transition.Days),
+			StorageClass: aws.StringValue(transition.StorageClass),
+		})
+	}
+	for _, transition := range s3Rule.NoncurrentVersionTransitions {
+		rule.NoncurrentTransitions = append(rule.NoncurrentTransitions, LifecycleTransition{
+			Days:         aws.Int64Value(transition.NoncurrentDays),
+			StorageClass: aws.StringValue(transition.StorageClass),
+		})
+	}
+	if s3Rule.AbortIncompleteMultipartUpload != nil {
+		rule.AbortIncompleteUploadDays = aws.Int64Value(s3Rule.AbortIncompleteMultipartUpload.DaysAfterInitiation)
+	}
+	return rule
+}
+
+// describe - Summary of the rule, which is the same for equal rules
+func (r LifecycleRule) describe(status string) string {
+	var parts []string
+	if status != s3.ExpirationStatusEnabled {
+		parts = append(parts, settingDisabled)
+	}
+	if r.Prefix != "" {
+		parts = append(parts, "prefix="+r.Prefix)
+	}
+	for _, key := range sortedKeys(r.Tags) {
+		parts = append(parts, fmt.Sprintf("tag:%s=%s", key, r.Tags[key]))
+	}
+	if r.ExpireDays > 0 {
+		parts = append(parts, fmt.Sprintf("expire=%dd", r.ExpireDays))
+	}
+	if r.ExpireNoncurrentDays > 0 {
+		parts = append(parts, fmt.Sprintf("expireNoncurrent=%dd", r.ExpireNoncurrentDays))
+	}
+	for _, transition := range r.Transitions {
+		parts = append(parts, fmt.Sprintf("transition=%dd:%s", transition.Days, transition.StorageClass))
+	}
+	for _, transition := range r.NoncurrentTransitions {
+		parts = append(parts, fmt.Sprintf("noncurrentTransition=%dd:%s", transition.Days, transition.StorageClass))
+	}
+	if r.AbortIncompleteUploadDays > 0 {
+		parts = append(parts, fmt.Sprintf("abortIncompleteUpload=%dd", r.AbortIncompleteUploadDays))
+	}
+	return strings.Join(parts, " ")
+}
+
+// describe - Summary of the default retention
+func (o *ObjectLockOptions) describe() string {
+	if o.Years > 0 {
+		return fmt.Sprintf("%s %d years", o.Mode, o.Years)
+	}
+	return fmt.Sprintf("%s %d days", o.Mode, o.Days)
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The vendored SDK predates object lock, so its requests are built here, in the same way as the generated operations
+
+type objectLockConfiguration struct {
+	_ struct{} `type:"structure"`
+
+	ObjectLockEnabled *string         `type:"string"`
+	Rule              *objectLockRule `type:"structure"`
+}
+
+type objectLockRule struct {
+	_ struct{} `type:"structure"`
+
+	DefaultRetention *objectLockRetention `type:"structure"`
+}
+
+type objectLockRetention struct {
+	_ struct{} `type:"structure"`
+
+	Mode  *string `type:"string"`
+	Days  *int64  `type:"integer"`
+	Years *int64  `type:"integer"`
+}
+
+type getObjectLockInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+}
+
+type getObjectLockOutput struct {
+	_ struct{} `type:"structure" payload:"ObjectLockConfiguration"`
+
+	ObjectLockConfiguration *objectLockConfiguration `type:"structure"`
+}
+
+type putObjectLockInput struct {
+	_ struct{} `type:"structure" payload:"ObjectLockConfiguration"`
+
+	Bucket                  *string                  `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	ObjectLockConfiguration *objectLockConfiguration `locationName:"ObjectLockConfiguration" type:"structure" xmlURI:"http://s3.amazonaws.com/doc/2006-03-01/"`
+}
+
+type putObjectLockOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// objectLockSetting - Compare the default retention of the bucket with the config, nil when it isn't configured
+func (s *S3Uploader) objectLockSetting() (*BucketSetting, error) {
+	if s.config.ObjectLock == nil {
+		return nil, nil
+	}
+	output := &getObjectLockOutput{}
+	err := s.bucketRequest("GetObjectLockConfiguration", "GET", &getObjectLockInput{Bucket: aws.String(s.config.Bucket)}, output).Send()
+	actual := settingDisabled
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "ObjectLockConfigurationNotFoundError" {
+			return nil, err
+		}
+	} else if config := output.ObjectLockConfiguration; config != nil && aws.StringValue(config.ObjectLockEnabled) == "Enabled" {
+		actual = "enabled"
+		if config.Rule != nil && config.Rule.DefaultRetention != nil {
+			retention := config.Rule.DefaultRetention
+			actual = (&ObjectLockOptions{
+				Mode:  aws.StringValue(retention.Mode),
+				Days:  aws.Int64Value(retention.Days),
+				Years: aws.Int64Value(retention.Years),
+			}).describe()
+		}
+	}
+	setting := newBucketSetting("objectLock", s.config.ObjectLock.describe(), actual)
+	return &setting, nil
+}
+
+// putObjectLock - Enable object lock on the bucket, which can't be turned off again
+func (s *S3Uploader) putObjectLock() error {
+	retention := &objectLockRetention{Mode: aws.String(s.config.ObjectLock.Mode)}
+	if s.config.ObjectLock.Years > 0 {
+		retention.Years = aws.Int64(s.config.ObjectLock.Years)
+	} else {
+		retention.Days = aws.Int64(s.config.ObjectLock.Days)
+	}
+	req := s.bucketRequest("PutObjectLockConfiguration", "PUT", &putObjectLockInput{
+		Bucket: aws.String(s.config.Bucket),
+		ObjectLockConfiguration: &objectLockConfiguration{
+			ObjectLockEnabled: aws.String("Enabled"),
+			Rule:              &objectLockRule{DefaultRetention: retention},
+		},
+	}, &putObjectLockOutput{})
+	req.Handlers.Build.PushBack(contentMD5)
+	return req.Send()
+}
+
+// bucketRequest - Request for an object lock operation on the bucket
+func (s *S3Uploader) bucketRequest(name string, method string, input interface{}, output interface{}) *request.Request {
+	req := s.client.NewRequest(&request.Operation{
+		Name:       name,
+		HTTPMethod: method,
+		HTTPPath:   "/{Bucket}?object-lock",
+	}, input, output)
+	// The SDK can only move the buckets of its own operations into the host name
+	req.Handlers.Build.PushBack(s.bucketInHost)
+	return req
+}
+
+// bucketInHost - Address the bucket in the host name, as the generated operations do
+func (s *S3Uploader) bucketInHost(r *request.Request) {
+	bucket := s.config.Bucket
+	if aws.BoolValue(r.Config.S3ForcePathStyle) || strings.Contains(bucket, ".") {
+		return
+	}
+	u := r.HTTPRequest.URL
+	u.Host = bucket + "." + u.Host
+	u.Path = strings.TrimPrefix(u.Path, "/"+bucket)
+	u.RawPath = strings.TrimPrefix(u.RawPath, "/"+bucket)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+}
+
+// contentMD5 - S3 requires a checksum of the body for bucket configuration changes
+func contentMD5(r *request.Request) {
+	if r.Body == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		_, err = r.Body.Seek(r.BodyStart, io.SeekStart)
+	}
+	if err != nil {
+		r.Error = awserr.New("ContentMD5", "failed to compute body MD5", err)
+		return
+	}
+	sum := md5.Sum(body)
+	r.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+}
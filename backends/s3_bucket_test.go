@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBucket - Stores the bucket configuration documents it's sent, and returns them
+type fakeBucket struct {
+	sync.Mutex
+	documents map[string][]byte
+	puts      []string
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	var setting string
+	for _, name := range []string{"versioning", "lifecycle", "object-lock"} {
+		if _, ok := r.URL.Query()[name]; ok {
+			setting = name
+		}
+	}
+
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("Content-MD5") == "" {
+			http.Error(w, "<Error><Code>InvalidRequest</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.documents[setting] = body
+		f.puts = append(f.puts, setting)
+	case "DELETE":
+		delete(f.documents, setting)
+		f.puts = append(f.puts, setting)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		body, ok := f.documents[setting]
+		if !ok {
+			codes := map[string]string{"lifecycle": "NoSuchLifecycleConfiguration", "object-lock": "ObjectLockConfigurationNotFoundError"}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>" + codes[setting] + "</Code></Error>"))
+			return
+		}
+		w.Write(body)
+	}
+}
+
+func TestBucketSettings(t *testing.T) {
+	bucket := &fakeBucket{documents: map[string][]byte{
+		"versioning": []byte(`<VersioningConfiguration><Status>Suspended</Status></VersioningConfiguration>`),
+		"lifecycle": []byte(`<LifecycleConfiguration><Rule><ID>manual</ID><Status>Enabled</Status>
+			<Filter><Prefix>tmp/</Prefix></Filter><Expiration><Days>1</Days></Expiration></Rule></LifecycleConfiguration>`),
+	}}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	sess := testSession(server, true)
+	options := &S3Options{
+		Region:     "mock-region",
+		Bucket:     "test-bucket",
+		BucketRoot: "root",
+		Versioning: true,
+		Lifecycle: []LifecycleRule{
+			{ID: "noncurrent", ExpireNoncurrentDays: 90, AbortIncompleteUploadDays: 7},
+			{
+				ID:          "archive",
+				Prefix:      "host-1/",
+				Tags:        map[string]string{"watcher": "security"},
+				Transitions: []LifecycleTransition{{Days: 30, StorageClass: "GLACIER_IR"}},
+			},
+		},
+		ObjectLock: &ObjectLockOptions{Mode: LockGovernance, Days: 30},
+	}
+	assert.Nil(t, options.Validate(), "Should be valid")
+	uploader := &S3Uploader{session: sess, client: s3.New(sess), config: options}
+
+	settings, err := uploader.CheckBucket()
+	assert.Nil(t, err, "Should check the bucket")
+	actual := make(map[string]BucketSetting)
+	for _, setting := range settings {
+		assert.False(t, setting.InSync, "Nothing should match yet: "+setting.Setting)
+		actual[setting.Setting] = setting
+	}
+	assert.Equal(t, "Suspended", actual["versioning"].Actual, "Should report versioning")
+	assert.Equal(t, settingMissing, actual["lifecycle/noncurrent"].Actual, "Should report missing rules")
+	assert.Equal(t, settingAbsent, actual["lifecycle/manual"].Expected, "Should report rules which aren't in the config")
+	assert.Equal(t, settingDisabled, actual["objectLock"].Actual, "Should report object lock")
+
+	assert.Nil(t, uploader.ApplyBucketSettings(), "Should apply the settings")
+	assert.Equal(t, []string{"lifecycle"}, bucket.puts, "Should only update the lifecycle on its own")
+	assert.Nil(t, uploader.ApplyObjectLock(), "Should apply the object lock")
+	assert.Equal(t, []string{"lifecycle", "object-lock"}, bucket.puts, "Should update the object lock when asked to")
+	settings, err = uploader.CheckBucket()
+	assert.Nil(t, err, "Should check the bucket")
+	for _, setting := range settings {
+		if setting.Setting != "versioning" {
+			assert.True(t, setting.InSync, "Should have applied "+setting.Setting)
+		}
+	}
+	assert.Contains(t, string(bucket.documents["lifecycle"]), "<Prefix>root/host-1/</Prefix>", "Prefixes are under the bucket root")
+
+	// Applying again doesn't change anything
+	assert.Nil(t, uploader.ApplyBucketSettings(), "Should apply the settings")
+	assert.Nil(t, uploader.ApplyObjectLock(), "Should apply the object lock")
+	assert.Len(t, bucket.puts, 2, "Should leave matching settings alone")
+
+	invalid := []*S3Options{
+		{Region: "us-east-1", Bucket: "backups", Lifecycle: []LifecycleRule{{ID: "empty"}}},
+		{Region: "us-east-1", Bucket: "backups", Lifecycle: []LifecycleRule{{ID: "a", ExpireDays: 1}, {ID: "a", ExpireDays: 2}}},
+		{Region: "us-east-1", Bucket: "backups", Lifecycle: []LifecycleRule{{ID: "a", Transitions: []LifecycleTransition{{Days: 1, StorageClass: "STANDARD"}}}}},
+		{Region: "us-east-1", Bucket: "backups", ObjectLock: &ObjectLockOptions{Mode: LockCompliance, Days: 1}},
+		{Region: "us-east-1", Bucket: "backups", Versioning: true, ObjectLock: &ObjectLockOptions{Mode: LockCompliance, Days: 1, Years: 1}},
+	}
+	for _, options := range invalid {
+		assert.NotNil(t, options.Validate(), "Should be invalid")
+	}
+}
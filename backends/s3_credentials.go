@@ -0,0 +1,202 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Environment variables used for web identity federation, such as EKS service accounts
+const (
+	webIdentityTokenFileEnv = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	roleARNEnv              = "AWS_ROLE_ARN"
+	roleSessionNameEnv      = "AWS_ROLE_SESSION_NAME"
+)
+
+// defaultSessionName - Session name of assumed roles, shows up in CloudTrail
+const defaultSessionName = "backer"
+
+// AssumeRoleOptions - Role to assume with the credentials found for the backend
+type AssumeRoleOptions struct {
+	RoleARN     string `json:"roleArn"`
+	ExternalID  string `json:"externalId"`
+	SessionName string `json:"sessionName"`
+	Duration    string `json:"duration"` // How long each set of role credentials lasts, defaults to 15m
+}
+
+// Validate - Ensure the role can be assumed, without contacting STS
+func (o *AssumeRoleOptions) Validate() error {
+	if o.RoleARN == "" {
+		return errors.New("assumeRole.roleArn is required")
+	}
+	if !strings.HasPrefix(o.RoleARN, "arn:") {
+		return errors.New("invalid role ARN: " + o.RoleARN)
+	}
+	if o.Duration != "" {
+		duration, err := time.ParseDuration(o.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid assumeRole.duration: %s", err)
+		}
+		if duration < 15*time.Minute || duration > 12*time.Hour {
+			return errors.New("assumeRole.duration must be between 15m and 12h")
+		}
+	}
+	return nil
+}
+
+// hasStaticKeys - Whether keys are set in the config, which override every other source of credentials
+func (c *S3Credentials) hasStaticKeys() bool {
+	return c.AccessKeyID != "" || c.SecretAccessKey != ""
+}
+
+// newSession - Create the AWS session for a backend
+// Static keys or a profile from the config are used if set, otherwise the standard chain: environment variables, web
+// identity, shared credentials and config profiles, then ECS or EC2 instance roles. The role is then assumed, if configured.
+func newSession(options *S3Options, configs ...*aws.Config) (*session.Session, error) {
+	config := aws.NewConfig().WithRegion(options.Region)
+	for _, c := range configs {
+		config.MergeIn(c)
+	}
+	if options.Credentials.hasStaticKeys() {
+		config.Credentials = credentials.NewStaticCredentials(options.Credentials.AccessKeyID, options.Credentials.SecretAccessKey, options.Credentials.SessionToken)
+	} else if options.Credentials.Profile != "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		// The SDK prefers keys from the environment over the profile it was asked for, unless it's given the keys
+		profile, err := profileCredentials(options.Credentials.Profile)
+		if err != nil {
+			return nil, err
+		}
+		config.Credentials = profile
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           options.Credentials.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The SDK doesn't know about web identity tokens, they're used ahead of profiles from the environment and instance roles
+	if !options.Credentials.hasStaticKeys() && options.Credentials.Profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		if tokenFile, roleARN := os.Getenv(webIdentityTokenFileEnv), os.Getenv(roleARNEnv); tokenFile != "" && roleARN != "" {
+			sessionName := os.Getenv(roleSessionNameEnv)
+			if sessionName == "" {
+				sessionName = defaultSessionName
+			}
+			client := sts.New(sess, &aws.Config{Credentials: credentials.AnonymousCredentials})
+			sess = sess.Copy(&aws.Config{Credentials: credentials.NewCredentials(newWebIdentityProvider(client, roleARN, sessionName, tokenFile))})
+		}
+	}
+
+	role := options.Credentials.AssumeRole
+	if role == nil {
+		return sess, nil
+	}
+	creds := stscreds.NewCredentials(sess, role.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = role.SessionName
+		if p.RoleSessionName == "" {
+			p.RoleSessionName = defaultSessionName
+		}
+		if role.ExternalID != "" {
+			p.ExternalID = aws.String(role.ExternalID)
+		}
+		if duration, err := time.ParseDuration(role.Duration); err == nil {
+			p.Duration = duration
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// profileCredentials - Keys of a profile from the shared credentials file, or the shared config file
+// Profiles which assume a role can't be resolved without the SDK, which would use the keys in the environment instead
+func profileCredentials(profile string) (*credentials.Credentials, error) {
+	creds := credentials.NewSharedCredentials("", profile)
+	if _, err := creds.Get(); err == nil {
+		return creds, nil
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = defaults.SharedConfigFilename()
+	}
+	// Profiles other than the default are prefixed in the config file
+	section := profile
+	if profile != session.DefaultSharedConfigProfile {
+		section = "profile " + profile
+	}
+	creds = credentials.NewSharedCredentials(configFile, section)
+	if _, err := creds.Get(); err == nil {
+		return creds, nil
+	}
+	return nil, fmt.Errorf("profile %s has no keys, unset AWS_ACCESS_KEY_ID or use assumeRole to use it", profile)
+}
+
+// CheckCredentials - Ensure that credentials are available for the backend, without contacting S3
+// Instance roles and assumed roles are fetched, so this may contact the instance metadata service or STS
+func (o *S3Options) CheckCredentials() error {
+	// Don't wait around for a metadata service which isn't there
+	sess, err := newSession(o, &aws.Config{
+		HTTPClient: &http.Client{Timeout: 2 * time.Second},
+		MaxRetries: aws.Int(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sess.Config.Credentials.Get()
+	return err
+}
+
+// webIdentityProvider - Exchanges a web identity token for the credentials of a role
+// The token file is read on every refresh, as it's rotated by whoever provides it
+type webIdentityProvider struct {
+	credentials.Expiry
+	client      *sts.STS
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+func newWebIdentityProvider(client *sts.STS, roleARN string, sessionName string, tokenFile string) *webIdentityProvider {
+	return &webIdentityProvider{
+		client:      client,
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		tokenFile:   tokenFile,
+	}
+}
+
+// Retrieve - Assume the role with the current token
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to read web identity token: %s", err)
+	}
+	resp, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	// Refresh a little early, so requests don't race the expiry
+	p.SetExpiration(aws.TimeValue(resp.Credentials.Expiration), time.Minute)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
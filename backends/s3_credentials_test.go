@@ -0,0 +1,188 @@
+package backends
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSTS - Answers AssumeRole calls with fixed credentials, recording the requests
+func fakeSTS(t *testing.T, requests chan<- http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm(), "Should parse the request")
+		requests <- *r
+		action := r.Form.Get("Action")
+		fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult><Credentials>
+			<AccessKeyId>ROLEKEY</AccessKeyId>
+			<SecretAccessKey>ROLESECRET</SecretAccessKey>
+			<SessionToken>TOKEN</SessionToken>
+			<Expiration>2099-01-01T00:00:00Z</Expiration>
+		</Credentials></%[1]sResult></%[1]sResponse>`, action)
+	}))
+}
+
+// isolateCredentials - Clear the credentials of whoever is running the tests
+func isolateCredentials(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "backer-credentials")
+	assert.Nil(t, err, "Should create temp dir")
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_PROFILE":                 "",
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials"),
+		"AWS_CONFIG_FILE":             filepath.Join(dir, "config"),
+		webIdentityTokenFileEnv:       "",
+		roleARNEnv:                    "",
+	}
+	previous := make(map[string]string)
+	for key, value := range env {
+		previous[key] = os.Getenv(key)
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, value := range previous {
+			os.Setenv(key, value)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCredentialChain(t *testing.T) {
+	defer isolateCredentials(t)()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "ENVSECRET")
+	options := &S3Options{Region: "us-east-1"}
+	sess, err := newSession(options)
+	assert.Nil(t, err, "Should create session")
+	creds, err := sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should find credentials")
+	assert.Equal(t, "ENVKEY", creds.AccessKeyID, "Should use the environment")
+
+	// Keys in the config win
+	options.Credentials = S3Credentials{AccessKeyID: "CONFIGKEY", SecretAccessKey: "CONFIGSECRET"}
+	sess, err = newSession(options)
+	assert.Nil(t, err, "Should create session")
+	creds, err = sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should find credentials")
+	assert.Equal(t, "CONFIGKEY", creds.AccessKeyID, "Should use the static keys")
+
+	// Profiles from the shared credentials file
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	profiles := "[backup]\naws_access_key_id = PROFILEKEY\naws_secret_access_key = PROFILESECRET\n"
+	assert.Nil(t, ioutil.WriteFile(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), []byte(profiles), 0600), "Should write credentials")
+	options.Credentials = S3Credentials{Profile: "backup"}
+	assert.Nil(t, options.CheckCredentials(), "Should find the profile")
+	sess, err = newSession(options)
+	assert.Nil(t, err, "Should create session")
+	creds, err = sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should find credentials")
+	assert.Equal(t, "PROFILEKEY", creds.AccessKeyID, "Should use the profile")
+
+	options.Credentials = S3Credentials{Profile: "missing"}
+	assert.NotNil(t, options.CheckCredentials(), "Should fail for missing profiles")
+
+	// Profiles in the config win over the environment
+	options.Credentials = S3Credentials{Profile: "backup"}
+	os.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "ENVSECRET")
+	sess, err = newSession(options)
+	assert.Nil(t, err, "Should create session")
+	creds, err = sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should find credentials")
+	assert.Equal(t, "PROFILEKEY", creds.AccessKeyID, "Should use the configured profile")
+
+	// Profiles from the shared config file
+	configProfiles := "[profile archive]\naws_access_key_id = CONFIGFILEKEY\naws_secret_access_key = CONFIGFILESECRET\n"
+	assert.Nil(t, ioutil.WriteFile(os.Getenv("AWS_CONFIG_FILE"), []byte(configProfiles), 0600), "Should write config")
+	options.Credentials = S3Credentials{Profile: "archive"}
+	sess, err = newSession(options)
+	assert.Nil(t, err, "Should create session")
+	creds, err = sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should find credentials")
+	assert.Equal(t, "CONFIGFILEKEY", creds.AccessKeyID, "Should use the profile from the config file")
+
+	// Falling back to the environment would use a different account than the one configured
+	options.Credentials = S3Credentials{Profile: "missing"}
+	_, err = newSession(options)
+	assert.NotNil(t, err, "Should fail instead of using the environment")
+	assert.Contains(t, err.Error(), "missing", "Should name the profile")
+}
+
+func TestWebIdentity(t *testing.T) {
+	defer isolateCredentials(t)()
+	requests := make(chan http.Request, 1)
+	server := fakeSTS(t, requests)
+	defer server.Close()
+
+	token := os.Getenv("AWS_CONFIG_FILE") + ".token"
+	assert.Nil(t, ioutil.WriteFile(token, []byte("service-account-token\n"), 0600), "Should write token")
+	os.Setenv(webIdentityTokenFileEnv, token)
+	os.Setenv(roleARNEnv, "arn:aws:iam::123456789012:role/backer")
+
+	sess, err := newSession(&S3Options{Region: "us-east-1"}, &aws.Config{Endpoint: aws.String(server.URL)})
+	assert.Nil(t, err, "Should create session")
+	creds, err := sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should assume the role")
+	assert.Equal(t, "ROLEKEY", creds.AccessKeyID, "Should use the role credentials")
+
+	request := <-requests
+	assert.Equal(t, "AssumeRoleWithWebIdentity", request.Form.Get("Action"), "Should exchange the token")
+	assert.Equal(t, "service-account-token", request.Form.Get("WebIdentityToken"), "Should send the token")
+	assert.Equal(t, "arn:aws:iam::123456789012:role/backer", request.Form.Get("RoleArn"), "Should send the role")
+	assert.Empty(t, request.Header.Get("Authorization"), "Shouldn't sign the request")
+
+	// A profile in the config wins over the token
+	profiles := "[backup]\naws_access_key_id = PROFILEKEY\naws_secret_access_key = PROFILESECRET\n"
+	assert.Nil(t, ioutil.WriteFile(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), []byte(profiles), 0600), "Should write credentials")
+	sess, err = newSession(&S3Options{Region: "us-east-1", Credentials: S3Credentials{Profile: "backup"}}, &aws.Config{Endpoint: aws.String(server.URL)})
+	assert.Nil(t, err, "Should create session")
+	creds, err = sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should find credentials")
+	assert.Equal(t, "PROFILEKEY", creds.AccessKeyID, "Should use the configured profile")
+	assert.Empty(t, requests, "Shouldn't exchange the token")
+}
+
+func TestAssumeRole(t *testing.T) {
+	defer isolateCredentials(t)()
+	requests := make(chan http.Request, 1)
+	server := fakeSTS(t, requests)
+	defer server.Close()
+
+	options := &S3Options{
+		Region: "us-east-1",
+		Credentials: S3Credentials{
+			AccessKeyID:     "CONFIGKEY",
+			SecretAccessKey: "CONFIGSECRET",
+			AssumeRole: &AssumeRoleOptions{
+				RoleARN:    "arn:aws:iam::123456789012:role/backer",
+				ExternalID: "backer-external",
+				Duration:   "1h",
+			},
+		},
+	}
+	sess, err := newSession(options, &aws.Config{Endpoint: aws.String(server.URL)})
+	assert.Nil(t, err, "Should create session")
+	creds, err := sess.Config.Credentials.Get()
+	assert.Nil(t, err, "Should assume the role")
+	assert.Equal(t, "ROLEKEY", creds.AccessKeyID, "Should use the role credentials")
+
+	request := <-requests
+	assert.Equal(t, "AssumeRole", request.Form.Get("Action"), "Should assume the role")
+	assert.Equal(t, "backer-external", request.Form.Get("ExternalId"), "Should send the external ID")
+	assert.Equal(t, "3600", request.Form.Get("DurationSeconds"), "Should ask for the duration")
+	assert.Contains(t, request.Header.Get("Authorization"), "CONFIGKEY", "Should sign with the static keys")
+
+	options.Credentials.AssumeRole.Duration = "5m"
+	assert.NotNil(t, options.Validate(), "Should check the duration")
+	options.Credentials.AssumeRole = &AssumeRoleOptions{}
+	assert.NotNil(t, options.Validate(), "Should require a role")
+}
@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Startup checks of a backend, reported by PreflightError
+const (
+	PreflightCredentials = "credentials"
+	PreflightCreate      = "create"
+	PreflightBucket      = "bucket"
+	PreflightVersioning  = "versioning"
+	PreflightPut         = "put"
+	PreflightHead        = "head"
+	PreflightDelete      = "delete"
+)
+
+// Where the probe objects are written, relative to the bucket root, each host reuses the same key
+const preflightPrefix = ".backer/preflight"
+
+// PreflightError - A startup check which the backend failed, so it can't be used
+type PreflightError struct {
+	Backend string
+	Bucket  string
+	Check   string // One of the Preflight checks
+	Err     error
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("backend %s: %s check of bucket %s failed: %s", e.Backend, e.Check, e.Bucket, e.Err)
+}
+
+func (s *S3Uploader) preflightError(check string, err error) error {
+	return &PreflightError{Backend: s.GetName(), Bucket: s.config.Bucket, Check: check, Err: err}
+}
+
+// Preflight - Check that the bucket exists, that versioning matches the config,
+// and that a probe object can be written, read and removed with the permissions uploads need
+func (s *S3Uploader) Preflight() error {
+	_, err := s.client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(s.config.Bucket),
+	})
+	if err != nil {
+		if requestErr, ok := err.(s3.RequestFailure); ok && requestErr.StatusCode() == 404 {
+			err = errors.New("the bucket does not exist, create it or set createBucket and run backer backend apply")
+		}
+		return s.preflightError(PreflightBucket, err)
+	}
+
+	versioning, err := s.client.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.config.Bucket),
+	})
+	if err != nil {
+		return s.preflightError(PreflightVersioning, err)
+	}
+	enabled := aws.StringValue(versioning.Status) == s3.BucketVersioningStatusEnabled
+	if s.config.Versioning && !enabled {
+		return s.preflightError(PreflightVersioning, errors.New("versioning is not enabled on the bucket, enable it or set createBucket and run backer backend apply"))
+	}
+	if !s.config.Versioning && enabled {
+		log.Warnf("Versioning is enabled on bucket %s, but not in the config, removed files will keep their old versions\n", s.config.Bucket)
+	}
+
+	return s.probe()
+}
+
+// probe - Write, read and remove an object, as uploads and deletes do
+// Under object lock every probe would leave a version behind which can't be removed until its retention has passed, so
+// only the bucket and versioning are checked
+func (s *S3Uploader) probe() error {
+	if s.config.ObjectLock != nil {
+		log.Debugf("Skipping the probe object of bucket %s, since it would be locked\n", s.config.Bucket)
+		return nil
+	}
+	host, _ := os.Hostname()
+	key := s.buildObjectKey(path.Join(preflightPrefix, host))
+	tags, err := s.tagging(&ObjectMetadata{Hostname: host})
+	if err != nil {
+		return s.preflightError(PreflightPut, err)
+	}
+
+	input := &s3.PutObjectInput{
+		Body:         bytes.NewReader([]byte("backer preflight check\n")),
+		Bucket:       aws.String(s.config.Bucket),
+		Key:          aws.String(key),
+		StorageClass: aws.String(s.storageClass(nil)),
+		Tagging:      tags,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s.encryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey, err = s.customerKey()
+	if err != nil {
+		return s.preflightError(PreflightPut, err)
+	}
+	put, err := s.client.PutObject(input)
+	if err != nil {
+		return s.preflightError(PreflightPut, err)
+	}
+	versionID := aws.StringValue(put.VersionId)
+
+	if _, err = s.headObject(key, versionID); err != nil {
+		return s.preflightError(PreflightHead, err)
+	}
+
+	// Remove the probe version entirely
+	deleteInput := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		deleteInput.VersionId = aws.String(versionID)
+	}
+	if _, err = s.client.DeleteObject(deleteInput); err != nil {
+		return s.preflightError(PreflightDelete, err)
+	}
+	return nil
+}
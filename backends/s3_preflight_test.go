@@ -0,0 +1,164 @@
+package backends
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePreflight - A bucket which records the requests it's sent, and refuses the methods it's told to
+type fakePreflight struct {
+	sync.Mutex
+	versioning       string
+	refuse           string
+	createCode       string // Error code returned when the bucket is created
+	refuseVersioning bool   // Whether or not enabling versioning fails
+	requests         []string
+}
+
+func (f *fakePreflight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	request := r.Method + " " + r.URL.Path
+	if r.URL.RawQuery != "" {
+		request += "?" + r.URL.RawQuery
+	}
+	f.requests = append(f.requests, request)
+
+	switch {
+	case r.Method == "PUT" && r.URL.RawQuery == "" && !strings.Contains(strings.TrimPrefix(r.URL.Path, "/"), "/") && f.createCode != "":
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("<Error><Code>" + f.createCode + "</Code><Message>" + f.createCode + "</Message></Error>"))
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.RawQuery, "versioning=") && f.refuseVersioning:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"))
+	case f.refuse == r.Method:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"))
+	case r.URL.Path == "/missing-bucket":
+		w.WriteHeader(http.StatusNotFound)
+	case strings.HasSuffix(r.URL.RawQuery, "versioning="):
+		w.Write([]byte("<VersioningConfiguration><Status>" + f.versioning + "</Status></VersioningConfiguration>"))
+	case r.Method == "PUT":
+		w.Header().Set("X-Amz-Version-Id", "probe-version")
+	case r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func preflightUploader(server *httptest.Server, options *S3Options) *S3Uploader {
+	sess := testSession(server, true)
+	return &S3Uploader{session: sess, client: s3.New(sess), config: options}
+}
+
+func TestPreflight(t *testing.T) {
+	bucket := &fakePreflight{versioning: "Enabled"}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	uploader := preflightUploader(server, &S3Options{Bucket: "test-bucket", BucketRoot: "root", Versioning: true})
+	assert.Nil(t, uploader.Preflight(), "Should pass")
+	assert.Len(t, bucket.requests, 5, "Should check the bucket, versioning, and put, head and delete a probe")
+	assert.Equal(t, "HEAD /test-bucket", bucket.requests[0], "Should check the bucket exists")
+	host, _ := os.Hostname()
+	assert.Equal(t, "PUT /test-bucket/root/.backer/preflight/"+host, bucket.requests[2], "Should put the probe of this host under the bucket root")
+	assert.True(t, strings.HasSuffix(bucket.requests[4], "versionId=probe-version"), "Should remove the probe version")
+
+	// Versioning has to match the config, unless backer was asked to enable it
+	bucket.versioning = "Suspended"
+	err := uploader.Preflight()
+	assert.IsType(t, &PreflightError{}, err, "Should return a preflight error")
+	assert.Equal(t, PreflightVersioning, err.(*PreflightError).Check, "Should check versioning")
+
+	uploader.config.Versioning = false
+	bucket.refuse = "PUT"
+	err = uploader.Preflight()
+	assert.Equal(t, PreflightPut, err.(*PreflightError).Check, "Should check objects can be written")
+	assert.Contains(t, err.Error(), "backend S3: put check of bucket test-bucket failed", "Should say what failed")
+
+	bucket.refuse = "DELETE"
+	err = uploader.Preflight()
+	assert.Equal(t, PreflightDelete, err.(*PreflightError).Check, "Should check objects can be removed")
+
+	uploader.config.Bucket = "missing-bucket"
+	err = uploader.Preflight()
+	assert.Equal(t, PreflightBucket, err.(*PreflightError).Check, "Should check the bucket exists")
+	assert.Contains(t, err.Error(), "createBucket", "Should suggest creating the bucket")
+
+	// Probes under object lock would be kept until their retention has passed
+	bucket.refuse = ""
+	bucket.requests = nil
+	uploader.config.Bucket = "test-bucket"
+	uploader.config.Versioning = true
+	uploader.config.ObjectLock = &ObjectLockOptions{Mode: LockCompliance, Days: 1}
+	bucket.versioning = "Enabled"
+	assert.Nil(t, uploader.Preflight(), "Should pass")
+	assert.Len(t, bucket.requests, 2, "Should only check the bucket and versioning")
+}
+
+func TestNewS3Uploader(t *testing.T) {
+	defer isolateCredentials(t)()
+	bucket := &fakePreflight{versioning: "Enabled"}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	options := &S3Options{
+		Region:       "mock-region",
+		Bucket:       "missing-bucket",
+		CreateBucket: true,
+		Versioning:   true,
+		Lifecycle:    []LifecycleRule{{ID: "noncurrent", ExpireNoncurrentDays: 90}},
+		Credentials:  S3Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"},
+	}
+	connect := func() error {
+		_, err := newS3Uploader(options, aws.NewConfig().WithEndpoint(server.URL).WithS3ForcePathStyle(true).WithMaxRetries(0))
+		return err
+	}
+
+	// Only backer backend apply creates buckets or changes their settings
+	err := connect()
+	assert.IsType(t, &PreflightError{}, err, "Should return a preflight error")
+	assert.Equal(t, PreflightBucket, err.(*PreflightError).Check, "Should not create the bucket")
+	assert.Contains(t, err.Error(), "backend apply", "Should say how to create the bucket")
+
+	options.Bucket = "test-bucket"
+	bucket.requests = nil
+	assert.Nil(t, connect(), "Should connect, even though the settings can't be read")
+	for _, request := range bucket.requests {
+		if request == "PUT /test-bucket" || strings.HasPrefix(request, "PUT /test-bucket?") {
+			t.Errorf("Should not change the bucket, sent %s", request)
+		}
+	}
+}
+
+func TestCreateBucket(t *testing.T) {
+	bucket := &fakePreflight{versioning: "Enabled", createCode: "BucketAlreadyExists"}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	uploader := preflightUploader(server, &S3Options{Bucket: "test-bucket", CreateBucket: true, Versioning: true})
+
+	err := uploader.ApplyBucketSettings()
+	assert.IsType(t, &PreflightError{}, err, "Should return a preflight error")
+	assert.Equal(t, PreflightCreate, err.(*PreflightError).Check, "Should fail to create the bucket")
+	assert.Contains(t, err.Error(), "globally unique", "Should explain that the name is taken")
+
+	// Buckets we already own are fine, as long as versioning can be enabled
+	bucket.createCode = "BucketAlreadyOwnedByYou"
+	bucket.refuseVersioning = true
+	err = uploader.ApplyBucketSettings()
+	assert.IsType(t, &PreflightError{}, err, "Should return a preflight error")
+	assert.Equal(t, PreflightCreate, err.(*PreflightError).Check, "Should fail to enable versioning")
+	assert.Contains(t, err.Error(), "AccessDenied", "Should include the reason")
+
+	bucket.refuseVersioning = false
+	bucket.requests = nil
+	assert.Nil(t, uploader.ApplyBucketSettings(), "Should create the bucket")
+	assert.Equal(t, []string{"PUT /test-bucket", "PUT /test-bucket?versioning="}, bucket.requests, "Should create the bucket and enable versioning")
+}
@@ -0,0 +1,215 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Server-side encryption modes
+const (
+	EncryptionS3       = "SSE-S3"  // Keys managed by S3
+	EncryptionKMS      = "SSE-KMS" // Keys managed by KMS
+	EncryptionCustomer = "SSE-C"   // Keys provided with every request
+)
+
+// Limits S3 places on object tags
+const (
+	maxTags        = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// storageClasses - Classes files can be uploaded with
+// Archive classes are left out, since their objects need restoring before diff or log can read them
+var storageClasses = map[string]bool{
+	s3.StorageClassStandard:          true,
+	s3.StorageClassReducedRedundancy: true,
+	s3.StorageClassStandardIa:        true,
+	"ONEZONE_IA":                     true,
+	"INTELLIGENT_TIERING":            true,
+	"GLACIER_IR":                     true,
+}
+
+// EncryptionOptions - Server-side encryption of the uploaded objects
+type EncryptionOptions struct {
+	Type        string `json:"type"`        // SSE-S3, SSE-KMS or SSE-C
+	KMSKeyID    string `json:"kmsKeyId"`    // Key for SSE-KMS, defaults to the aws/s3 key of the account
+	CustomerKey string `json:"customerKey"` // Base64 encoded 256 bit key for SSE-C
+}
+
+// TagVariables - Variables available to object tag templates
+type TagVariables struct {
+	Host      string // Hostname of this machine
+	MachineID string // Unique ID of this machine
+	Watcher   string // Bucket path of the watcher
+}
+
+// CheckStorageClass - Ensure that files can be uploaded with the storage class
+func CheckStorageClass(class string) error {
+	if !storageClasses[class] {
+		return errors.New("unsupported storage class: " + class)
+	}
+	return nil
+}
+
+// Validate - Ensure the encryption settings are complete
+func (e *EncryptionOptions) Validate() error {
+	switch e.Type {
+	case EncryptionS3:
+	case EncryptionKMS:
+	case EncryptionCustomer:
+		key, err := base64.StdEncoding.DecodeString(e.CustomerKey)
+		if err != nil {
+			return fmt.Errorf("invalid encryption.customerKey: %s", err)
+		}
+		if len(key) != 32 {
+			return errors.New("encryption.customerKey must be a base64 encoded 256 bit key")
+		}
+	default:
+		return fmt.Errorf("unknown encryption type %q, expected %s, %s or %s", e.Type, EncryptionS3, EncryptionKMS, EncryptionCustomer)
+	}
+	if e.KMSKeyID != "" && e.Type != EncryptionKMS {
+		return errors.New("encryption.kmsKeyId is only used with " + EncryptionKMS)
+	}
+	if e.CustomerKey != "" && e.Type != EncryptionCustomer {
+		return errors.New("encryption.customerKey is only used with " + EncryptionCustomer)
+	}
+	return nil
+}
+
+// validateStorage - Check the storage class, encryption and tags of the backend
+func (o *S3Options) validateStorage() error {
+	if o.StorageClass != "" {
+		if err := CheckStorageClass(o.StorageClass); err != nil {
+			return err
+		}
+	}
+	if o.Encryption != nil {
+		if err := o.Encryption.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(o.Tags) > maxTags {
+		return fmt.Errorf("objects can have at most %d tags", maxTags)
+	}
+	for key, value := range o.Tags {
+		if key == "" || len(key) > maxTagKeyLen {
+			return fmt.Errorf("tag keys must be between 1 and %d characters", maxTagKeyLen)
+		}
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid template for tag %s: %s", key, err)
+		}
+		// Templates which parse can still refer to variables which don't exist
+		if err = tmpl.Execute(ioutil.Discard, TagVariables{}); err != nil {
+			return fmt.Errorf("invalid template for tag %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// storageClass - Class to upload the file with, the watcher wins over the backend
+func (s *S3Uploader) storageClass(objectMetadata *ObjectMetadata) string {
+	switch {
+	case objectMetadata != nil && objectMetadata.StorageClass != "":
+		return objectMetadata.StorageClass
+	case s.config.StorageClass != "":
+		return s.config.StorageClass
+	case s.config.ReducedRedundancy:
+		return s3.StorageClassReducedRedundancy
+	}
+	return s3.StorageClassStandard
+}
+
+// tagging - URL encoded tags of the file, rendered from the tag templates
+func (s *S3Uploader) tagging(objectMetadata *ObjectMetadata) (*string, error) {
+	if len(s.config.Tags) == 0 {
+		return nil, nil
+	}
+	variables := TagVariables{
+		Host:      objectMetadata.Hostname,
+		MachineID: objectMetadata.MachineID,
+		Watcher:   objectMetadata.Watcher,
+	}
+
+	keys := make([]string, 0, len(s.config.Tags))
+	for key := range s.config.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := url.Values{}
+	for _, key := range keys {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(s.config.Tags[key])
+		if err != nil {
+			return nil, err
+		}
+		var value bytes.Buffer
+		if err = tmpl.Execute(&value, variables); err != nil {
+			return nil, err
+		}
+		if value.Len() > maxTagValueLen {
+			return nil, fmt.Errorf("value of tag %s is longer than %d characters", key, maxTagValueLen)
+		}
+		tags.Set(key, value.String())
+	}
+	return aws.String(tags.Encode()), nil
+}
+
+// encryption - Encryption headers for uploads, nil when S3 should use the default encryption of the bucket
+func (s *S3Uploader) encryption() (sse *string, kmsKeyID *string) {
+	if s.config.Encryption == nil {
+		return nil, nil
+	}
+	switch s.config.Encryption.Type {
+	case EncryptionS3:
+		return aws.String(s3.ServerSideEncryptionAes256), nil
+	case EncryptionKMS:
+		if s.config.Encryption.KMSKeyID != "" {
+			kmsKeyID = aws.String(s.config.Encryption.KMSKeyID)
+		}
+		return aws.String(s3.ServerSideEncryptionAwsKms), kmsKeyID
+	}
+	return nil, nil
+}
+
+// customerKey - Algorithm and key to send with every request for an object, when SSE-C is used
+// S3 keeps no copy of the key, so objects can only be read back with the same one
+// Keys which can't be decoded are an error, since the object would be sent without encryption
+func (s *S3Uploader) customerKey() (algorithm *string, key *string, err error) {
+	if s.config.Encryption == nil || s.config.Encryption.Type != EncryptionCustomer {
+		return nil, nil, nil
+	}
+	// The SDK encodes the raw key, and adds its MD5
+	raw, err := base64.StdEncoding.DecodeString(s.config.Encryption.CustomerKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid encryption.customerKey: %s", err)
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(string(raw)), nil
+}
+
+// headObject - Fetch the metadata of an object, an empty versionID returns the latest version
+func (s *S3Uploader) headObject(key string, versionID string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	var err error
+	input.SSECustomerAlgorithm, input.SSECustomerKey, err = s.customerKey()
+	if err != nil {
+		return nil, err
+	}
+	return s.client.HeadObject(input)
+}
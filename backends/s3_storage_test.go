@@ -0,0 +1,111 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageOptions(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	sess := testSession(server, true)
+	uploader := &S3Uploader{
+		session: sess,
+		client:  s3.New(sess),
+		config: &S3Options{
+			Region:            "mock-region",
+			Bucket:            "test-bucket",
+			ReducedRedundancy: true,
+			StorageClass:      "ONEZONE_IA",
+			Encryption:        &EncryptionOptions{Type: EncryptionKMS, KMSKeyID: "alias/backer"},
+			Tags: map[string]string{
+				"host":    "{{.Host}}",
+				"watcher": "{{.Watcher}}",
+				"managed": "backer",
+			},
+		},
+	}
+	assert.Nil(t, uploader.config.Validate(), "Should be valid")
+
+	metadata := &ObjectMetadata{Checksum: "sum", Hostname: "test-host", Watcher: "nginx"}
+	assert.Nil(t, uploader.UploadFile("test-file", bytes.NewReader([]byte("data")), "test-file", metadata), "Should upload")
+	header := <-headers
+	assert.Equal(t, "ONEZONE_IA", header.Get("X-Amz-Storage-Class"), "Storage class should win over reduced redundancy")
+	assert.Equal(t, "aws:kms", header.Get("X-Amz-Server-Side-Encryption"), "Should encrypt with KMS")
+	assert.Equal(t, "alias/backer", header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"), "Should use the KMS key")
+	tags, err := url.ParseQuery(header.Get("X-Amz-Tagging"))
+	assert.Nil(t, err, "Should encode the tags")
+	assert.Equal(t, url.Values{"host": {"test-host"}, "watcher": {"nginx"}, "managed": {"backer"}}, tags, "Should render the tags")
+
+	// Watchers override the class of the backend
+	metadata.StorageClass = "GLACIER_IR"
+	assert.Nil(t, uploader.UploadFile("test-file", bytes.NewReader([]byte("data")), "test-file", metadata), "Should upload")
+	header = <-headers
+	assert.Equal(t, "GLACIER_IR", header.Get("X-Amz-Storage-Class"), "Should use the class of the watcher")
+
+	invalid := []*S3Options{
+		{Region: "us-east-1", Bucket: "backups", StorageClass: "DEEP_ARCHIVE"},
+		{Region: "us-east-1", Bucket: "backups", Encryption: &EncryptionOptions{Type: "SSE-X"}},
+		{Region: "us-east-1", Bucket: "backups", Encryption: &EncryptionOptions{Type: EncryptionS3, KMSKeyID: "alias/backer"}},
+		{Region: "us-east-1", Bucket: "backups", Encryption: &EncryptionOptions{Type: EncryptionCustomer, CustomerKey: "c2hvcnQ="}},
+		{Region: "us-east-1", Bucket: "backups", Tags: map[string]string{"host": "{{.Host"}},
+		{Region: "us-east-1", Bucket: "backups", Tags: map[string]string{"host": "{{.Hostname}}"}},
+		{Region: "us-east-1", Bucket: "backups", ContentAddressed: true, Encryption: &EncryptionOptions{
+			Type:        EncryptionCustomer,
+			CustomerKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)),
+		}},
+	}
+	for _, options := range invalid {
+		assert.NotNil(t, options.Validate(), "Should be invalid")
+	}
+}
+
+func TestCustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	headers := make(chan http.Header, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Header().Set("X-Amz-Meta-Checksum", "sum")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// SSE-C keys are only sent over TLS
+	sess := testSession(server, true)
+	uploader := &S3Uploader{
+		session: sess,
+		client:  s3.New(sess),
+		config: &S3Options{
+			Bucket:     "test-bucket",
+			Encryption: &EncryptionOptions{Type: EncryptionCustomer, CustomerKey: base64.StdEncoding.EncodeToString(key)},
+		},
+	}
+	assert.Nil(t, uploader.config.Encryption.Validate(), "Should be valid")
+
+	inSync, err := uploader.FileInSync("test-file", "test-file", bytes.NewReader([]byte("data")), &ObjectMetadata{Checksum: "sum"})
+	assert.Nil(t, err, "Should check the file")
+	assert.True(t, inSync, "Should be in sync")
+	header := <-headers
+	assert.Equal(t, "AES256", header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"), "Should send the algorithm")
+	assert.Equal(t, base64.StdEncoding.EncodeToString(key), header.Get("X-Amz-Server-Side-Encryption-Customer-Key"), "Should send the key with reads")
+	assert.NotEmpty(t, header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"), "Should send the key checksum")
+
+	// Keys which can't be decoded fail the request, rather than sending it without encryption
+	uploader.config.Encryption.CustomerKey = "not base64"
+	_, err = uploader.FileInSync("test-file", "test-file", bytes.NewReader([]byte("data")), &ObjectMetadata{Checksum: "sum"})
+	assert.NotNil(t, err, "Should fail without a key")
+	assert.Empty(t, headers, "Shouldn't send the request")
+}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -60,6 +63,11 @@ func TestUpload(t *testing.T) {
 			t.Errorf("Checksums should match")
 		}
 
+		// Check the provenance metadata
+		assert.Equal(t, "test-host", r.Header.Get("X-Amz-Meta-Hostname"), "Should have hostname")
+		assert.Equal(t, "create", r.Header.Get("X-Amz-Meta-Event"), "Should have event type")
+		assert.Empty(t, r.Header.Get("X-Amz-Meta-Machine-Id"), "Should not set empty values")
+
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -74,7 +82,11 @@ func TestUpload(t *testing.T) {
 		},
 	}
 
-	uploader.UploadFile("test-file", testByteReader, "test-remote", hashString)
+	uploader.UploadFile("test-file", testByteReader, "test-remote/test-file", &ObjectMetadata{
+		Checksum: hashString,
+		Hostname: "test-host",
+		Event:    "create",
+	})
 }
 
 func TestStartupSync(t *testing.T) {
@@ -92,7 +104,10 @@ func TestStartupSync(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fileHash := responseMap[r.RequestURI]
 
-		if fileHash == "" {
+		// Accept uploads of the out of sync files
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusOK)
+		} else if fileHash == "" {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
 			// Set the checksum metadata
@@ -120,34 +135,400 @@ func TestStartupSync(t *testing.T) {
 
 	// Try to create a reader and verify the file is in sync
 	syncedReader := bytes.NewReader(bytesInSync)
-	sync, err := uploader.FileInSync("inSync", "root", syncedReader, hashInSync)
+	sync, err := uploader.FileInSync("inSync", "root/inSync", syncedReader, &ObjectMetadata{Checksum: hashInSync})
 	assert.Nil(t, err, "Error should be nil")
 	assert.True(t, sync, "File should be in sync")
 
 	// Out of sync
 	outSyncReader := bytes.NewReader(bytesOutOfSync)
-	sync, err = uploader.FileInSync("outSync", "root", outSyncReader, hashOutOfSync)
+	sync, err = uploader.FileInSync("outSync", "root/outSync", outSyncReader, &ObjectMetadata{Checksum: hashOutOfSync})
 	assert.Nil(t, err, "Should not have error")
 	assert.False(t, sync, "Should be out of sync")
 
 	// Missing
 	missingReader := bytes.NewReader([]byte("Doesn't exist"))
-	sync, err = uploader.FileInSync("missing", "root", missingReader, "no hash")
+	sync, err = uploader.FileInSync("missing", "root/missing", missingReader, &ObjectMetadata{Checksum: "no hash"})
 	assert.Nil(t, err, "Should not have error")
 	assert.False(t, sync, "Should be out of sync")
 
 }
 
+func TestContentAddressedUpload(t *testing.T) {
+	testBytes := []byte("Shared resolv.conf")
+	hashString := hashBytes(testBytes)
+	blobPath := "/blobs/sha256/" + hashString
+
+	modified := time.Now()
+	var uploaded []string
+	var refreshed []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		switch {
+		case r.Method == http.MethodHead:
+			// The blob already exists
+			if r.URL.Path != blobPath {
+				t.Errorf("Should only check the blob, not %s", r.URL.Path)
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(testBytes)))
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+			refreshed = append(refreshed, r.URL.Path)
+			assert.Equal(t, "REPLACE", r.Header.Get("X-Amz-Metadata-Directive"), "Should be allowed to copy onto itself")
+			w.Write([]byte(`<CopyObjectResult><ETag>"blob"</ETag></CopyObjectResult>`))
+		case r.Method == http.MethodPut:
+			uploaded = append(uploaded, r.URL.Path)
+			assert.Equal(t, "blobs/sha256/"+hashString, r.Header.Get("X-Amz-Meta-Blob"), "Should point to the blob")
+			assert.Equal(t, strconv.Itoa(len(testBytes)), r.Header.Get("X-Amz-Meta-Blob-Size"), "Should record the blob size")
+
+			var pointer blobPointer
+			err := json.NewDecoder(r.Body).Decode(&pointer)
+			assert.Nil(t, err, "Should upload a pointer")
+			assert.Equal(t, hashString, pointer.Checksum, "Pointer should have the checksum")
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	session := createTestSetup(handler)
+
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config: &S3Options{
+			Versioning:       true,
+			ContentAddressed: true,
+		},
+	}
+
+	uploader.UploadFile("resolv.conf", bytes.NewReader(testBytes), "host-1/etc/resolv.conf", &ObjectMetadata{Checksum: hashString})
+	assert.Equal(t, []string{"/host-1/etc/resolv.conf"}, uploaded, "Should only upload the pointer")
+	assert.Empty(t, refreshed, "Recent blobs are left alone")
+
+	// Garbage collection could be about to remove an old blob
+	modified = time.Now().Add(-blobGracePeriod)
+	uploaded = nil
+	err := uploader.UploadFile("resolv.conf", bytes.NewReader(testBytes), "host-1/etc/resolv.conf", &ObjectMetadata{Checksum: hashString})
+	assert.Nil(t, err, "Should upload")
+	assert.Equal(t, []string{blobPath}, refreshed, "Should refresh the blob before pointing to it")
+	assert.Equal(t, []string{"/host-1/etc/resolv.conf"}, uploaded, "Should only upload the pointer")
+}
+
 func createTestSetup(handler http.HandlerFunc) *session.Session {
-	server := httptest.NewServer(handler)
+	return testSession(httptest.NewServer(handler), false)
+}
 
-	return session.Must(session.NewSession(aws.NewConfig().
+// testSession - Session which sends every request to the test server, with path style the bucket is part of the path
+// The client of the server is set after the session is created, so it trusts TLS servers whatever AWS_CA_BUNDLE says
+func testSession(server *httptest.Server, pathStyle bool) *session.Session {
+	sess := session.Must(session.NewSession(aws.NewConfig().
 		WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "SESSION")).
 		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(pathStyle).
+		WithMaxRetries(0).
 		WithRegion("mock-region")))
+	return sess.Copy(aws.NewConfig().WithHTTPClient(server.Client()))
 }
 
 func hashBytes(bb []byte) string {
 	hash := sha256.New()
 	return hex.EncodeToString(hash.Sum(bb))
 }
+
+func TestListVersions(t *testing.T) {
+	var heads []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("prefix") != "":
+			assert.Contains(t, r.URL.RawQuery, "versions", "Should list the versions")
+			w.Write([]byte(`<ListVersionsResult>
+				<Version><Key>root/nginx.conf</Key><VersionId>v1</VersionId><IsLatest>false</IsLatest><LastModified>2018-01-01T00:00:00.000Z</LastModified><Size>10</Size></Version>
+				<Version><Key>root/nginx.conf</Key><VersionId>v2</VersionId><IsLatest>false</IsLatest><LastModified>2018-01-02T00:00:00.000Z</LastModified><Size>12</Size></Version>
+				<Version><Key>root/nginx.conf.bak</Key><VersionId>v3</VersionId><IsLatest>true</IsLatest><LastModified>2018-01-03T00:00:00.000Z</LastModified><Size>12</Size></Version>
+				<DeleteMarker><Key>root/nginx.conf</Key><VersionId>v4</VersionId><IsLatest>true</IsLatest><LastModified>2018-01-04T00:00:00.000Z</LastModified></DeleteMarker>
+			</ListVersionsResult>`))
+		case r.Method == http.MethodHead:
+			heads = append(heads, r.URL.Path+"?"+r.URL.RawQuery)
+			w.Header().Set("X-Amz-Meta-Checksum", "sum")
+			w.Header().Set("X-Amz-Meta-Hostname", "test-host")
+			w.Header().Set("X-Amz-Meta-Blob-Size", "2048")
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+	})
+
+	session := createTestSetup(handler)
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config:  &S3Options{BucketRoot: "root", Versioning: true},
+	}
+
+	versions, err := uploader.ListVersions("nginx.conf")
+	assert.Nil(t, err, "Should list the versions")
+	assert.Len(t, versions, 3, "Should only list versions of the file")
+	assert.Equal(t, "v4", versions[0].VersionID, "Should be newest first")
+	assert.True(t, versions[0].DeleteMarker, "Should include delete markers")
+	assert.Equal(t, int64(12), versions[1].Size, "Should use the listed size")
+	assert.Nil(t, versions[1].Metadata, "Shouldn't fetch the metadata")
+	assert.Empty(t, heads, "Should only use the listing")
+
+	objects, err := uploader.ListObjects("")
+	assert.Nil(t, err, "Should list the objects")
+	assert.Len(t, objects, 1, "Should skip old versions and deleted files")
+	assert.Equal(t, "v3", objects[0].VersionID, "Should use the listed version")
+	assert.Empty(t, heads, "Should only use the listing")
+
+	assert.Nil(t, uploader.HeadVersion(&versions[1]), "Should fetch the metadata")
+	assert.Equal(t, []string{"/root/nginx.conf?versionId=v2"}, heads, "Should fetch the listed version")
+	assert.Equal(t, "test-host", versions[1].Metadata.Hostname, "Should have the provenance")
+	assert.Equal(t, int64(2048), versions[1].Size, "Should report the size of the blob")
+	assert.Nil(t, uploader.HeadVersion(&versions[0]), "Delete markers don't have metadata")
+	assert.Len(t, heads, 1, "Shouldn't fetch delete markers")
+}
+
+func TestMoveObject(t *testing.T) {
+	var size int64 = 6 * 1024 * 1024 * 1024
+	var requests []string
+	var ranges []string
+	var sources []string
+	var deleted string
+	var create http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		_, listing := query["versions"]
+		_, deleting := query["delete"]
+		switch {
+		case r.Method == http.MethodGet && listing:
+			w.Write([]byte(`<ListVersionsResult>
+				<Version><Key>old/file</Key><VersionId>v1</VersionId><IsLatest>false</IsLatest><LastModified>2018-01-01T00:00:00.000Z</LastModified></Version>
+				<Version><Key>old/file</Key><VersionId>v2</VersionId><IsLatest>false</IsLatest><LastModified>2018-01-02T00:00:00.000Z</LastModified></Version>
+				<DeleteMarker><Key>old/file</Key><VersionId>d1</VersionId><IsLatest>true</IsLatest><LastModified>2018-01-03T00:00:00.000Z</LastModified></DeleteMarker>
+			</ListVersionsResult>`))
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("X-Amz-Version-Id", query.Get("versionId"))
+			w.Header().Set("X-Amz-Meta-Checksum", "sum")
+			w.Header().Set("X-Amz-Storage-Class", "STANDARD_IA")
+		case r.Method == http.MethodGet:
+			assert.Contains(t, query, "tagging", "Should read the tags")
+			w.Write([]byte(`<Tagging><TagSet><Tag><Key>host</Key><Value>web-1</Value></Tag></TagSet></Tagging>`))
+		case r.Method == http.MethodPost && deleting:
+			body, _ := ioutil.ReadAll(r.Body)
+			deleted = string(body)
+			w.Write([]byte(`<DeleteResult></DeleteResult>`))
+		case r.Method == http.MethodPost && query.Get("uploadId") == "":
+			create = r.Header
+			w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && query.Get("uploadId") == "upload":
+			ranges = append(ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+			w.Write([]byte(`<CopyPartResult><ETag>"part"</ETag></CopyPartResult>`))
+		case r.Method == http.MethodPut:
+			sources = append(sources, r.Header.Get("X-Amz-Copy-Source"))
+			w.Write([]byte(`<CopyObjectResult><ETag>"object"</ETag></CopyObjectResult>`))
+		case r.Method == http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Contains(t, string(body), "<PartNumber>12</PartNumber>", "Should complete every part")
+			w.Write([]byte(`<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	session := createTestSetup(handler)
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config:  &S3Options{Versioning: true},
+	}
+
+	moved, err := uploader.MoveObject("old/file", "new/file")
+	assert.Nil(t, err, "Should move the object")
+	assert.Equal(t, 2, moved, "Should move every version")
+	assert.Len(t, ranges, 24, "Should copy 6GB in 512MB parts, for each version")
+	assert.Equal(t, "bytes=0-536870911", ranges[0], "Should copy the first part")
+	assert.Equal(t, fmt.Sprintf("bytes=%d-%d", size-copyPartSize, size-1), ranges[11], "Should copy the rest in the last part")
+	assert.Equal(t, "sum", create.Get("X-Amz-Meta-Checksum"), "Should carry over the metadata")
+	assert.Equal(t, "host=web-1", create.Get("X-Amz-Tagging"), "Should carry over the tags")
+	assert.Equal(t, "STANDARD_IA", create.Get("X-Amz-Storage-Class"), "Should keep the storage class")
+	assert.Equal(t, "POST /", requests[len(requests)-1], "Should remove the old key last")
+	for _, version := range []string{"v1", "v2", "d1"} {
+		assert.Contains(t, deleted, "<VersionId>"+version+"</VersionId>", "Should remove every version of the old key")
+	}
+
+	size = 1024
+	requests = nil
+	moved, err = uploader.MoveObject("old/file", "new/file")
+	assert.Nil(t, err, "Should move the object")
+	assert.Equal(t, 2, moved, "Should move every version")
+	assert.Equal(t, []string{"%2Fold%2Ffile?versionId=v1", "%2Fold%2Ffile?versionId=v2"}, sources, "Should copy the oldest version first")
+	assert.Equal(t, []string{"GET /", "HEAD /old/file", "PUT /new/file", "HEAD /old/file", "PUT /new/file", "POST /"}, requests,
+		"Should copy small objects in one request")
+}
+
+func TestContentAddressedRecheck(t *testing.T) {
+	testBytes := []byte("Collected resolv.conf")
+	hashString := hashBytes(testBytes)
+	blobPath := "/blobs/sha256/" + hashString
+
+	var uploaded []string
+	var blobBody []byte
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		switch r.Method {
+		case http.MethodHead:
+			// The blob is collected once the pointer has been written
+			if len(uploaded) > 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(testBytes)))
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		case http.MethodPut:
+			uploaded = append(uploaded, r.URL.Path)
+			if r.URL.Path == blobPath {
+				blobBody, _ = ioutil.ReadAll(r.Body)
+			}
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	session := createTestSetup(handler)
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config:  &S3Options{Versioning: true, ContentAddressed: true},
+	}
+
+	err := uploader.UploadFile("resolv.conf", bytes.NewReader(testBytes), "host-1/etc/resolv.conf", &ObjectMetadata{Checksum: hashString})
+	assert.Nil(t, err, "Should upload")
+	assert.Equal(t, []string{"/host-1/etc/resolv.conf", blobPath}, uploaded, "Should upload the blob again after the pointer")
+	assert.Equal(t, testBytes, blobBody, "Should upload the whole body")
+}
+
+func TestCollectGarbage(t *testing.T) {
+	old := "2018-01-01T00:00:00.000Z"
+	recent := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	var deleted string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `<ListVersionsResult>
+				<Version><Key>host/file</Key><VersionId>p1</VersionId><IsLatest>true</IsLatest><LastModified>%[1]s</LastModified></Version>
+				<Version><Key>blobs/sha256/used</Key><VersionId>b1</VersionId><IsLatest>true</IsLatest><LastModified>%[1]s</LastModified></Version>
+				<Version><Key>blobs/sha256/used</Key><VersionId>b0</VersionId><IsLatest>false</IsLatest><LastModified>%[1]s</LastModified></Version>
+				<Version><Key>blobs/sha256/unused</Key><VersionId>b2</VersionId><IsLatest>true</IsLatest><LastModified>%[1]s</LastModified></Version>
+				<Version><Key>blobs/sha256/uploading</Key><VersionId>b3</VersionId><IsLatest>true</IsLatest><LastModified>%[2]s</LastModified></Version>
+				<Version><Key>blobs/sha256/reused</Key><VersionId>b4</VersionId><IsLatest>true</IsLatest><LastModified>%[1]s</LastModified></Version>
+				<DeleteMarker><Key>host/removed</Key><VersionId>d1</VersionId><LastModified>%[1]s</LastModified></DeleteMarker>
+			</ListVersionsResult>`, old, recent)
+		case http.MethodHead:
+			switch r.URL.Path {
+			case "/host/file":
+				w.Header().Set("X-Amz-Meta-Blob", "blobs/sha256/used")
+			case "/blobs/sha256/unused":
+				w.Header().Set("Last-Modified", "Mon, 01 Jan 2018 00:00:00 GMT")
+			case "/blobs/sha256/reused":
+				// Another host refreshed the blob after it was listed
+				w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			default:
+				t.Errorf("Unexpected check of %s", r.URL.Path)
+			}
+		case http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			deleted = string(body)
+			w.Write([]byte(`<DeleteResult></DeleteResult>`))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	session := createTestSetup(handler)
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config:  &S3Options{Versioning: true, ContentAddressed: true},
+	}
+
+	garbage, err := uploader.CollectGarbage(true)
+	assert.Nil(t, err, "Should find the garbage")
+	assert.Len(t, garbage, 2, "Should skip referenced, recent and reused blobs")
+	keys := map[string]string{}
+	for _, version := range garbage {
+		keys[version.VersionID] = version.Key
+	}
+	assert.Equal(t, map[string]string{"b0": "blobs/sha256/used", "b2": "blobs/sha256/unused"}, keys,
+		"Should collect the unreferenced blob, and the previous versions of referenced ones")
+	assert.Empty(t, deleted, "Dry runs don't delete anything")
+
+	_, err = uploader.CollectGarbage(false)
+	assert.Nil(t, err, "Should collect the garbage")
+	assert.Contains(t, deleted, "<Key>blobs/sha256/unused</Key><VersionId>b2</VersionId>", "Should delete the unreferenced blob")
+	assert.NotContains(t, deleted, "<VersionId>b1</VersionId>", "Should keep referenced blobs")
+	assert.NotContains(t, deleted, "blobs/sha256/reused", "Should keep blobs which were reused")
+}
+
+func TestDeleteErrors(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`<ListVersionsResult>
+				<Version><Key>host/file</Key><VersionId>v3</VersionId><IsLatest>true</IsLatest><LastModified>2018-01-03T00:00:00.000Z</LastModified></Version>
+				<Version><Key>host/file</Key><VersionId>v2</VersionId><LastModified>2018-01-02T00:00:00.000Z</LastModified></Version>
+				<Version><Key>host/file</Key><VersionId>v1</VersionId><LastModified>2018-01-01T00:00:00.000Z</LastModified></Version>
+			</ListVersionsResult>`))
+		case http.MethodPost:
+			// Locked versions are reported in the body of a successful response
+			w.Write([]byte(`<DeleteResult>
+				<Deleted><Key>host/file</Key><VersionId>v2</VersionId></Deleted>
+				<Error><Key>host/file</Key><VersionId>v1</VersionId><Code>AccessDenied</Code><Message>Access Denied because object protected by object lock.</Message></Error>
+			</DeleteResult>`))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	session := createTestSetup(handler)
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config:  &S3Options{Versioning: true},
+	}
+
+	_, err := uploader.Prune("host", &RetentionPolicy{KeepLast: 1}, false)
+	assert.NotNil(t, err, "Should report the versions which weren't deleted")
+	assert.Contains(t, err.Error(), "unable to delete 1 of 2 versions", "Should count the failures")
+	assert.Contains(t, err.Error(), "object lock", "Should include the reason")
+}
+
+func TestResolveBlob(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/host/file":
+			assert.Equal(t, "versionId=p1", r.URL.RawQuery, "Should read the requested version")
+			w.Header().Set("X-Amz-Meta-Blob", "blobs/sha256/sum")
+			w.Write([]byte(`{"blob":"blobs/sha256/sum"}`))
+		case "/blobs/sha256/sum":
+			w.Write([]byte("file contents"))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	session := createTestSetup(handler)
+	uploader := &S3Uploader{
+		session: session,
+		client:  s3.New(session),
+		config:  &S3Options{ContentAddressed: true},
+	}
+
+	body, err := uploader.GetVersion("host/file", "p1")
+	assert.Nil(t, err, "Should read the version")
+	data, err := ioutil.ReadAll(body)
+	assert.Nil(t, err, "Should read the body")
+	assert.Equal(t, "file contents", string(data), "Should return the body of the blob")
+}
@@ -1,11 +1,85 @@
 package backends
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Uploader - Primary interface to be implemented by the various backends
+// Files are addressed by their object key, relative to the root of the backend
 type Uploader interface {
-	UploadFile(name string, data io.Reader, remotePath string, checksum string)
-	FileInSync(name string, remotePath string, data io.Reader, checksum string) (bool, error)
-	DeleteFile(name string, remotePath string)
+	UploadFile(name string, data io.Reader, key string, metadata *ObjectMetadata) error
+	FileInSync(name string, key string, data io.Reader, metadata *ObjectMetadata) (bool, error)
+	DeleteFile(name string, key string) error
 	GetName() string
 }
+
+// ObjectMetadata - Provenance information stored alongside each uploaded object
+// Backends without native object metadata should store this in a sidecar object
+type ObjectMetadata struct {
+	Checksum      string
+	Hostname      string
+	MachineID     string
+	Watcher       string
+	Event         string
+	ModTime       time.Time
+	BackerVersion string
+	StorageClass  string // Overrides the storage class of the backend for this file, it isn't stored with the object
+}
+
+// CountingReader - Counts the number of bytes read from the wrapped reader
+type CountingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+// NewCountingReader - Wrap the reader, to count the bytes read from it
+func NewCountingReader(reader io.Reader) *CountingReader {
+	return &CountingReader{
+		reader: reader,
+	}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Count - Returns the number of bytes read so far
+func (c *CountingReader) Count() int64 {
+	return c.count
+}
+
+// Pruner - Optional interface for backends which can expire old versions of objects
+type Pruner interface {
+	Prune(prefix string, policy *RetentionPolicy, dryRun bool) ([]ObjectVersion, error)
+}
+
+// GarbageCollector - Optional interface for backends which share data between objects
+// Shared data which is no longer referenced is removed once the retention policies have been applied
+type GarbageCollector interface {
+	CollectGarbage(dryRun bool) ([]ObjectVersion, error)
+}
+
+// VersionReader - Optional interface for backends which can retrieve stored copies of a file
+// An empty versionID returns the latest version. Listings don't include the metadata of each version,
+// HeadVersion fetches it when it's needed
+type VersionReader interface {
+	GetVersion(key string, versionID string) (io.ReadCloser, error)
+	ListVersions(key string) ([]ObjectVersion, error)
+	ListObjects(prefix string) ([]ObjectVersion, error)
+	HeadVersion(version *ObjectVersion) error
+}
+
+// Mover - Optional interface for backends which can move objects to a new key
+// Every version of the object is moved, the number of versions moved is returned
+type Mover interface {
+	MoveObject(from string, to string) (int, error)
+}
+
+// Inventory - Optional interface for backends which can report what they hold without transferring any data
+// Returns the checksum of the latest version of each object under the prefix, keyed the same way as uploads
+type Inventory interface {
+	Checksums(prefix string) (map[string]string, error)
+}
@@ -0,0 +1,324 @@
+// Package client - Typed access to a running backer daemon
+//
+// Every operation the CLI can run is available as a method, taking a context and the request types from
+// the shared package. Connections check that the daemon speaks the same protocol version before they're used.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// Config - Where to find the daemon, and how long to wait for it
+type Config struct {
+	Socket  string        // Control socket of a local daemon, defaults to shared.DefaultSocket
+	Host    string        // host:port of a remote daemon, used instead of the socket when set
+	TLS     *tls.Config   // Client certificate and CAs used to connect to Host
+	Timeout time.Duration // Limit for each call whose context has no deadline, zero waits forever
+}
+
+// Client - Connection to the daemon
+type Client struct {
+	rpc     *rpc.Client
+	timeout time.Duration
+	daemon  shared.VersionInfo
+}
+
+// IncompatibleError - The daemon speaks a different protocol version than this package
+type IncompatibleError struct {
+	Protocol int
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("daemon speaks protocol version %d, this client needs version %d", e.Protocol, shared.ProtocolVersion)
+}
+
+// IsServerError - Whether the daemon ran the operation and returned an error, rather than being unreachable
+func IsServerError(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return ok
+}
+
+// Dial - Connect to the daemon described by the config
+func Dial(ctx context.Context, config Config) (*Client, error) {
+	var dialer net.Dialer
+	if config.Host == "" {
+		socket := config.Socket
+		if socket == "" {
+			socket = shared.DefaultSocket
+		}
+		conn, err := dialer.DialContext(ctx, "unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(ctx, conn, config.Timeout)
+	}
+
+	if config.TLS == nil {
+		return nil, errors.New("remote daemons need a TLS config")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", config.Host)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := config.TLS.Clone()
+	if tlsConfig.ServerName == "" {
+		if tlsConfig.ServerName, _, err = net.SplitHostPort(config.Host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return NewClient(ctx, tlsConn, config.Timeout)
+}
+
+// NewClient - Use an existing connection to the daemon, closing it if the daemon isn't compatible
+func NewClient(ctx context.Context, conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{
+		rpc:     rpc.NewClient(conn),
+		timeout: timeout,
+	}
+	info, err := c.Version(ctx)
+	if err != nil {
+		c.Close()
+		// Daemons from before the protocol was versioned don't know about the call
+		if IsServerError(err) && strings.Contains(err.Error(), "can't find method") {
+			return nil, &IncompatibleError{}
+		}
+		return nil, err
+	}
+	if info.Protocol != shared.ProtocolVersion {
+		c.Close()
+		return nil, &IncompatibleError{Protocol: info.Protocol}
+	}
+	c.daemon = *info
+	return c, nil
+}
+
+// LoadTLSConfig - Build the TLS config for a remote daemon, from PEM files
+// An empty CA uses the system roots to verify the daemon
+func LoadTLSConfig(cert string, key string, ca string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	return config, nil
+}
+
+// Daemon - The protocol and release of the daemon, as reported when connecting
+func (c *Client) Daemon() shared.VersionInfo {
+	return c.daemon
+}
+
+// Close - Close the connection to the daemon
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// call - Run an operation on the daemon, giving up when the context is done
+// The daemon may still finish the operation after the client has stopped waiting
+func (c *Client) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	call := c.rpc.Go("RPC."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Version - Protocol and release of the daemon
+func (c *Client) Version(ctx context.Context) (*shared.VersionInfo, error) {
+	info := &shared.VersionInfo{}
+	if err := c.call(ctx, "Version", &shared.VersionArgs{Protocol: shared.ProtocolVersion}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ListWatchers - Paths of every watcher
+func (c *Client) ListWatchers(ctx context.Context) (*shared.FileWatchers, error) {
+	watchers := &shared.FileWatchers{}
+	if err := c.call(ctx, "ListWatchers", 0, watchers); err != nil {
+		return nil, err
+	}
+	return watchers, nil
+}
+
+// AddWatcher - Start watching a directory, saving it to the config
+func (c *Client) AddWatcher(ctx context.Context, args *shared.WatchArgs) (*shared.FileWatchers, error) {
+	watchers := &shared.FileWatchers{}
+	if err := c.call(ctx, "AddWatcher", args, watchers); err != nil {
+		return nil, err
+	}
+	return watchers, nil
+}
+
+// RemoveWatcher - Stop watching a directory, saving it to the config
+func (c *Client) RemoveWatcher(ctx context.Context, args *shared.WatchArgs) (*shared.FileWatchers, error) {
+	watchers := &shared.FileWatchers{}
+	if err := c.call(ctx, "RemoveWatcher", args, watchers); err != nil {
+		return nil, err
+	}
+	return watchers, nil
+}
+
+// Reload - Re-read the config file
+func (c *Client) Reload(ctx context.Context) (*shared.ReloadResult, error) {
+	result := &shared.ReloadResult{}
+	if err := c.call(ctx, "Reload", 0, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Status - Health of the watchers, backends and queues
+func (c *Client) Status(ctx context.Context) (*shared.StatusReport, error) {
+	report := &shared.StatusReport{}
+	if err := c.call(ctx, "Status", 0, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ListObjects - Current version of every stored object
+func (c *Client) ListObjects(ctx context.Context, args *shared.ListArgs) (*shared.ObjectList, error) {
+	objects := &shared.ObjectList{}
+	if err := c.call(ctx, "ListObjects", args, objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// ListObjectVersions - Stored versions of a single file
+func (c *Client) ListObjectVersions(ctx context.Context, args *shared.Args) (*shared.BucketObjects, error) {
+	objects := &shared.BucketObjects{}
+	if err := c.call(ctx, "ListObjectVersions", args, objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Diff - Compare a file against a stored version, or two stored versions
+func (c *Client) Diff(ctx context.Context, args *shared.DiffArgs) (*shared.DiffResult, error) {
+	result := &shared.DiffResult{}
+	if err := c.call(ctx, "Diff", args, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Log - History of a single file
+func (c *Client) Log(ctx context.Context, args *shared.LogArgs) (*shared.FileLog, error) {
+	history := &shared.FileLog{}
+	if err := c.call(ctx, "Log", args, history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Prune - Enforce the retention policies
+func (c *Client) Prune(ctx context.Context, args *shared.PruneArgs) (*shared.PruneResult, error) {
+	result := &shared.PruneResult{}
+	if err := c.call(ctx, "Prune", args, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// MigrateKeys - Move stored objects from an old key template to the current one
+func (c *Client) MigrateKeys(ctx context.Context, args *shared.MigrateArgs) (*shared.MigrateResult, error) {
+	result := &shared.MigrateResult{}
+	if err := c.call(ctx, "MigrateKeys", args, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Sync - Start reconciling local files with the backends, use SyncProgress to follow the job
+func (c *Client) Sync(ctx context.Context, args *shared.SyncArgs) (*shared.SyncJob, error) {
+	job := &shared.SyncJob{}
+	if err := c.call(ctx, "Sync", args, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// SyncProgress - Files reconciled by a sync job since the offset
+func (c *Client) SyncProgress(ctx context.Context, args *shared.SyncProgressArgs) (*shared.SyncProgress, error) {
+	progress := &shared.SyncProgress{}
+	if err := c.call(ctx, "SyncProgress", args, progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// Events - Pipeline events after a sequence number
+// Waiting calls block on the daemon until an event arrives, so the timeout only starts once the daemon has given up
+func (c *Client) Events(ctx context.Context, args *shared.EventsArgs) (*shared.EventBatch, error) {
+	if _, ok := ctx.Deadline(); !ok && args.Wait && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, shared.EventWait+c.timeout)
+		defer cancel()
+	}
+	batch := &shared.EventBatch{}
+	if err := c.call(ctx, "Events", args, batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Pause - Stop uploading files until resumed, or the duration has passed
+func (c *Client) Pause(ctx context.Context, args *shared.PauseArgs) (*shared.PauseStatus, error) {
+	status := &shared.PauseStatus{}
+	if err := c.call(ctx, "Pause", args, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Resume - Start uploading files again
+func (c *Client) Resume(ctx context.Context) (*shared.PauseStatus, error) {
+	status := &shared.PauseStatus{}
+	if err := c.call(ctx, "Resume", 0, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
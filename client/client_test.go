@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeDaemon - Answers the calls the tests need, in place of the daemon
+type FakeDaemon struct {
+	protocol int
+	delay    time.Duration
+}
+
+func (f *FakeDaemon) Version(args *shared.VersionArgs, info *shared.VersionInfo) error {
+	*info = shared.VersionInfo{Protocol: f.protocol, Backer: "test"}
+	return nil
+}
+
+func (f *FakeDaemon) Status(args int, report *shared.StatusReport) error {
+	time.Sleep(f.delay)
+	*report = shared.StatusReport{Healthy: true}
+	return nil
+}
+
+func (f *FakeDaemon) Events(args *shared.EventsArgs, batch *shared.EventBatch) error {
+	time.Sleep(f.delay)
+	*batch = shared.EventBatch{Last: args.After}
+	return nil
+}
+
+func (f *FakeDaemon) Resume(args int, status *shared.PauseStatus) error {
+	return errors.New("uploads are not paused")
+}
+
+func serveFake(t *testing.T, fake *FakeDaemon) (string, func()) {
+	dir, err := ioutil.TempDir("", "backer-client")
+	assert.Nil(t, err, "Should create temp dir")
+	socket := filepath.Join(dir, "backer.sock")
+	l, err := net.Listen("unix", socket)
+	assert.Nil(t, err, "Should listen")
+
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName("RPC", fake), "Should register")
+	go server.Accept(l)
+	return socket, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDial(t *testing.T) {
+	socket, cleanup := serveFake(t, &FakeDaemon{protocol: shared.ProtocolVersion})
+	defer cleanup()
+
+	c, err := Dial(context.Background(), Config{Socket: socket})
+	assert.Nil(t, err, "Should connect")
+	defer c.Close()
+	assert.Equal(t, "test", c.Daemon().Backer, "Should remember the daemon version")
+
+	report, err := c.Status(context.Background())
+	assert.Nil(t, err, "Should get the status")
+	assert.True(t, report.Healthy, "Should decode the reply")
+
+	_, err = c.Resume(context.Background())
+	assert.Equal(t, "uploads are not paused", err.Error(), "Should return the daemon error")
+	assert.True(t, IsServerError(err), "Should be a server error")
+
+	_, err = Dial(context.Background(), Config{Socket: socket + ".missing"})
+	assert.NotNil(t, err, "Should fail without a daemon")
+	assert.False(t, IsServerError(err), "Connection failures aren't server errors")
+}
+
+func TestIncompatibleDaemon(t *testing.T) {
+	socket, cleanup := serveFake(t, &FakeDaemon{protocol: shared.ProtocolVersion + 1})
+	defer cleanup()
+
+	_, err := Dial(context.Background(), Config{Socket: socket})
+	assert.IsType(t, &IncompatibleError{}, err, "Should refuse other protocol versions")
+	assert.Equal(t, shared.ProtocolVersion+1, err.(*IncompatibleError).Protocol, "Should report the daemon protocol")
+}
+
+func TestTimeout(t *testing.T) {
+	socket, cleanup := serveFake(t, &FakeDaemon{protocol: shared.ProtocolVersion, delay: time.Second})
+	defer cleanup()
+
+	c, err := Dial(context.Background(), Config{Socket: socket, Timeout: 50 * time.Millisecond})
+	assert.Nil(t, err, "Should connect")
+	defer c.Close()
+
+	_, err = c.Status(context.Background())
+	assert.Equal(t, context.DeadlineExceeded, err, "Should give up after the timeout")
+
+	// Deadlines on the context win over the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = c.Status(ctx)
+	assert.Nil(t, err, "Should wait for the context deadline")
+
+	// Following events waits on the daemon first
+	_, err = c.Events(context.Background(), &shared.EventsArgs{})
+	assert.Equal(t, context.DeadlineExceeded, err, "Should time out without waiting")
+	_, err = c.Events(context.Background(), &shared.EventsArgs{Wait: true})
+	assert.Nil(t, err, "Should wait for the daemon to give up first")
+}
@@ -1,44 +1,829 @@
 package main
 
 import (
-	"net/rpc"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/nickrobison/backer/client"
+	"github.com/nickrobison/backer/daemon"
 	"github.com/nickrobison/backer/shared"
-	"github.com/olekukonko/tablewriter"
 	"gopkg.in/urfave/cli.v1"
 )
 
+// dialDaemon - Connect to the daemon on the local socket, or the remote host given with --host
+func dialDaemon(c *cli.Context) (*client.Client, error) {
+	config := client.Config{
+		Socket:  c.GlobalString("socket"),
+		Host:    c.GlobalString("host"),
+		Timeout: c.GlobalDuration("timeout"),
+	}
+	if config.Host != "" {
+		tlsConfig, err := client.LoadTLSConfig(c.GlobalString("tls-cert"), c.GlobalString("tls-key"), c.GlobalString("tls-ca"))
+		if err != nil {
+			return nil, cli.NewExitError(err.Error(), exitUsage)
+		}
+		config.TLS = tlsConfig
+	}
+
+	conn, err := client.Dial(context.Background(), config)
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), exitUnreachable)
+	}
+	return conn, nil
+}
+
+// fileArgument - Returns the absolute path of the file given on the command line
+func fileArgument(c *cli.Context) (string, error) {
+	if c.NArg() != 1 {
+		return "", cli.NewExitError("Must specify a single file", exitUsage)
+	}
+	path, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return "", cli.NewExitError(err.Error(), exitUsage)
+	}
+	return path, nil
+}
+
 func listWatchers(c *cli.Context) error {
 	log.Debugln("Listing watchers")
-	client, err := rpc.Dial("unix", "/tmp/backer.sock")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Status(context.Background())
+	if err != nil {
+		return daemonError(err)
+	}
+
+	table := newTable("Path", "Status")
+	for _, watcher := range reply.Watchers {
+		table.append(watcher.Path, healthString(watcher.Healthy))
+	}
+	return printResult(c, reply.Watchers, table)
+}
+
+func addWatcher(c *cli.Context) error {
+	path, err := fileArgument(c)
+	if err != nil {
+		return err
+	}
+	log.Debugln("Adding watcher for", path)
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	bucketPath := c.String("bucket-path")
+	if bucketPath == "" {
+		bucketPath = filepath.Base(path)
+	}
+	args := &shared.WatchArgs{
+		Path:       path,
+		BucketPath: bucketPath,
+		Sync:       c.Bool("sync"),
+	}
+	reply, err := client.AddWatcher(context.Background(), args)
+	if err != nil {
+		return daemonError(err)
+	}
+
+	if humanOutput(c) {
+		fmt.Printf("Watching %s as %s\n", path, bucketPath)
+		return nil
+	}
+	return printResult(c, reply, watcherTable(reply))
+}
+
+func removeWatcher(c *cli.Context) error {
+	path, err := fileArgument(c)
+	if err != nil {
+		return err
+	}
+	log.Debugln("Removing watcher for", path)
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.RemoveWatcher(context.Background(), &shared.WatchArgs{Path: path})
+	if err != nil {
+		return daemonError(err)
+	}
+
+	if humanOutput(c) {
+		fmt.Printf("Stopped watching %s, %d watchers remaining\n", path, len(reply.Paths))
+		return nil
+	}
+	return printResult(c, reply, watcherTable(reply))
+}
+
+func watcherTable(watchers *shared.FileWatchers) *table {
+	table := newTable("Path")
+	for _, path := range watchers.Paths {
+		table.append(path)
+	}
+	return table
+}
+
+func reloadConfig(c *cli.Context) error {
+	log.Debugln("Reloading config")
+	client, err := dialDaemon(c)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 	defer client.Close()
 
-	var reply = &shared.FileWatchers{}
-	err = client.Call("RPC.ListWatchers", 0, &reply)
+	reply, err := client.Reload(context.Background())
 	if err != nil {
-		log.Fatalln(err)
+		return cli.NewExitError("Unable to reload, the daemon is still running the previous config: "+err.Error(), exitCode(err))
 	}
 
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Path", "Status"})
+	table := newTable("Path", "Change")
+	for _, path := range reply.Added {
+		table.append(path, "Added")
+	}
+	for _, path := range reply.Updated {
+		table.append(path, "Updated")
+	}
+	for _, path := range reply.Removed {
+		table.append(path, "Removed")
+	}
+	if err = printResult(c, reply, table); err != nil {
+		return err
+	}
 
-	for _, watcher := range reply.Paths {
-		table.Append([]string{watcher, "OK"})
+	if reply.Backends {
+		printMessage(c, "Backends were rebuilt with the new options\n")
 	}
-	table.Render()
 	return nil
 }
 
-func listObjects(c *cli.Context) error {
+func pauseUploads(c *cli.Context) error {
+	log.Debugln("Pausing uploads")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Pause(context.Background(), &shared.PauseArgs{Duration: c.Duration("for")})
+	if err != nil {
+		return daemonError(err)
+	}
+	if humanOutput(c) {
+		fmt.Println(pausedString(reply.Until))
+		return nil
+	}
+	return printResult(c, reply, pauseTable(reply))
+}
+
+func resumeUploads(c *cli.Context) error {
+	log.Debugln("Resuming uploads")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Resume(context.Background())
+	if err != nil {
+		return daemonError(err)
+	}
+	if humanOutput(c) {
+		fmt.Printf("Uploads resumed, flushing %d queued changes\n", reply.Queued)
+		return nil
+	}
+	return printResult(c, reply, pauseTable(reply))
+}
+
+func pauseTable(status *shared.PauseStatus) *table {
+	table := newTable("Paused", "Until", "Queued")
+	table.append(strconv.FormatBool(status.Paused), formatTime(status.Until), strconv.Itoa(status.Queued))
+	return table
+}
+
+func pausedString(until time.Time) string {
+	if until.IsZero() {
+		return "Uploads are paused until resumed"
+	}
+	return "Uploads are paused until " + formatTime(until)
+}
+
+func daemonStatus(c *cli.Context) error {
+	log.Debugln("Retrieving daemon status")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Status(context.Background())
+	if err != nil {
+		return daemonError(err)
+	}
+
+	if reply.Paused {
+		printMessage(c, "PAUSED: %s\n\n", pausedString(reply.PausedUntil))
+	}
+
+	watchers := newTable("Watcher", "Status", "Alive", "Files", "Last sync", "Last error", "Error time")
+	for _, watcher := range reply.Watchers {
+		watchers.append(
+			watcher.Path,
+			healthString(watcher.Healthy),
+			strconv.FormatBool(watcher.Alive),
+			strconv.Itoa(watcher.FileCount),
+			formatTime(watcher.LastSync),
+			watcher.LastError,
+			formatTime(watcher.LastErrorTime),
+		)
+	}
+
+	backends := newTable("Backend", "Status", "In flight", "Bytes", "Last success", "Last error", "Error time")
+	for _, backend := range reply.Backends {
+		backends.append(
+			backend.Name,
+			healthString(backend.Healthy),
+			strconv.Itoa(backend.InFlight),
+			strconv.FormatInt(backend.BytesTransferred, 10),
+			formatTime(backend.LastSuccess),
+			backend.LastError,
+			formatTime(backend.LastErrorTime),
+		)
+	}
+
+	queues := newTable("Queue", "Depth")
+	for _, queue := range reply.Queues {
+		queues.append(queue.Name, strconv.Itoa(queue.Depth))
+	}
+
+	pipeline := newTable("Dropped events", "Last reconcile")
+	pipeline.append(strconv.Itoa(reply.EventOverflows), formatTime(reply.LastReconcile))
+
+	if err = printResult(c, reply, watchers, backends, queues, pipeline); err != nil {
+		return err
+	}
+
+	// Let monitoring know that something is wrong
+	if !reply.Healthy {
+		return cli.NewExitError("Daemon is unhealthy", exitProblems)
+	}
 	return nil
 }
 
+func healthString(healthy bool) string {
+	if healthy {
+		return "OK"
+	}
+	return "FAILING"
+}
+
+func listObjects(c *cli.Context) error {
+	log.Debugln("Listing objects")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.ListObjects(context.Background(), &shared.ListArgs{Metadata: c.Bool("metadata")})
+	if err != nil {
+		return daemonError(err)
+	}
+
+	table := newTable("Backend", "Key", "Modified", "Size", "Checksum", "Host", "Watcher", "Event", "Backer")
+	for _, object := range reply.Objects {
+		table.append(
+			object.Backend,
+			object.Key,
+			object.LastModified.Format(time.RFC3339),
+			strconv.FormatInt(object.Size, 10),
+			displayChecksum(c, object.Checksum),
+			object.Hostname,
+			object.Watcher,
+			object.Event,
+			object.BackerVersion,
+		)
+	}
+	return printResult(c, reply, table)
+}
+
 func listObjectVersions(c *cli.Context) error {
+	path, err := fileArgument(c)
+	if err != nil {
+		return err
+	}
+	log.Debugln("Listing versions of", path)
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.ListObjectVersions(context.Background(), &shared.Args{Path: path})
+	if err != nil {
+		return daemonError(err)
+	}
+
+	table := newTable("Version")
+	for _, version := range reply.Version {
+		table.append(version)
+	}
+	return printResult(c, reply, table)
+}
+
+func syncFiles(c *cli.Context) error {
+	args := &shared.SyncArgs{
+		All:    c.Bool("all"),
+		DryRun: c.Bool("dry-run"),
+	}
+	if !args.All {
+		path, err := fileArgument(c)
+		if err != nil {
+			return err
+		}
+		args.Path = path
+	}
+	log.Debugln("Syncing", args.Path)
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	job, err := client.Sync(context.Background(), args)
+	if err != nil {
+		return daemonError(err)
+	}
+
+	// Poll for results, printing each file as it's reconciled
+	// Other formats wait for the job to finish, and print every file at once
+	offset := 0
+	var files []shared.SyncFile
+	var reply *shared.SyncProgress
+	for {
+		reply, err = client.SyncProgress(context.Background(), &shared.SyncProgressArgs{ID: job.ID, Offset: offset})
+		if err != nil {
+			return daemonError(err)
+		}
+		for _, file := range reply.Files {
+			if humanOutput(c) {
+				printSyncFile(file, reply.DryRun)
+			}
+		}
+		files = append(files, reply.Files...)
+		offset += len(reply.Files)
+		if reply.Done {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	reply.Files = files
+	return printSyncResult(c, reply)
+}
+
+// runOnce - Reconcile every watcher without a daemon, for hosts which can't keep one running
+func runOnce(c *cli.Context) error {
+	if !c.Bool("once") {
+		return cli.NewExitError("Use --once to reconcile the watchers and exit, or --daemon to keep running", exitUsage)
+	}
+	config := c.String("config")
+	if config == "" {
+		config = c.GlobalString("config")
+	}
+
+	dryRun := c.Bool("dry-run")
+	reply, err := daemon.RunOnce(config, Version, dryRun, c.Bool("delete-orphans"), func(file shared.SyncFile) {
+		if humanOutput(c) {
+			printSyncFile(file, dryRun)
+		}
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitFailed)
+	}
+	return printSyncResult(c, reply)
+}
+
+// printSyncResult - Print the outcome of a sync, people have already seen each file so only get the summary
+func printSyncResult(c *cli.Context, reply *shared.SyncProgress) error {
+	var err error
+	if humanOutput(c) {
+		uploaded := "Uploaded"
+		if reply.DryRun {
+			uploaded = "Would upload"
+		}
+		summary := newTable(uploaded, "Unchanged", "Failed", "Orphaned")
+		summary.append(
+			strconv.Itoa(reply.Summary.Uploaded),
+			strconv.Itoa(reply.Summary.Unchanged),
+			strconv.Itoa(reply.Summary.Failed),
+			strconv.Itoa(reply.Summary.Orphaned),
+		)
+		err = printResult(c, reply.Summary, summary)
+	} else {
+		table := newTable("Backend", "Path", "Key", "Status", "Error")
+		for _, file := range reply.Files {
+			table.append(file.Backend, file.Path, file.Key, file.Status, file.Error)
+		}
+		err = printResult(c, reply, table)
+	}
+	if err != nil {
+		return err
+	}
+
+	if reply.Summary.Failed > 0 {
+		return cli.NewExitError("Some files failed to sync", exitProblems)
+	}
+	return nil
+}
+
+func printSyncFile(file shared.SyncFile, dryRun bool) {
+	status := file.Status
+	if dryRun && status == shared.SyncUploaded {
+		status = "would upload"
+	}
+	switch {
+	case file.Status == shared.SyncOrphaned:
+		fmt.Printf("%-12s %s %s\n", status, file.Backend, file.Key)
+	case file.Error != "":
+		fmt.Printf("%-12s %s %s: %s\n", status, file.Backend, file.Path, file.Error)
+	default:
+		fmt.Printf("%-12s %s %s\n", status, file.Backend, file.Path)
+	}
+}
+
+func pruneVersions(c *cli.Context) error {
+	log.Debugln("Pruning expired versions")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Prune(context.Background(), &shared.PruneArgs{DryRun: c.Bool("dry-run")})
+	if err != nil {
+		return daemonError(err)
+	}
+
+	table := newTable("Backend", "Key", "Version", "Modified", "Type")
+	for _, version := range reply.Versions {
+		versionType := "Version"
+		if version.DeleteMarker {
+			versionType = "Delete marker"
+		}
+		table.append(version.Backend, version.Key, version.VersionID, version.LastModified.Format(time.RFC3339), versionType)
+	}
+	if err = printResult(c, reply, table); err != nil {
+		return err
+	}
+
+	if reply.DryRun {
+		printMessage(c, "Would remove %d versions\n", len(reply.Versions))
+	} else {
+		printMessage(c, "Removed %d versions\n", len(reply.Versions))
+	}
+	return nil
+}
+
+func pipelineEvents(c *cli.Context) error {
+	log.Debugln("Retrieving pipeline events")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	format := c.GlobalString("output")
+	if c.Bool("json") {
+		format = outputJSON
+	}
+	// Events are streamed, so CSV only has a single header
+	var writer *csv.Writer
+	if format == outputCSV {
+		writer = csv.NewWriter(os.Stdout)
+		writer.Write([]string{"Seq", "Time", "Stage", "Path", "Backend", "Detail", "Duration", "Error"})
+		writer.Flush()
+	}
+
+	args := &shared.EventsArgs{}
+	for {
+		reply, err := client.Events(context.Background(), args)
+		if err != nil {
+			return daemonError(err)
+		}
+		if reply.Missed > 0 {
+			log.Warnf("Missed %d events\n", reply.Missed)
+		}
+		for _, event := range reply.Events {
+			if err = printEvent(event, format, writer); err != nil {
+				return err
+			}
+		}
+
+		if !c.Bool("follow") {
+			return nil
+		}
+		args.After = reply.Last
+		args.Wait = true
+	}
+}
+
+// printEvent - Print a single event, JSON is printed one event per line and YAML as a document per event
+func printEvent(event shared.PipelineEvent, format string, writer *csv.Writer) error {
+	switch format {
+	case outputJSON:
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(line))
+		return nil
+	case outputYAML:
+		fmt.Println("---")
+		return printYAML(event)
+	case outputCSV:
+		writer.Write([]string{
+			strconv.FormatUint(event.Seq, 10),
+			event.Time.Format(time.RFC3339Nano),
+			event.Stage,
+			event.Path,
+			event.Backend,
+			event.Detail,
+			event.Duration.String(),
+			event.Error,
+		})
+		writer.Flush()
+		return writer.Error()
+	}
+
+	line := fmt.Sprintf("%s %-11s %s", event.Time.Local().Format("15:04:05.000"), event.Stage, event.Path)
+	if event.Backend != "" {
+		line += " -> " + event.Backend
+	}
+	if event.Detail != "" {
+		line += " (" + event.Detail + ")"
+	}
+	if event.Duration > 0 {
+		line += " " + event.Duration.String()
+	}
+	if event.Error != "" {
+		line += ": " + event.Error
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func diffFile(c *cli.Context) error {
+	path, err := fileArgument(c)
+	if err != nil {
+		return err
+	}
+	log.Debugln("Diffing", path)
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	args := &shared.DiffArgs{
+		Path:        path,
+		FromVersion: c.String("version"),
+		ToVersion:   c.String("against"),
+	}
+	reply, err := client.Diff(context.Background(), args)
+	if err != nil {
+		return daemonError(err)
+	}
+
+	if humanOutput(c) {
+		if reply.Diff != "" {
+			fmt.Print(reply.Diff)
+		} else {
+			fmt.Println(reply.Summary)
+		}
+		return nil
+	}
+	table := newTable("From", "To", "Binary", "Changed", "Summary")
+	table.append(reply.From, reply.To, strconv.FormatBool(reply.Binary), strconv.FormatBool(reply.Changed), reply.Summary)
+	return printResult(c, reply, table)
+}
+
+func fileLog(c *cli.Context) error {
+	path, err := fileArgument(c)
+	if err != nil {
+		return err
+	}
+	log.Debugln("Retrieving history of", path)
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.Log(context.Background(), &shared.LogArgs{Path: path, Patch: c.Bool("patch"), Metadata: c.Bool("metadata")})
+	if err != nil {
+		return daemonError(err)
+	}
+
+	// Patches don't fit in a table, so print them one after another
+	if c.Bool("patch") && humanOutput(c) {
+		for _, version := range reply.Versions {
+			fmt.Printf("version %s (%s)\n", version.VersionID, versionType(version))
+			fmt.Printf("Date:    %s\n", version.LastModified.Format(time.RFC1123Z))
+			fmt.Printf("Host:    %s (%s)\n", version.Hostname, version.MachineID)
+			fmt.Printf("Watcher: %s\n", version.Watcher)
+			fmt.Printf("Event:   %s\n", version.Event)
+			fmt.Printf("Mtime:   %s\n", formatTime(version.ModTime))
+			fmt.Printf("Backer:  %s\n", version.BackerVersion)
+			fmt.Printf("Size:    %d\n", version.Size)
+			fmt.Printf("SHA256:  %s\n\n", version.Checksum)
+			fmt.Println(version.Patch)
+		}
+		return nil
+	}
+
+	table := newTable("Modified", "Version", "Type", "Size", "Checksum", "Host", "Event", "Backer")
+	for _, version := range reply.Versions {
+		table.append(
+			version.LastModified.Format(time.RFC3339),
+			version.VersionID,
+			versionType(version),
+			strconv.FormatInt(version.Size, 10),
+			displayChecksum(c, version.Checksum),
+			version.Hostname,
+			version.Event,
+			version.BackerVersion,
+		)
+	}
+	return printResult(c, reply, table)
+}
+
+func versionType(version shared.FileVersion) string {
+	if version.DeleteMarker {
+		return "Delete"
+	}
+	return "Upload"
+}
+
+// displayChecksum - Shorten checksums to fit in a table, scripts get all of it
+func displayChecksum(c *cli.Context, checksum string) string {
+	if humanOutput(c) && len(checksum) > 12 {
+		return checksum[:12]
+	}
+	return checksum
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func migrateKeys(c *cli.Context) error {
+	log.Debugln("Migrating object keys")
+	client, err := dialDaemon(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	args := &shared.MigrateArgs{
+		FromTemplate: c.String("from"),
+		DryRun:       c.Bool("dry-run"),
+	}
+	reply, err := client.MigrateKeys(context.Background(), args)
+	if err != nil {
+		return daemonError(err)
+	}
+
+	table := newTable("Backend", "From", "To", "Status")
+	moved, versions, failed := 0, 0, 0
+	for _, move := range reply.Moves {
+		status := "Not found"
+		switch {
+		case reply.DryRun:
+			status = "Pending"
+		case move.Error != "":
+			status = "Failed: " + move.Error
+			failed++
+		case move.Versions > 0:
+			status = fmt.Sprintf("Moved %d versions", move.Versions)
+			moved++
+		}
+		versions += move.Versions
+		table.append(move.Backend, move.From, move.To, status)
+	}
+	if err = printResult(c, reply, table); err != nil {
+		return err
+	}
+
+	if reply.DryRun {
+		printMessage(c, "Would move up to %d objects\n", len(reply.Moves))
+		return nil
+	}
+	printMessage(c, "Moved %d versions of %d objects\n", versions, moved)
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d objects were left under their previous keys, in part or in full", failed), exitProblems)
+	}
+	return nil
+}
+
+// configArgument - Returns the config file given on the command line, or the global --config
+func configArgument(c *cli.Context) string {
+	if c.NArg() > 0 {
+		return c.Args().First()
+	}
+	return c.GlobalString("config")
+}
+
+func validateConfig(c *cli.Context) error {
+	location := configArgument(c)
+	log.Debugln("Validating", location)
+	report := daemon.ValidateConfig(location)
+
+	table := newTable("Severity", "Field", "Problem")
+	for _, problem := range report.Problems {
+		severity := "Error"
+		if problem.Warning {
+			severity = "Warning"
+		}
+		table.append(severity, problem.Field, problem.Message)
+	}
+	if humanOutput(c) && len(report.Problems) == 0 {
+		fmt.Printf("%s is valid\n", location)
+	} else if err := printResult(c, report, table); err != nil {
+		return err
+	}
+
+	if !report.Valid {
+		return cli.NewExitError(location+" is invalid", exitProblems)
+	}
+	return nil
+}
+
+func showConfig(c *cli.Context) error {
+	location := configArgument(c)
+	config, err := daemon.ShowConfig(location)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitFailed)
+	}
+	table, err := flatten(config)
+	if err != nil {
+		return err
+	}
+	return printResult(c, config, table)
+}
+
+func checkBackends(c *cli.Context) error {
+	return printBackends(c, daemon.CheckBackends)
+}
+
+// applyBackends - Apply the bucket settings of the config, including object lock
+func applyBackends(c *cli.Context) error {
+	return printBackends(c, daemon.ApplyBackends)
+}
+
+// printBackends - Print the bucket settings of every backend, exiting non-zero if any of them don't match
+func printBackends(c *cli.Context, compare func(string) (*shared.BackendReport, error)) error {
+	location := configArgument(c)
+	report, err := compare(location)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitFailed)
+	}
+
+	table := newTable("Backend", "Bucket", "Setting", "Expected", "Actual", "Status")
+	for _, backend := range report.Backends {
+		if backend.Error != "" {
+			table.append(backend.Backend, backend.Bucket, "", "", backend.Error, "Error")
+		}
+		for _, setting := range backend.Settings {
+			status := "OK"
+			if !setting.InSync {
+				status = "Drift"
+			}
+			table.append(backend.Backend, backend.Bucket, setting.Setting, setting.Expected, setting.Actual, status)
+		}
+	}
+	if err = printResult(c, report, table); err != nil {
+		return err
+	}
+
+	if !report.InSync {
+		return cli.NewExitError("bucket settings don't match "+location, exitProblems)
+	}
 	return nil
 }
@@ -0,0 +1,408 @@
+package daemon
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// Start of each HTTP request method, used to tell HTTP clients apart from net/rpc ones on the control socket
+var httpMethods = []string{"GET ", "POST", "HEAD", "PUT ", "DELE", "OPTI", "PATC"}
+
+// apiMethods - RPC methods which may be called over HTTP
+var apiMethods = []string{
+	"Version",
+	"ListWatchers",
+	"Prune",
+	"Diff",
+	"Log",
+	"ListObjects",
+	"ListObjectVersions",
+	"MigrateKeys",
+	"Status",
+	"AddWatcher",
+	"RemoveWatcher",
+	"Reload",
+	"Sync",
+	"SyncProgress",
+	"Events",
+	"Pause",
+	"Resume",
+}
+
+// apiOperation - An RPC method exposed over HTTP
+type apiOperation struct {
+	method  reflect.Method
+	args    reflect.Type // Nil for operations without arguments
+	result  reflect.Type
+	pointer bool // Whether or not the method takes a pointer to its arguments
+}
+
+// apiServer - Serves the RPC methods as JSON over HTTP, to both the control socket and the optional TCP listener
+type apiServer struct {
+	state      *daemonState
+	server     *http.Server
+	operations map[string]*apiOperation
+	conns      *connListener
+}
+
+func newAPIServer(state *daemonState) *apiServer {
+	a := &apiServer{
+		state:      state,
+		operations: apiOperations(),
+		conns:      newConnListener(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+shared.APIVersion+"/", a.handle)
+	a.server = &http.Server{Handler: mux}
+	go a.server.Serve(a.conns)
+	return a
+}
+
+// listen - Serve the API on a loopback TCP address, clients which send the token get the configured access
+func (a *apiServer) listen(config *shared.APIConfig) error {
+	token, err := config.ReadToken()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	log.Println("API listening on", l.Addr())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Debugln("Stopped accepting API connections:", err)
+				return
+			}
+			a.state.RLock()
+			role := roleRead
+			if a.state.config.API.Access == "write" {
+				role = roleWrite
+			}
+			a.state.RUnlock()
+			a.conns.add(&roleConn{Conn: conn, reader: conn, role: role, token: token})
+		}
+	}()
+	return nil
+}
+
+// apiOperations - The RPC methods listed in apiMethods
+func apiOperations() map[string]*apiOperation {
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	rpcType := reflect.TypeOf(&RPC{})
+	operations := make(map[string]*apiOperation)
+	for _, name := range apiMethods {
+		method, ok := rpcType.MethodByName(name)
+		if !ok || method.Type.NumIn() != 3 || method.Type.NumOut() != 1 || method.Type.Out(0) != errorType {
+			panic(fmt.Sprintf("%s can't be served over HTTP", name))
+		}
+		args := method.Type.In(1)
+		reply := method.Type.In(2)
+		if reply.Kind() != reflect.Ptr {
+			panic(fmt.Sprintf("%s can't be served over HTTP", name))
+		}
+		operation := &apiOperation{
+			method: method,
+			result: reply.Elem(),
+		}
+		if args.Kind() == reflect.Ptr {
+			operation.args = args.Elem()
+			operation.pointer = true
+		}
+		operations[method.Name] = operation
+	}
+	return operations
+}
+
+func (a *apiServer) handle(w http.ResponseWriter, req *http.Request) {
+	if err := checkTCPRequest(req); err != nil {
+		writeJSON(w, http.StatusUnauthorized, &shared.APIError{Error: err.Error()})
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/"+shared.APIVersion+"/")
+	if name == "schema" {
+		writeJSON(w, http.StatusOK, a.schema())
+		return
+	}
+
+	operation, ok := a.operations[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, &shared.APIError{Error: "unknown operation " + name})
+		return
+	}
+	if req.Method != http.MethodPost && !(req.Method == http.MethodGet && operation.args == nil) {
+		w.Header().Set("Allow", strings.Join(operation.methods(), ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, &shared.APIError{Error: "method not allowed"})
+		return
+	}
+	// Browsers can send form posts to any address without asking first, but not JSON ones
+	if req.Method == http.MethodPost {
+		contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || contentType != "application/json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, &shared.APIError{Error: "arguments have to be sent as application/json"})
+			return
+		}
+	}
+
+	var role accessRole
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(*roleAddr); ok {
+		role = addr.role
+	}
+	a.state.RLock()
+	config := a.state.config
+	a.state.RUnlock()
+	r := &RPC{Config: config, state: a.state, role: role}
+
+	// Operations without arguments take an unused int, just like over net/rpc
+	args := reflect.ValueOf(0)
+	if operation.args != nil {
+		value := reflect.New(operation.args)
+		err := json.NewDecoder(req.Body).Decode(value.Interface())
+		if err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, &shared.APIError{Error: "invalid arguments: " + err.Error()})
+			return
+		}
+		args = value
+		if !operation.pointer {
+			args = value.Elem()
+		}
+	}
+
+	result := reflect.New(operation.result)
+	out := operation.method.Func.Call([]reflect.Value{reflect.ValueOf(r), args, result})
+	if err, _ := out[0].Interface().(error); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*permissionError); ok {
+			status = http.StatusForbidden
+		}
+		writeJSON(w, status, &shared.APIError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result.Interface())
+}
+
+// checkTCPRequest - Requests over TCP need the bearer token, and have to be addressed to this machine
+// Checking the host stops web pages from reaching the API by pointing their own domain at a loopback address
+func checkTCPRequest(req *http.Request) error {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(*roleAddr)
+	if !ok || addr.token == "" {
+		return nil
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !shared.IsLoopbackHost(host) {
+		return errors.New("requests have to be addressed to a loopback host, not " + req.Host)
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(addr.token)) != 1 {
+		return errors.New("missing or invalid bearer token")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Errorln("Unable to write API response:", err)
+	}
+}
+
+func (o *apiOperation) methods() []string {
+	if o.args == nil {
+		return []string{http.MethodGet, http.MethodPost}
+	}
+	return []string{http.MethodPost}
+}
+
+// schema - Describe each operation, along with its arguments and result
+func (a *apiServer) schema() *shared.APISchema {
+	schema := &shared.APISchema{Version: shared.APIVersion}
+	for name, operation := range a.operations {
+		described := shared.APIOperation{
+			Name:    name,
+			Path:    "/" + shared.APIVersion + "/" + name,
+			Methods: operation.methods(),
+			Result:  typeSchema(operation.result),
+		}
+		if operation.args != nil {
+			described.Args = typeSchema(operation.args)
+		}
+		schema.Operations = append(schema.Operations, described)
+	}
+	sort.Slice(schema.Operations, func(i, j int) bool {
+		return schema.Operations[i].Name < schema.Operations[j].Name
+	})
+	return schema
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// typeSchema - Describe how the type is encoded by encoding/json
+func typeSchema(t reflect.Type) *shared.TypeSchema {
+	switch t {
+	case timeType:
+		return &shared.TypeSchema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &shared.TypeSchema{Type: "integer", Description: "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return &shared.TypeSchema{Type: "boolean"}
+	case reflect.String:
+		return &shared.TypeSchema{Type: "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &shared.TypeSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &shared.TypeSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &shared.TypeSchema{Type: "array", Items: typeSchema(t.Elem())}
+	case reflect.Map:
+		return &shared.TypeSchema{Type: "object"}
+	case reflect.Struct:
+		schema := &shared.TypeSchema{Type: "object", Properties: make(map[string]*shared.TypeSchema)}
+		addProperties(schema, t)
+		return schema
+	}
+	return &shared.TypeSchema{Type: "object"}
+}
+
+// addProperties - Add the JSON fields of the struct, including those of embedded structs
+func addProperties(schema *shared.TypeSchema, t reflect.Type) {
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && fieldType.Kind() == reflect.Struct {
+			addProperties(schema, fieldType)
+			continue
+		}
+		if field.Type.Kind() == reflect.Interface {
+			continue
+		}
+		schema.Properties[name] = typeSchema(field.Type)
+	}
+}
+
+// isHTTP - Returns whether or not the connection starts with an HTTP request
+func isHTTP(reader *bufio.Reader) bool {
+	start, err := reader.Peek(4)
+	if err != nil {
+		return false
+	}
+	for _, method := range httpMethods {
+		if string(start) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// roleConn - Connection whose peer has already been authorized
+type roleConn struct {
+	net.Conn
+	reader io.Reader // Includes anything which was read while deciding how to serve the connection
+	role   accessRole
+	token  string // Bearer token requests have to send, TCP clients can't be identified any other way
+}
+
+func (c *roleConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// LocalAddr - The HTTP server hands this to every request on the connection, which is how handlers learn the role
+func (c *roleConn) LocalAddr() net.Addr {
+	return &roleAddr{Addr: c.Conn.LocalAddr(), role: c.role, token: c.token}
+}
+
+// roleAddr - Local address of a roleConn, carrying what its peer is allowed to do
+type roleAddr struct {
+	net.Addr
+	role  accessRole
+	token string
+}
+
+// connListener - Hands connections which were accepted elsewhere to the HTTP server
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) add(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "control", Net: "unix"}
+}
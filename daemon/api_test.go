@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI(t *testing.T) {
+	fm, dir := createFileManager(&MockBackend{})
+	defer os.RemoveAll(dir)
+	fm.RegisterWatcherPath(dir, "test-bucket")
+	state := &daemonState{
+		RWMutex: fm.configLock,
+		config:  fm.config,
+		manager: fm,
+	}
+	api := newAPIServer(state)
+	defer api.conns.Close()
+
+	call := func(role accessRole, method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &roleAddr{role: role}))
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		recorder := httptest.NewRecorder()
+		api.handle(recorder, req)
+		return recorder
+	}
+
+	resp := call(roleRead, "GET", "/v1/ListWatchers", "")
+	assert.Equal(t, http.StatusOK, resp.Code, "Should list watchers")
+	var watchers shared.FileWatchers
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &watchers), "Should return JSON")
+	assert.Equal(t, []string{dir}, watchers.Paths, "Should return the watcher")
+
+	resp = call(roleRead, "GET", "/v1/Pause", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code, "Operations with arguments need a POST")
+	resp = call(roleRead, "POST", "/v1/Pause", `{"Duration": 60000000000}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code, "Readers can't pause")
+	resp = call(roleWrite, "POST", "/v1/Pause", `{"Duration": 60000000000}`)
+	assert.Equal(t, http.StatusOK, resp.Code, "Writers can pause")
+	var status shared.PauseStatus
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &status), "Should return JSON")
+	assert.True(t, status.Paused, "Should pause")
+
+	resp = call(roleWrite, "POST", "/v1/Pause", `{"Duration": "soon"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code, "Should reject invalid arguments")
+	resp = call(roleRead, "GET", "/v1/Restore", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code, "Should reject unknown operations")
+	resp = call(roleWrite, "GET", "/v1/SayHello", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code, "Should only expose the listed operations")
+
+	// Form posts can be sent by any web page
+	req := httptest.NewRequest("POST", "/v1/Pause", strings.NewReader(`{"Duration": 60000000000}`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &roleAddr{role: roleWrite}))
+	resp = httptest.NewRecorder()
+	api.handle(resp, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.Code, "Should only accept JSON")
+
+	// TCP clients have to send the token, to a loopback host
+	tcp := func(host string, auth string) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/v1/ListWatchers", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &roleAddr{role: roleRead, token: "secret"}))
+		recorder := httptest.NewRecorder()
+		api.handle(recorder, req)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusOK, tcp("127.0.0.1:7117", "Bearer secret"), "Should accept the token")
+	assert.Equal(t, http.StatusOK, tcp("localhost:7117", "Bearer secret"), "Should accept localhost")
+	assert.Equal(t, http.StatusUnauthorized, tcp("127.0.0.1:7117", ""), "Should need the token")
+	assert.Equal(t, http.StatusUnauthorized, tcp("127.0.0.1:7117", "Bearer guess"), "Should reject the wrong token")
+	assert.Equal(t, http.StatusUnauthorized, tcp("evil.example.com:7117", "Bearer secret"), "Should reject other hosts")
+
+	// The schema covers every RPC method
+	resp = call(roleNone, "GET", "/v1/schema", "")
+	var schema shared.APISchema
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &schema), "Should return the schema")
+	assert.Equal(t, len(api.operations), len(schema.Operations), "Should describe every operation")
+	for _, operation := range schema.Operations {
+		if operation.Name == "Sync" {
+			assert.Equal(t, "boolean", operation.Args.Properties["DryRun"].Type, "Should describe the arguments")
+			assert.Equal(t, []string{"POST"}, operation.Methods, "Should require a body")
+		}
+		if operation.Name == "Log" {
+			versions := operation.Result.Properties["Versions"].Items
+			assert.Equal(t, "date-time", versions.Properties["LastModified"].Format, "Should describe times")
+			assert.Contains(t, versions.Properties, "Checksum", "Should flatten embedded structs")
+		}
+	}
+}
+
+func TestAPIOnControlSocket(t *testing.T) {
+	fm, dir := createFileManager(&MockBackend{})
+	defer os.RemoveAll(dir)
+	fm.config.Socket = shared.SocketConfig{Path: filepath.Join(dir, "backer.sock")}
+	state := &daemonState{
+		RWMutex: fm.configLock,
+		config:  fm.config,
+		manager: fm,
+	}
+	state.api = newAPIServer(state)
+	defer state.api.conns.Close()
+
+	l, err := getSocket(&fm.config.Socket)
+	assert.Nil(t, err, "Should listen on the socket")
+	defer l.Close()
+	go serveRPC(l, state)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", fm.config.Socket.Path)
+		},
+	}}
+	resp, err := client.Get("http://backer/v1/Status")
+	assert.Nil(t, err, "Should call the API over the socket")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Should return the status")
+	var report shared.StatusReport
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&report), "Should return JSON")
+	assert.Equal(t, "backlog", report.Queues[0].Name, "Should report the backlog")
+}
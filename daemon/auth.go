@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"os/user"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// accessRole - Which commands a client of the control socket may run
+type accessRole int
+
+const (
+	roleNone  accessRole = iota // May not run any commands
+	roleRead                    // May run commands which don't change anything
+	roleWrite                   // May run every command
+)
+
+func (r accessRole) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleWrite:
+		return "write"
+	}
+	return "none"
+}
+
+// Returned on platforms where the identity of the peer can't be determined
+var errPeerCredentialsUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// peer - Identity of the process on the other end of the control socket
+type peer struct {
+	uid uint32
+	gid uint32
+	pid int32
+}
+
+// authorize - Returns the role of the peer, under the given policy
+// Root, the daemon user and the owner of the socket may do everything, anyone else has to be listed in the policy
+func authorize(policy *shared.SocketConfig, p *peer) accessRole {
+	if p.uid == 0 || int(p.uid) == os.Getuid() {
+		return roleWrite
+	}
+
+	uid := strconv.FormatUint(uint64(p.uid), 10)
+	users := []string{uid}
+	gids := []string{strconv.FormatUint(uint64(p.gid), 10)}
+	if account, err := user.LookupId(uid); err == nil {
+		users = append(users, account.Username)
+		if groupIDs, err := account.GroupIds(); err == nil {
+			gids = append(gids, groupIDs...)
+		}
+	}
+	groups := append([]string(nil), gids...)
+	for _, gid := range gids {
+		if group, err := user.LookupGroupId(gid); err == nil {
+			groups = append(groups, group.Name)
+		}
+	}
+
+	if policy.Owner != "" && matchesAny([]string{policy.Owner}, users) {
+		return roleWrite
+	}
+	if matchesAny(policy.WriteUsers, users) || matchesAny(policy.WriteGroups, groups) {
+		return roleWrite
+	}
+	if matchesAny(policy.ReadUsers, users) || matchesAny(policy.ReadGroups, groups) {
+		return roleRead
+	}
+	return roleNone
+}
+
+// unidentifiedRole - Returns the role of peers which can't be identified, nobody unless the policy opts in
+// Anyone the socket permissions let in could be on the other end, so they're never allowed to change anything
+func unidentifiedRole(policy *shared.SocketConfig) accessRole {
+	if policy.AllowUnidentified == "read" {
+		return roleRead
+	}
+	return roleNone
+}
+
+func matchesAny(allowed []string, identities []string) bool {
+	for _, entry := range allowed {
+		for _, identity := range identities {
+			if entry == identity {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveRPC - Accept connections to the control socket, each one is served with the role of its peer
+func serveRPC(l net.Listener, state *daemonState) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Debugln("Stopped accepting connections:", err)
+			return
+		}
+		go serveConn(conn, state)
+	}
+}
+
+func serveConn(conn net.Conn, state *daemonState) {
+	state.RLock()
+	policy := state.config.Socket
+	state.RUnlock()
+
+	role := roleNone
+	p, err := peerCredentials(conn)
+	switch {
+	case err == errPeerCredentialsUnsupported:
+		role = unidentifiedRole(&policy)
+		if role == roleNone {
+			log.Warnln("Rejecting control socket connection, peers can't be identified on this platform unless socket.allowUnidentified is set")
+		}
+	case err != nil:
+		log.Errorln("Unable to identify control socket peer:", err)
+	default:
+		role = authorize(&policy, p)
+		log.Debugf("Control socket peer uid %d, pid %d has %s access\n", p.uid, p.pid, role)
+		if role == roleNone {
+			log.Warnf("Rejecting control socket connection from uid %d, pid %d\n", p.uid, p.pid)
+		}
+	}
+
+	if role == roleNone {
+		conn.Close()
+		return
+	}
+	serveAuthorized(conn, role, state)
+}
+
+// serveAuthorized - Serve either net/rpc or the HTTP API to a peer which has been given the role
+func serveAuthorized(conn net.Conn, role accessRole, state *daemonState) {
+	state.RLock()
+	config := state.config
+	state.RUnlock()
+
+	// The same socket serves both net/rpc and the HTTP API
+	reader := bufio.NewReader(conn)
+	wrapped := &roleConn{Conn: conn, reader: reader, role: role}
+	if state.api != nil && isHTTP(reader) {
+		state.api.conns.add(wrapped)
+		return
+	}
+
+	server := rpc.NewServer()
+	server.RegisterName("RPC", &RPC{
+		Config: config,
+		state:  state,
+		role:   role,
+	})
+	server.ServeConn(wrapped)
+}
+
+// permissionError - Returned when the peer isn't allowed to run a command
+type permissionError struct {
+	required accessRole
+}
+
+func (e *permissionError) Error() string {
+	return "permission denied, this command requires " + e.required.String() + " access"
+}
+
+// authorize - Ensure that the peer is allowed to run a command which requires the given role
+func (r *RPC) authorize(required accessRole) error {
+	if r.role < required {
+		return &permissionError{required: required}
+	}
+	return nil
+}
+
+// mutating - Returns the role required by commands which only change things when they aren't a dry run
+func mutating(dryRun bool) accessRole {
+	if dryRun {
+		return roleRead
+	}
+	return roleWrite
+}
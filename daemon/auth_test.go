@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	stranger := &peer{uid: 4242, gid: 4343}
+	policy := &shared.SocketConfig{}
+	assert.Equal(t, roleWrite, authorize(policy, &peer{uid: 0}), "Root can do everything")
+	assert.Equal(t, roleWrite, authorize(policy, &peer{uid: uint32(os.Getuid())}), "The daemon user can do everything")
+	assert.Equal(t, roleNone, authorize(policy, stranger), "Nobody else can do anything without a policy")
+	assert.Equal(t, roleWrite, authorize(&shared.SocketConfig{Owner: "4242"}, stranger), "The socket owner can do everything")
+
+	policy.ReadUsers = []string{"1000"}
+	assert.Equal(t, roleNone, authorize(policy, stranger), "Should reject users outside of the policy")
+	policy.ReadGroups = []string{"4343"}
+	assert.Equal(t, roleRead, authorize(policy, stranger), "Should allow members of read groups")
+	policy.WriteUsers = []string{"4242"}
+	assert.Equal(t, roleWrite, authorize(policy, stranger), "Should allow write users")
+
+	// Peers which can't be identified are turned away, unless the policy lets them read
+	assert.Equal(t, roleNone, unidentifiedRole(&shared.SocketConfig{}), "Should reject unidentified peers by default")
+	assert.Equal(t, roleRead, unidentifiedRole(&shared.SocketConfig{AllowUnidentified: "read"}), "Should allow reads when opted in")
+	assert.NotNil(t, (&shared.SocketConfig{AllowUnidentified: "write"}).Validate(), "Unidentified peers can't be given write access")
+
+	// Mutating commands need write access, unless they're a dry run
+	r := &RPC{role: roleRead}
+	assert.NotNil(t, r.Pause(&shared.PauseArgs{}, &shared.PauseStatus{}), "Readers can't pause uploads")
+	assert.NotNil(t, r.Prune(&shared.PruneArgs{}, &shared.PruneResult{}), "Readers can't prune")
+	assert.Nil(t, r.authorize(mutating(true)), "Readers can do dry runs")
+}
+
+func TestControlSocket(t *testing.T) {
+	fm, dir := createFileManager(&MockBackend{})
+	defer os.RemoveAll(dir)
+	fm.RegisterWatcherPath(dir, "test-bucket")
+
+	fm.config.Socket = shared.SocketConfig{
+		Path: filepath.Join(dir, "run", "backer.sock"),
+		Mode: "0600",
+	}
+	l, err := getSocket(&fm.config.Socket)
+	assert.Nil(t, err, "Should listen on the socket")
+	defer l.Close()
+
+	info, err := os.Stat(fm.config.Socket.Path)
+	assert.Nil(t, err, "Should create the socket")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Should apply the socket mode")
+
+	state := &daemonState{
+		RWMutex: fm.configLock,
+		config:  fm.config,
+		manager: fm,
+	}
+	go serveRPC(l, state)
+
+	// We're the same user as the daemon, so everything is allowed
+	conn, err := net.Dial("unix", fm.config.Socket.Path)
+	assert.Nil(t, err, "Should connect")
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var status = &shared.PauseStatus{}
+	err = client.Call("RPC.Pause", &shared.PauseArgs{}, &status)
+	assert.Nil(t, err, "Should be allowed to pause")
+	assert.True(t, status.Paused, "Should pause uploads")
+
+	var watchers = &shared.FileWatchers{}
+	err = client.Call("RPC.ListWatchers", 0, &watchers)
+	assert.Nil(t, err, "Should list watchers")
+	assert.Equal(t, []string{dir}, watchers.Paths, "Should return the watcher")
+}
@@ -1,6 +1,10 @@
 package daemon
 
-import log "github.com/sirupsen/logrus"
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
 
 // Borrowed heavily from: github.com/cespare/reflex
 
@@ -9,13 +13,15 @@ type Backlog interface {
 	Add(path BackerEvent)
 	Next() BackerEvent
 	RemoveOne() (empty bool)
+	Len() int
 }
 
 // MultiFileBacklog - data structure for maintaining Backlog state
 type MultiFileBacklog struct {
+	sync.Mutex
 	empty bool
 	next  BackerEvent
-	rest  map[BackerEvent]struct{}
+	rest  map[string]BackerEvent
 }
 
 // NewMultiFileBacklog - Creates a new Backlog
@@ -23,12 +29,14 @@ func NewMultiFileBacklog() *MultiFileBacklog {
 	return &MultiFileBacklog{
 		empty: true,
 		next:  BackerEvent{},
-		rest:  make(map[BackerEvent]struct{}),
+		rest:  make(map[string]BackerEvent),
 	}
 }
 
 // Add - Add a file event to the backlog
 func (b *MultiFileBacklog) Add(event BackerEvent) {
+	b.Lock()
+	defer b.Unlock()
 	defer func() {
 		b.empty = false
 	}()
@@ -37,13 +45,27 @@ func (b *MultiFileBacklog) Add(event BackerEvent) {
 		return
 	}
 	if b.next.equals(event) {
+		b.next = mergeEvents(b.next, event)
 		return
 	}
-	b.rest[event] = struct{}{}
+	if existing, ok := b.rest[event.Path]; ok {
+		event = mergeEvents(existing, event)
+	}
+	b.rest[event.Path] = event
+}
+
+// mergeEvents - Combine two events for the same file, a file which is created and then written is still a creation
+func mergeEvents(existing BackerEvent, event BackerEvent) BackerEvent {
+	if existing.Type == CREATE && event.Type == WRITE {
+		return existing
+	}
+	return event
 }
 
 // Next - retrieves the next BackerEvent from the Backlog
 func (b *MultiFileBacklog) Next() BackerEvent {
+	b.Lock()
+	defer b.Unlock()
 	if b.empty {
 		log.Fatalln("Empty backlog, can't get next")
 	}
@@ -52,6 +74,8 @@ func (b *MultiFileBacklog) Next() BackerEvent {
 
 // RemoveOne - Removes a single BackerEvent from the Backlog
 func (b *MultiFileBacklog) RemoveOne() bool {
+	b.Lock()
+	defer b.Unlock()
 	if b.empty {
 		log.Fatalln("Empty backlog, can't remove")
 	}
@@ -60,10 +84,20 @@ func (b *MultiFileBacklog) RemoveOne() bool {
 		b.empty = true
 		return true
 	}
-	for next := range b.rest {
+	for _, next := range b.rest {
 		b.next = next
 		break
 	}
-	delete(b.rest, b.next)
+	delete(b.rest, b.next.Path)
 	return false
 }
+
+// Len - Returns the number of events waiting in the Backlog
+func (b *MultiFileBacklog) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	if b.empty {
+		return 0
+	}
+	return len(b.rest) + 1
+}
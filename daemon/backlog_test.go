@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklogMergesEvents(t *testing.T) {
+	backlog := NewMultiFileBacklog()
+	assert.Equal(t, 0, backlog.Len(), "Should start empty")
+
+	backlog.Add(BackerEvent{Type: CREATE, Path: "/etc/hosts"})
+	backlog.Add(BackerEvent{Type: WRITE, Path: "/etc/hosts"})
+	backlog.Add(BackerEvent{Type: CREATE, Path: "/etc/resolv.conf"})
+	backlog.Add(BackerEvent{Type: WRITE, Path: "/etc/resolv.conf"})
+	backlog.Add(BackerEvent{Type: WRITE, Path: "/etc/fstab"})
+	backlog.Add(BackerEvent{Type: REMOVE, Path: "/etc/fstab"})
+	assert.Equal(t, 3, backlog.Len(), "Should keep one event per file")
+
+	events := make(map[string]Event)
+	for {
+		event := backlog.Next()
+		events[event.Path] = event.Type
+		if backlog.RemoveOne() {
+			break
+		}
+	}
+	assert.Equal(t, map[string]Event{
+		"/etc/hosts":       CREATE,
+		"/etc/resolv.conf": CREATE,
+		"/etc/fstab":       REMOVE,
+	}, events, "A created file which is written is still created, later events win otherwise")
+	assert.Equal(t, 0, backlog.Len(), "Should be empty")
+}
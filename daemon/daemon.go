@@ -1,9 +1,6 @@
 package daemon
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"net/rpc"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,8 +10,6 @@ import (
 
 	systemd "github.com/coreos/go-systemd/daemon"
 	"github.com/fsnotify/fsnotify"
-	"github.com/nickrobison/backer/backends"
-	"github.com/nickrobison/backer/shared"
 )
 
 // var logger *log.Logger
@@ -25,26 +20,15 @@ import (
 
 // Start backer daemon
 // Registers an S3 uploader and a fileManager to watch the watchers
-func Start(configLocation string) {
+func Start(configLocation string, version string) {
 	log.Println("Starting up Backer daemon")
 
-	// Read in the config file
-	file, err := ioutil.ReadFile(configLocation)
-	if err != nil {
-		log.Fatalln("Cannot read config file:", configLocation)
-	}
-
-	var config shared.BackerConfig
-	err = json.Unmarshal(file, &config)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	// Validate the paths
-	err = config.ValidateWatcherPaths()
+	config, err := loadConfig(configLocation)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	pruneInterval, _ := config.GetPruneInterval()
+	reconcileInterval, _ := config.GetReconcileInterval()
 
 	// Register the shutdown handler
 	done := make(chan bool)
@@ -57,15 +41,14 @@ func Start(configLocation string) {
 	}
 	defer watcher.Close()
 
-	// Create new uploader
-	var clients []backends.Uploader
-
-	s3Client := backends.NewS3Uploader(&config.S3)
-	clients = append(clients, s3Client)
-	config.Backends = clients
+	// Create the backends, and check they can be used
+	config.Backends, err = buildBackends(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Register new file manager
-	fm := NewFileManager(&config)
+	fm := NewFileManager(config, version)
 
 	// Register all watchers
 	for _, newWatcher := range config.Watchers {
@@ -81,19 +64,48 @@ func Start(configLocation string) {
 	}
 	fm.Start(watcher.Events, watcher.Errors)
 
+	state := &daemonState{
+		RWMutex:        fm.configLock,
+		configLocation: configLocation,
+		config:         config,
+		manager:        fm,
+		watcher:        watcher,
+	}
+
+	// Enforce the retention policies, if we're configured to do so
+	if pruneInterval > 0 {
+		state.startPrune(pruneInterval)
+	}
+	// Catch any changes missed by the watchers
+	if reconcileInterval > 0 {
+		state.startReconcile(reconcileInterval)
+	}
+	go handleReload(state)
+
 	// Start listener
-	l, err := getSocket()
+	l, err := getSocket(&config.Socket)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer l.Close()
 
-	cliRPC := &RPC{
-		Config: &config,
+	state.api = newAPIServer(state)
+	if config.API.Listen != "" {
+		err = state.api.listen(&config.API)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	go serveRPC(l, state)
+
+	// Allow other machines to manage the daemon, if we're configured to do so
+	if config.Remote.Listen != "" {
+		remote, err := listenRemote(&config.Remote, state)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer remote.Close()
 	}
-	server := rpc.NewServer()
-	server.RegisterName("RPC", cliRPC)
-	go server.Accept(l)
 
 	// go startSocket(&config)
 	log.Debugln("Ready to listen")
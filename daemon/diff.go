@@ -0,0 +1,133 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Number of bytes to inspect when deciding whether or not a file is binary
+const binarySniffLength = 8000
+
+// diffFile - Compare a file against one of its stored versions, or two stored versions against each other
+func diffFile(config *shared.BackerConfig, args *shared.DiffArgs) (*shared.DiffResult, error) {
+	key, err := config.ObjectKey(args.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := getVersionReader(config)
+	if err != nil {
+		return nil, err
+	}
+
+	fromLabel := versionLabel(args.Path, args.FromVersion)
+	from, err := readVersion(reader, key, args.FromVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare against the local file, unless we've been given a second version
+	var to []byte
+	var toLabel string
+	if args.ToVersion == "" {
+		toLabel = args.Path
+		to, err = ioutil.ReadFile(args.Path)
+	} else {
+		toLabel = versionLabel(args.Path, args.ToVersion)
+		to, err = readVersion(reader, key, args.ToVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buildDiff(fromLabel, from, toLabel, to)
+}
+
+// buildDiff - Create a unified diff for text files, or a summary for binary ones
+func buildDiff(fromLabel string, from []byte, toLabel string, to []byte) (*shared.DiffResult, error) {
+	result := &shared.DiffResult{
+		From:    fromLabel,
+		To:      toLabel,
+		Binary:  isBinary(from) || isBinary(to),
+		Changed: !bytes.Equal(from, to),
+	}
+
+	if !result.Changed {
+		result.Summary = fmt.Sprintf("%s and %s are identical", fromLabel, toLabel)
+		return result, nil
+	}
+
+	if result.Binary {
+		result.Summary = fmt.Sprintf("Binary files differ: %s (%s) and %s (%s)", fromLabel, describeContent(from), toLabel, describeContent(to))
+		return result, nil
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(from)),
+		B:        difflib.SplitLines(string(to)),
+		FromFile: fromLabel,
+		ToFile:   toLabel,
+		Context:  3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Diff = diff
+	result.Summary = fmt.Sprintf("%s and %s differ", fromLabel, toLabel)
+	return result, nil
+}
+
+// getVersionReader - Returns the first backend which is able to retrieve stored versions
+func getVersionReader(config *shared.BackerConfig) (backends.VersionReader, error) {
+	for _, backend := range config.Backends {
+		if reader, ok := backend.(backends.VersionReader); ok {
+			return reader, nil
+		}
+	}
+	return nil, errors.New("no backend is able to retrieve stored versions")
+}
+
+func readVersion(reader backends.VersionReader, key string, versionID string) ([]byte, error) {
+	log.Debugf("Retrieving version '%s' of %s\n", versionID, key)
+	body, err := reader.GetVersion(key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func versionLabel(name string, versionID string) string {
+	if versionID == "" {
+		return name + "@latest"
+	}
+	return name + "@" + versionID
+}
+
+// isBinary - Simple heuristic, binary files contain NUL bytes or invalid UTF-8
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLength {
+		data = data[:binarySniffLength]
+		// Don't count a multi-byte character split by the cutoff as invalid
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	return bytes.IndexByte(data, 0) != -1 || !utf8.Valid(data)
+}
+
+func describeContent(data []byte) string {
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%d bytes, sha256 %s", len(data), hex.EncodeToString(hash[:]))
+}
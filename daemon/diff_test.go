@@ -0,0 +1,40 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextDiff(t *testing.T) {
+	from := []byte("server {\n\tlisten 80;\n}\n")
+	to := []byte("server {\n\tlisten 443;\n}\n")
+
+	result, err := buildDiff("nginx.conf@latest", from, "nginx.conf", to)
+	assert.Nil(t, err, "Should be able to diff")
+	assert.True(t, result.Changed, "Should have changed")
+	assert.False(t, result.Binary, "Should not be binary")
+	assert.True(t, strings.Contains(result.Diff, "-\tlisten 80;"), "Should remove the old line")
+	assert.True(t, strings.Contains(result.Diff, "+\tlisten 443;"), "Should add the new line")
+
+	result, err = buildDiff("nginx.conf@latest", from, "nginx.conf", from)
+	assert.Nil(t, err, "Should be able to diff")
+	assert.False(t, result.Changed, "Should be identical")
+	assert.Empty(t, result.Diff, "Should not have a diff")
+}
+
+func TestBinaryDiff(t *testing.T) {
+	from := []byte{0x00, 0x01, 0x02}
+	to := []byte("Plain text")
+
+	result, err := buildDiff("blob@v1", from, "blob", to)
+	assert.Nil(t, err, "Should be able to diff")
+	assert.True(t, result.Binary, "Should be binary")
+	assert.Empty(t, result.Diff, "Should not dump binary data")
+	assert.True(t, strings.HasPrefix(result.Summary, "Binary files differ"), "Should summarise the files")
+
+	// Multi-byte characters split by the cutoff are still text
+	text := []byte("a" + strings.Repeat("é", binarySniffLength))
+	assert.False(t, isBinary(text), "Should not be binary")
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// Number of pipeline events kept for `backer events`
+const eventHistory = 1000
+
+// eventLog - Bounded history of pipeline events, the oldest are dropped once it's full
+type eventLog struct {
+	sync.Mutex
+	events []shared.PipelineEvent
+	start  int           // Index of the oldest event
+	count  int           // Number of events stored
+	last   uint64        // Sequence number of the latest event
+	notify chan struct{} // Closed when a new event arrives
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		events: make([]shared.PipelineEvent, size),
+		notify: make(chan struct{}),
+	}
+}
+
+// record - Add an event to the history, and wake up anyone waiting for it
+func (e *eventLog) record(event shared.PipelineEvent) {
+	e.Lock()
+	defer e.Unlock()
+	e.last++
+	event.Seq = e.last
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if e.count < len(e.events) {
+		e.events[(e.start+e.count)%len(e.events)] = event
+		e.count++
+	} else {
+		e.events[e.start] = event
+		e.start = (e.start + 1) % len(e.events)
+	}
+
+	close(e.notify)
+	e.notify = make(chan struct{})
+}
+
+// since - Returns the stored events after the given sequence number
+// Along with a channel which is closed when the next event arrives
+func (e *eventLog) since(after uint64) (*shared.EventBatch, <-chan struct{}) {
+	e.Lock()
+	defer e.Unlock()
+
+	batch := &shared.EventBatch{Last: e.last}
+	oldest := e.last - uint64(e.count) + 1
+	if after+1 < oldest {
+		if after > 0 {
+			batch.Missed = oldest - after - 1
+		}
+		after = oldest - 1
+	}
+	for seq := after + 1; seq <= e.last; seq++ {
+		batch.Events = append(batch.Events, e.events[(e.start+int(seq-oldest))%len(e.events)])
+	}
+	return batch, e.notify
+}
+
+// wait - Returns the events after the given sequence number, waiting up to timeout for one to arrive
+func (e *eventLog) wait(after uint64, timeout time.Duration) *shared.EventBatch {
+	batch, notify := e.since(after)
+	if len(batch.Events) > 0 {
+		return batch
+	}
+	select {
+	case <-notify:
+		batch, _ = e.since(after)
+	case <-time.After(timeout):
+	}
+	return batch
+}
+
+// recordResult - Record the outcome of an operation, which started at the given time
+func (f *FileManager) recordResult(stage string, path string, backend string, started time.Time, err error) {
+	event := shared.PipelineEvent{
+		Stage:    stage,
+		Path:     path,
+		Backend:  backend,
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		event.Stage = shared.EventFailed
+		event.Detail = stage
+		event.Error = err.Error()
+	}
+	f.events.record(event)
+}
@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLog(t *testing.T) {
+	events := newEventLog(3)
+	batch, _ := events.since(0)
+	assert.Len(t, batch.Events, 0, "Should start empty")
+
+	for _, path := range []string{"a", "b", "c", "d"} {
+		events.record(shared.PipelineEvent{Stage: shared.EventReceived, Path: path})
+	}
+
+	// The oldest event has been dropped
+	batch, _ = events.since(0)
+	assert.Equal(t, uint64(4), batch.Last, "Should number every event")
+	assert.Len(t, batch.Events, 3, "Should only keep the history size")
+	assert.Equal(t, "b", batch.Events[0].Path, "Should drop the oldest event")
+	assert.Equal(t, uint64(0), batch.Missed, "Fetching the history doesn't miss anything")
+
+	batch, _ = events.since(3)
+	assert.Len(t, batch.Events, 1, "Should only return newer events")
+	assert.Equal(t, "d", batch.Events[0].Path, "Should return the latest event")
+	assert.False(t, batch.Events[0].Time.IsZero(), "Should timestamp the event")
+
+	// Followers are woken up by new events
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		events.record(shared.PipelineEvent{Stage: shared.EventBatched, Path: "e"})
+	}()
+	batch = events.wait(4, time.Second)
+	assert.Len(t, batch.Events, 1, "Should wait for the next event")
+	assert.Equal(t, "e", batch.Events[0].Path, "Should return the new event")
+
+	batch = events.wait(5, time.Millisecond)
+	assert.Len(t, batch.Events, 0, "Should give up waiting")
+
+	// Event 2 has now fallen out of the history
+	batch, _ = events.since(1)
+	assert.Equal(t, uint64(1), batch.Missed, "Should report events which fell out of the history")
+	assert.Equal(t, "c", batch.Events[0].Path, "Should start at the oldest event")
+}
@@ -3,6 +3,7 @@ package daemon
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -29,8 +30,24 @@ const (
 	REMOVE
 	// WRITE - File is modified
 	WRITE
+	// SYNC - File is synchronized with the backends
+	SYNC
 )
 
+func (e Event) String() string {
+	switch e {
+	case CREATE:
+		return "create"
+	case REMOVE:
+		return "remove"
+	case WRITE:
+		return "write"
+	case SYNC:
+		return "sync"
+	}
+	return "unknown"
+}
+
 // BackerEvent - Event structure which contains a filepath and an event type
 type BackerEvent struct {
 	Type Event
@@ -48,84 +65,50 @@ func (b *BackerEvent) equals(other BackerEvent) bool {
 // FileManager - Manages the interaction between FSNotify events and the various data backends
 type FileManager struct {
 	config       *shared.BackerConfig
+	configLock   *sync.RWMutex // Guards the config, which is replaced when it is reloaded
 	backlog      Backlog
 	uploaders    *[]backends.Uploader
 	watcherRoots map[string]string
+	rootsLock    sync.RWMutex
+	hostname     string
+	machineID    string
+	version      string
+	status       *statusTracker
+	events       *eventLog
+	pause        pauseState
 }
 
 // NewFileManager - Helper function for creating a new FileManager
-func NewFileManager(config *shared.BackerConfig) *FileManager {
+func NewFileManager(config *shared.BackerConfig, version string) *FileManager {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnln("Unable to determine hostname:", err)
+	}
 	return &FileManager{
 		config:       config,
+		configLock:   &sync.RWMutex{},
 		backlog:      NewMultiFileBacklog(),
 		uploaders:    &config.Backends,
 		watcherRoots: make(map[string]string),
+		hostname:     hostname,
+		machineID:    shared.GetMachineID(),
+		version:      version,
+		status:       newStatusTracker(),
+		events:       newEventLog(eventHistory),
 	}
 }
 
-func (f *FileManager) syncFiles(root string, remotePath string) {
+func (f *FileManager) syncFiles(root string, watcher string) {
 	// If root is a directory, list all the files and check each one individually
-	var files []string
-	dir, err := isDir(root)
+	files, err := listFiles(root)
 	if err != nil {
-		log.Fatalln(err)
-	}
-
-	// If we're a dir, get all the files in the directory
-	if dir {
-		fls, err := ioutil.ReadDir(root)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		files = make([]string, len(fls))
-		for idx, file := range fls {
-			files[idx] = filepath.Join(root, file.Name())
-		}
-	} else {
-		files = []string{root}
+		log.Errorln(err)
+		f.status.recordFile(root, err)
+		return
 	}
 
-	var filesWg sync.WaitGroup
-	filesWg.Add(len(files))
-
-	// For each file, check that the backends all have the latest copy, or send the new one along
-	for _, file := range files {
-		func(file string, filesWg *sync.WaitGroup) {
-			defer filesWg.Done()
-			var wg sync.WaitGroup
-			wg.Add(len(*f.uploaders))
-
-			// Create the writer and checksum array
-			writers := make([]io.Writer, len(*f.uploaders))
-
-			// Do the checksum
-			checksum, err := f.checksumFile(file)
-			if err != nil {
-				log.Fatalln(err)
-			}
-
-			for idx, backend := range *f.uploaders {
-				br, bw := io.Pipe()
-				writers[idx] = bw
-				go func(file string, remotePath string, backend backends.Uploader) {
-					defer wg.Done()
-					fileInSync, err := backend.FileInSync(file, remotePath, br, checksum)
-					if err != nil {
-						log.Fatalln(err)
-					}
-					if !fileInSync {
-						log.Debugf("Updated file %s on backend %s\n", file, backend.GetName())
-					}
-				}(file, remotePath, backend)
-			}
-
-			go f.processFile(&writers, file)
-
-			wg.Wait()
-			log.Debugf("Finished syncing %s to backends\n", file)
-		}(file, &filesWg)
-	}
-	filesWg.Wait()
+	// Orphaned objects are left to reconciliation, which knows about the other watchers
+	f.reconcile(syncTarget{root: root, watcher: watcher, files: files}, false, logSyncResult)
 	log.Println("Sync has finished")
 }
 
@@ -134,7 +117,7 @@ func (f *FileManager) Start(eventChannel <-chan fsnotify.Event, errorChannel <-c
 	// Before starting everything, check to ensure that our initial state is up to date, if that's what we're configured to do
 	if f.config.SyncOnStartup {
 		log.Debugln("Synchronizing file roots with backend")
-		for path, remote := range f.watcherRoots {
+		for path, remote := range f.roots() {
 			f.syncFiles(path, remote)
 		}
 	}
@@ -149,6 +132,8 @@ func (f *FileManager) Start(eventChannel <-chan fsnotify.Event, errorChannel <-c
 
 // RegisterWatcherPath - Register a file path with the Manager, will subscribe to FSEvents for this path
 func (f *FileManager) RegisterWatcherPath(path string, remoteRoot string) {
+	f.rootsLock.Lock()
+	defer f.rootsLock.Unlock()
 	if _, ok := f.watcherRoots[path]; ok {
 		log.Warnf("Path %s already registered with watcher\n", path)
 		return
@@ -156,34 +141,65 @@ func (f *FileManager) RegisterWatcherPath(path string, remoteRoot string) {
 	f.watcherRoots[path] = remoteRoot
 }
 
+// UnregisterWatcherPath - Stop handling events for a previously registered path
+func (f *FileManager) UnregisterWatcherPath(path string) {
+	f.rootsLock.Lock()
+	defer f.rootsLock.Unlock()
+	delete(f.watcherRoots, path)
+}
+
+// roots - Returns a copy of the registered watcher paths, and their bucket paths
+func (f *FileManager) roots() map[string]string {
+	f.rootsLock.RLock()
+	defer f.rootsLock.RUnlock()
+	roots := make(map[string]string, len(f.watcherRoots))
+	for path, remote := range f.watcherRoots {
+		roots[path] = remote
+	}
+	return roots
+}
+
 func (f *FileManager) handleFileEvents(config *shared.BackerConfig, eventChannel <-chan fsnotify.Event, errorChannel <-chan error, outputChannel chan<- BackerEvent) {
 	log.Debugln("Launching new file handler")
 	for {
 		select {
 		case event := <-eventChannel:
 			{
+				f.events.record(shared.PipelineEvent{Stage: shared.EventReceived, Path: event.Name, Detail: event.Op.String()})
 				if event.Op&chmodMask == 0 {
+					f.events.record(shared.PipelineEvent{Stage: shared.EventFiltered, Path: event.Name, Detail: "permissions only"})
 					continue
 				}
 				log.Debugf("Has event: %v\n", event)
 				if event.Op == fsnotify.Remove {
-					if f.config.DeleteOnRemove {
+					if f.deleteOnRemove() {
 						outputChannel <- BackerEvent{
 							Type: REMOVE,
 							Path: event.Name,
 						}
 						continue
 					}
+					f.events.record(shared.PipelineEvent{Stage: shared.EventFiltered, Path: event.Name, Detail: "deleteOnRemove is disabled"})
 					log.Debugf("Removed file %s, continuing\n", event.Name)
 					continue
 				}
+				eventType := WRITE
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					eventType = CREATE
+				}
 				outputChannel <- BackerEvent{
-					Type: CREATE,
+					Type: eventType,
 					Path: event.Name,
 				}
 			}
 		case err := <-errorChannel:
 			{
+				// The kernel queue filled up, so some changes were missed
+				if err == fsnotify.ErrEventOverflow {
+					log.Warnln("File events were dropped, they will be picked up by the next reconciliation")
+					f.status.recordOverflow()
+					continue
+				}
 				// When the application shutsdown
 				if err != nil {
 					log.Fatalln(err)
@@ -205,10 +221,22 @@ func (f *FileManager) batch(in <-chan BackerEvent, out chan<- BackerEvent) {
 				f.backlog.Add(event)
 			case <-timer.C:
 				for {
+					// While paused, keep coalescing events until we're resumed
+					output := out
+					var next BackerEvent
+					paused, _, resumed := f.pause.state()
+					if paused {
+						output = nil
+					} else {
+						resumed = nil
+						next = f.backlog.Next()
+					}
 					select {
 					case event := <-in:
 						f.backlog.Add(event)
-					case out <- f.backlog.Next():
+					case <-resumed:
+						log.Debugf("Flushing %d queued events\n", f.backlog.Len())
+					case output <- next:
 						if f.backlog.RemoveOne() {
 							break outer
 						}
@@ -221,10 +249,29 @@ func (f *FileManager) batch(in <-chan BackerEvent, out chan<- BackerEvent) {
 
 func (f *FileManager) handleFile(in <-chan BackerEvent) {
 	for event := range in {
+		f.events.record(shared.PipelineEvent{Stage: shared.EventBatched, Path: event.Path, Detail: event.Type.String()})
 		if event.Type == REMOVE {
-			log.Debugf("Removing %s from %s\n", event.Path, f.watcherRoots[event.Path])
-			uploaderRef := *f.uploaders
-			go uploaderRef[0].DeleteFile(event.Path, f.watcherRoots[event.Path])
+			key, _, err := f.objectKey(event.Path)
+			if err == errUnwatched {
+				log.Debugf("Dropping removal of %s, it's no longer watched\n", event.Path)
+				continue
+			}
+			if err != nil {
+				log.Errorln(err)
+				continue
+			}
+			root, _, _ := f.watcherFor(event.Path)
+			log.Debugf("Removing %s from %s\n", event.Path, key)
+			for _, uploader := range f.uploaderList() {
+				go func(u backends.Uploader, path string) {
+					started := time.Now()
+					f.status.startTransfer(u.GetName())
+					err := u.DeleteFile(path, key)
+					f.status.finishTransfer(u.GetName(), 0, err)
+					f.recordResult(shared.EventDeleted, path, u.GetName(), started, err)
+					f.status.recordFile(root, err)
+				}(uploader, event.Path)
+			}
 		} else {
 			f.handleFileUpload(&event)
 		}
@@ -233,38 +280,160 @@ func (f *FileManager) handleFile(in <-chan BackerEvent) {
 
 func (f *FileManager) handleFileUpload(event *BackerEvent) {
 	// Create a wait group to synchronize all the backends and the checksum goroutine
+	uploaders := f.uploaderList()
 	var wg sync.WaitGroup
-	wg.Add(len(*f.uploaders))
+	wg.Add(len(uploaders))
 
-	uploaderRef := f.uploaders
-	var pipeWriters = make([]io.Writer, len(*uploaderRef))
+	var pipeWriters = make([]*io.PipeWriter, len(uploaders))
 
-	watcherPath := f.watcherRoots[event.Path]
+	root, _, _ := f.watcherFor(event.Path)
+	key, watcher, err := f.objectKey(event.Path)
+	if err == errUnwatched {
+		log.Debugf("Dropping upload of %s, it's no longer watched\n", event.Path)
+		return
+	}
+	if err != nil {
+		log.Errorln(err)
+		f.status.recordFile(root, err)
+		return
+	}
 
 	// Do the checksumming
+	started := time.Now()
 	checksum, err := f.checksumFile(event.Path)
+	f.recordResult(shared.EventChecksummed, event.Path, "", started, err)
 	if err != nil {
-		log.Fatalln(err)
+		log.Errorln(err)
+		f.status.recordFile(root, err)
+		return
 	}
 
-	log.Debugf("Uploading %s to %s\n", event.Path, watcherPath)
-	for idx, uploader := range *f.uploaders {
+	log.Debugf("Uploading %s to %s\n", event.Path, key)
+	for idx, uploader := range uploaders {
 		// For each uploader, create a new pipe writer
 		reader, writer := io.Pipe()
 		pipeWriters[idx] = writer
 
 		go func(u backends.Uploader, event *BackerEvent) {
 			defer wg.Done()
-			u.UploadFile(event.Path, reader, watcherPath, checksum)
+			started := time.Now()
+			f.status.startTransfer(u.GetName())
+			counter := backends.NewCountingReader(reader)
+			err := u.UploadFile(event.Path, counter, key, f.buildMetadata(event.Path, watcher, event.Type, checksum))
+			// Backends which stop reading early would otherwise block the rest
+			io.Copy(ioutil.Discard, reader)
+			f.status.finishTransfer(u.GetName(), counter.Count(), err)
+			f.recordResult(shared.EventUploaded, event.Path, u.GetName(), started, err)
+			f.status.recordFile(root, err)
 		}(uploader, event)
 	}
 	// Run this in a go routine, so that way when it returns, we close all the writers, otherwise they'll deadlock and never stop reading
-	go f.processFile(&pipeWriters, event.Path)
+	read := make(chan error, 1)
+	go func() {
+		read <- f.processFile(pipeWriters, event.Path)
+	}()
 	wg.Wait()
+	if err = <-read; err != nil {
+		log.Errorf("Unable to read %s: %s\n", event.Path, err)
+	}
 	// Unlock the file
 	log.Printf("Finished uploading %s\n", event.Path)
 }
 
+// watcherFor - Returns the root and name of the watcher responsible for the given file
+// Returns false if no registered watcher contains the file, which happens to events queued before a watcher was removed
+func (f *FileManager) watcherFor(path string) (string, string, bool) {
+	f.rootsLock.RLock()
+	defer f.rootsLock.RUnlock()
+	if watcher, ok := f.watcherRoots[path]; ok {
+		return path, watcher, true
+	}
+	root := filepath.Dir(path)
+	watcher, ok := f.watcherRoots[root]
+	return root, watcher, ok
+}
+
+// errUnwatched - The file isn't in any registered watcher, so it has no object key
+var errUnwatched = errors.New("not in a registered watcher")
+
+// objectKey - Returns the object key of the given file, along with the name of its watcher
+func (f *FileManager) objectKey(path string) (string, string, error) {
+	root, watcher, ok := f.watcherFor(path)
+	if !ok {
+		return "", "", errUnwatched
+	}
+	key, err := f.keys().ObjectKey(root, watcher, path)
+	if err != nil {
+		return "", "", err
+	}
+	return key, watcher, nil
+}
+
+// buildMetadata - Returns the provenance metadata to store alongside an uploaded file
+func (f *FileManager) buildMetadata(path string, watcher string, event Event, checksum string) *backends.ObjectMetadata {
+	metadata := &backends.ObjectMetadata{
+		Checksum:      checksum,
+		Hostname:      f.hostname,
+		MachineID:     f.machineID,
+		Watcher:       watcher,
+		Event:         event.String(),
+		BackerVersion: f.version,
+		StorageClass:  f.storageClass(watcher),
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		metadata.ModTime = info.ModTime()
+	}
+	return metadata
+}
+
+// storageClass - Returns the storage class the watcher overrides the backends with, if any
+func (f *FileManager) storageClass(watcher string) string {
+	f.configLock.RLock()
+	defer f.configLock.RUnlock()
+	for _, w := range f.config.Watchers {
+		if w.BucketPath == watcher {
+			return w.StorageClass
+		}
+	}
+	return ""
+}
+
+// uploaderList - Returns the current backends, the list is replaced when the config is reloaded
+func (f *FileManager) uploaderList() []backends.Uploader {
+	f.configLock.RLock()
+	defer f.configLock.RUnlock()
+	return *f.uploaders
+}
+
+// keys - Returns the current key builder
+func (f *FileManager) keys() *shared.KeyBuilder {
+	f.configLock.RLock()
+	defer f.configLock.RUnlock()
+	return f.config.Keys
+}
+
+func (f *FileManager) deleteOnRemove() bool {
+	f.configLock.RLock()
+	defer f.configLock.RUnlock()
+	return f.config.DeleteOnRemove
+}
+
+// Status - Returns the health of each watcher, backend and queue
+func (f *FileManager) Status() *shared.StatusReport {
+	var names []string
+	for _, uploader := range f.uploaderList() {
+		names = append(names, uploader.GetName())
+	}
+	report := f.status.report(f.roots(), names)
+	report.Paused, report.PausedUntil, _ = f.pause.state()
+	report.Queues = []shared.QueueStatus{{
+		Name:  "backlog",
+		Depth: f.backlog.Len(),
+	}}
+	return report
+}
+
 func (f *FileManager) checksumFile(filename string) (string, error) {
 
 	file, err := os.Open(filename)
@@ -284,31 +453,54 @@ func (f *FileManager) checksumFile(filename string) (string, error) {
 	return hashString, nil
 }
 
-func (f *FileManager) processFile(pipeWriters *[]io.Writer, filename string) {
+// processFile - Copy the file to every pipe, the backends see the error if it can't be read
+func (f *FileManager) processFile(pipeWriters []*io.PipeWriter, filename string) error {
 	// Read in the file
 	// Should I lock this file?
 	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer file.Close()
+	if err == nil {
+		defer file.Close()
 
-	// Defer closing all the writers, except the Hash
-	for _, writer := range *pipeWriters {
-		// Cast this back to a PipeWriter, seems gross
-		w, ok := writer.(*io.PipeWriter)
-		if ok {
-			defer w.Close()
+		// Create a multiwriter and read everything into it
+		writers := make([]io.Writer, len(pipeWriters))
+		for idx, writer := range pipeWriters {
+			writers[idx] = writer
 		}
+		var bytes int64
+		bytes, err = io.Copy(io.MultiWriter(writers...), file)
+		log.Debugf("Finished reading %d bytes to pipes\n", bytes)
 	}
 
-	// Create a multiwriter and read everything into it
-	mw := io.MultiWriter(*pipeWriters...)
-	bytes, err := io.Copy(mw, file)
+	// Closing with a nil error is a normal close
+	for _, writer := range pipeWriters {
+		writer.CloseWithError(err)
+	}
+	return err
+}
+
+// listFiles - Returns the files of a watcher root, which is either a single file or a directory
+func listFiles(root string) ([]string, error) {
+	dir, err := isDir(root)
+	if err != nil {
+		return nil, err
+	}
+	if !dir {
+		return []string{root}, nil
+	}
+
+	// If we're a dir, get all the files in the directory
+	fls, err := ioutil.ReadDir(root)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	var files []string
+	for _, file := range fls {
+		if file.IsDir() {
+			continue
+		}
+		files = append(files, filepath.Join(root, file.Name()))
 	}
-	log.Debugf("Finished reading %d bytes to pipes\n", bytes)
+	return files, nil
 }
 
 func isDir(path string) (bool, error) {
@@ -3,11 +3,15 @@ package daemon
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -157,6 +161,111 @@ func TestDirectorySync(t *testing.T) {
 	assert.Equal(t, hex.EncodeToString(hash.Sum(nil)), syncHash, "Hash should match for second file")
 }
 
+func TestFailingBackend(t *testing.T) {
+	mb := &MockBackend{done: make(chan bool, 2)}
+	fm, dir := createFileManager(mb)
+	defer os.RemoveAll(dir)
+	failing := &FailingBackend{}
+	fm.config.Backends = []backends.Uploader{failing, mb}
+	fm.RegisterWatcherPath(dir, "test-bucket")
+
+	// Larger than anything the pipes would buffer
+	tmpf := filepath.Join(dir, "large")
+	data := strings.Repeat("backer", 1<<20)
+	assert.Nil(t, ioutil.WriteFile(tmpf, []byte(data), 0600), "Should write file")
+
+	uploaded := make(chan bool)
+	go func() {
+		fm.handleFileUpload(&BackerEvent{Type: WRITE, Path: tmpf})
+		close(uploaded)
+	}()
+	select {
+	case <-uploaded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Should not wait on the failed backend")
+	}
+	assert.Equal(t, len(data), mb.dataSize, "Should still upload to the other backend")
+
+	// Every backend removes the file
+	fm.handleFile(closedEvents(BackerEvent{Type: REMOVE, Path: tmpf}))
+	<-mb.done
+	<-mb.done
+	assert.Equal(t, tmpf, mb.deletedFile, "Should delete from the other backend")
+	for start := time.Now(); failing.deleted() == "" && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, tmpf, failing.deleted(), "Should delete from every backend")
+
+	// Files which can't be read fail every backend, instead of stopping the daemon
+	assert.NotNil(t, fm.processFile([]*io.PipeWriter{}, filepath.Join(dir, "missing")), "Should return the error")
+}
+
+func TestUnwatchedEvents(t *testing.T) {
+	mb := &MockBackend{done: make(chan bool, 2)}
+	fm, dir := createFileManager(mb)
+	defer os.RemoveAll(dir)
+	fm.RegisterWatcherPath(dir, "test-bucket")
+
+	tmpf := filepath.Join(dir, "queued")
+	assert.Nil(t, ioutil.WriteFile(tmpf, []byte("queued"), 0600), "Should write file")
+	_, _, err := fm.objectKey(tmpf)
+	assert.Nil(t, err, "Should build the key of a watched file")
+
+	// Events queued before the watcher was removed have nowhere to go
+	fm.UnregisterWatcherPath(dir)
+	_, _, err = fm.objectKey(tmpf)
+	assert.Equal(t, errUnwatched, err, "Should not build a key without a watcher")
+
+	fm.handleFileUpload(&BackerEvent{Type: WRITE, Path: tmpf})
+	fm.handleFile(closedEvents(BackerEvent{Type: REMOVE, Path: tmpf}))
+	select {
+	case <-mb.done:
+		t.Fatal("Should drop events of unwatched files")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Empty(t, mb.deletedFile, "Should not delete anything")
+}
+
+func closedEvents(events ...BackerEvent) <-chan BackerEvent {
+	in := make(chan BackerEvent, len(events))
+	for _, event := range events {
+		in <- event
+	}
+	close(in)
+	return in
+}
+
+// FailingBackend - Gives up on uploads without reading anything
+type FailingBackend struct {
+	sync.Mutex
+	deletedFile string
+}
+
+func (b *FailingBackend) UploadFile(name string, data io.Reader, remotePath string, metadata *backends.ObjectMetadata) error {
+	return errors.New("upload failed")
+}
+
+func (b *FailingBackend) DeleteFile(name string, remotePath string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.deletedFile = name
+	return nil
+}
+
+func (b *FailingBackend) deleted() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.deletedFile
+}
+
+func (b *FailingBackend) GetName() string {
+	return "FailingBackend"
+}
+
+func (b *FailingBackend) FileInSync(name string, remotePath string, data io.Reader, metadata *backends.ObjectMetadata) (bool, error) {
+	return false, errors.New("upload failed")
+}
+
 func createFileManager(backend backends.Uploader) (*FileManager, string) {
 
 	// Create a folder to watch
@@ -178,17 +287,26 @@ func createFileManager(backend backends.Uploader) (*FileManager, string) {
 
 	var backends = []backends.Uploader{backend}
 
+	keys, err := shared.NewKeyBuilder(shared.HostKeyTemplate)
+	if err != nil {
+		panic(err)
+	}
+
 	var mockConfig = &shared.BackerConfig{
 		DeleteOnRemove: true,
 		Backends:       backends,
 		Watchers:       watchers,
+		Keys:           keys,
 	}
 
 	fm := &FileManager{
 		config:       mockConfig,
+		configLock:   &sync.RWMutex{},
 		uploaders:    &mockConfig.Backends,
 		backlog:      NewMultiFileBacklog(),
 		watcherRoots: make(map[string]string),
+		status:       newStatusTracker(),
+		events:       newEventLog(eventHistory),
 	}
 
 	return fm, dir
@@ -203,7 +321,7 @@ type MockBackend struct {
 	synchronizedFiles map[string]string
 }
 
-func (b *MockBackend) UploadFile(name string, data io.Reader, remotePath string, checksum string) {
+func (b *MockBackend) UploadFile(name string, data io.Reader, remotePath string, metadata *backends.ObjectMetadata) error {
 	bytes, err := ioutil.ReadAll(data)
 	if err != nil {
 		panic(err)
@@ -212,26 +330,28 @@ func (b *MockBackend) UploadFile(name string, data io.Reader, remotePath string,
 	byteLen := len(bytes)
 	b.dataSize = byteLen
 	b.dataContent = byteData
-	b.checksum = checksum
+	b.checksum = metadata.Checksum
 	b.done <- true
+	return nil
 }
 
-func (b *MockBackend) DeleteFile(name string, remotePath string) {
+func (b *MockBackend) DeleteFile(name string, remotePath string) error {
 	b.deletedFile = name
 	b.done <- true
+	return nil
 }
 
 func (b *MockBackend) GetName() string {
 	return "MockBackend"
 }
 
-func (b *MockBackend) FileInSync(name string, remotePath string, data io.Reader, checksum string) (bool, error) {
+func (b *MockBackend) FileInSync(name string, remotePath string, data io.Reader, metadata *backends.ObjectMetadata) (bool, error) {
 	bytes, err := ioutil.ReadAll(data)
 	if err != nil {
 		panic(err)
 	}
 	log.Printf("Mock backend: %s\n", string(bytes))
-	b.synchronizedFiles[name] = checksum
+	b.synchronizedFiles[name] = metadata.Checksum
 	return true, nil
 }
 
@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// fileLog - Build the version history of a file, optionally including the changes made by each version
+func fileLog(config *shared.BackerConfig, args *shared.LogArgs) (*shared.FileLog, error) {
+	key, err := config.ObjectKey(args.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := getVersionReader(config)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := reader.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &shared.FileLog{
+		Path:     args.Path,
+		Versions: make([]shared.FileVersion, len(versions)),
+	}
+	if backend, ok := reader.(backends.Uploader); ok {
+		result.Backend = backend.GetName()
+	}
+
+	for idx, version := range versions {
+		if args.Metadata || args.Patch {
+			if err = reader.HeadVersion(&version); err != nil {
+				return nil, err
+			}
+		}
+		fileVersion := shared.FileVersion{
+			VersionID:    version.VersionID,
+			LastModified: version.LastModified,
+			Size:         version.Size,
+			IsLatest:     version.IsLatest,
+			DeleteMarker: version.DeleteMarker,
+		}
+		if version.Metadata != nil {
+			fileVersion.ObjectMetadata = *version.Metadata
+		}
+		result.Versions[idx] = fileVersion
+	}
+
+	if args.Patch {
+		err = addPatches(reader, args.Path, key, result.Versions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// addPatches - Diff each version against the one before it, versions are ordered newest first
+func addPatches(reader backends.VersionReader, name string, key string, versions []shared.FileVersion) error {
+	// The oldest version is diffed against an empty file
+	var previous []byte
+	previousLabel := name + "@empty"
+	for idx := len(versions) - 1; idx >= 0; idx-- {
+		if versions[idx].DeleteMarker {
+			continue
+		}
+		data, err := readVersion(reader, key, versions[idx].VersionID)
+		if err != nil {
+			return err
+		}
+
+		label := versionLabel(name, versions[idx].VersionID)
+		diff, err := buildDiff(previousLabel, previous, label, data)
+		if err != nil {
+			return err
+		}
+		if diff.Diff != "" {
+			versions[idx].Patch = diff.Diff
+		} else {
+			versions[idx].Patch = diff.Summary
+		}
+		previous = data
+		previousLabel = label
+	}
+	return nil
+}
+
+// listObjects - Returns the current version of every object stored by the watchers
+func listObjects(config *shared.BackerConfig, args *shared.ListArgs) (*shared.ObjectList, error) {
+	result := &shared.ObjectList{}
+	for _, backend := range config.Backends {
+		reader, ok := backend.(backends.VersionReader)
+		if !ok {
+			continue
+		}
+		for _, watcher := range config.Watchers {
+			prefix, err := config.Keys.WatcherPrefix(watcher.BucketPath)
+			if err != nil {
+				return nil, err
+			}
+			objects, err := reader.ListObjects(prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, object := range objects {
+				if args.Metadata {
+					if err = reader.HeadVersion(&object); err != nil {
+						return nil, err
+					}
+				}
+				info := shared.ObjectInfo{
+					Backend:      backend.GetName(),
+					Key:          object.Key,
+					VersionID:    object.VersionID,
+					LastModified: object.LastModified,
+					Size:         object.Size,
+				}
+				if object.Metadata != nil {
+					info.ObjectMetadata = *object.Metadata
+				}
+				result.Objects = append(result.Objects, info)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLog(t *testing.T) {
+	backend := &VersionBackend{bodies: map[string]string{
+		"v1": "listen 80;\n",
+		"v2": "listen 443;\n",
+	}}
+	fm, dir := createFileManager(backend)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "nginx.conf")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("listen 443;\n"), 0600), "Should write file")
+
+	now := time.Now()
+	backend.versions = []backends.ObjectVersion{
+		{VersionID: "v3", LastModified: now, DeleteMarker: true, IsLatest: true},
+		{VersionID: "v2", LastModified: now.Add(-time.Hour), Size: 12},
+		{VersionID: "v1", LastModified: now.Add(-2 * time.Hour), Size: 11},
+	}
+
+	history, err := fileLog(fm.config, &shared.LogArgs{Path: file})
+	assert.Nil(t, err, "Should build the history")
+	assert.Equal(t, "VersionBackend", history.Backend, "Should name the backend")
+	assert.Len(t, history.Versions, 3, "Should list every version")
+	assert.True(t, history.Versions[0].DeleteMarker, "Should include delete markers")
+	assert.Empty(t, history.Versions[1].Hostname, "Shouldn't fetch the metadata")
+	assert.Equal(t, 0, backend.heads, "Should only use the listing")
+
+	history, err = fileLog(fm.config, &shared.LogArgs{Path: file, Metadata: true})
+	assert.Nil(t, err, "Should build the history")
+	assert.Equal(t, "test-host", history.Versions[1].Hostname, "Should fetch the metadata")
+	assert.Equal(t, 2, backend.heads, "Should fetch each upload")
+
+	history, err = fileLog(fm.config, &shared.LogArgs{Path: file, Patch: true})
+	assert.Nil(t, err, "Should build the history")
+	assert.Empty(t, history.Versions[0].Patch, "Delete markers don't change anything")
+	assert.True(t, strings.Contains(history.Versions[1].Patch, "+listen 443;"), "Should diff against the previous version")
+	assert.True(t, strings.Contains(history.Versions[2].Patch, "+listen 80;"), "Should diff the first version against nothing")
+	assert.Equal(t, "test-host", history.Versions[2].Hostname, "Patches include the metadata")
+
+	_, err = fileLog(fm.config, &shared.LogArgs{Path: "/not/watched"})
+	assert.NotNil(t, err, "Should only log watched files")
+}
+
+// VersionBackend - Returns the same versions for every key
+type VersionBackend struct {
+	InventoryBackend
+	versions []backends.ObjectVersion
+	bodies   map[string]string
+	heads    int
+}
+
+func (b *VersionBackend) GetName() string {
+	return "VersionBackend"
+}
+
+func (b *VersionBackend) GetVersion(key string, versionID string) (io.ReadCloser, error) {
+	body, ok := b.bodies[versionID]
+	if !ok {
+		return nil, errors.New("no such version")
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte(body))), nil
+}
+
+func (b *VersionBackend) ListVersions(key string) ([]backends.ObjectVersion, error) {
+	versions := make([]backends.ObjectVersion, len(b.versions))
+	for idx, version := range b.versions {
+		version.Key = key
+		versions[idx] = version
+	}
+	return versions, nil
+}
+
+func (b *VersionBackend) ListObjects(prefix string) ([]backends.ObjectVersion, error) {
+	return nil, nil
+}
+
+func (b *VersionBackend) HeadVersion(version *backends.ObjectVersion) error {
+	if version.DeleteMarker {
+		return nil
+	}
+	b.heads++
+	version.Metadata = &backends.ObjectMetadata{Checksum: "sum", Hostname: "test-host"}
+	return nil
+}
@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// migrateKeys - Move the objects of every local file from the previous key template to the current one
+// Only files which still exist locally can be migrated, as their old keys are derived from their paths
+// Objects which can't be moved are reported along with the rest, so a single failure doesn't stop the migration
+func migrateKeys(config *shared.BackerConfig, args *shared.MigrateArgs) (*shared.MigrateResult, error) {
+	fromKeys, err := shared.NewKeyBuilder(args.FromTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &shared.MigrateResult{
+		DryRun: args.DryRun,
+	}
+	for _, watcher := range config.Watchers {
+		root, err := watcher.GetPath()
+		if err != nil {
+			return nil, err
+		}
+		files, err := listFiles(root)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			from, err := fromKeys.ObjectKey(root, watcher.BucketPath, file)
+			if err != nil {
+				return nil, err
+			}
+			to, err := config.Keys.ObjectKey(root, watcher.BucketPath, file)
+			if err != nil {
+				return nil, err
+			}
+			if from == to {
+				continue
+			}
+
+			for _, backend := range config.Backends {
+				mover, ok := backend.(backends.Mover)
+				if !ok {
+					log.Debugf("Backend %s does not support moving objects\n", backend.GetName())
+					continue
+				}
+				move := shared.KeyMove{
+					Backend: backend.GetName(),
+					Path:    file,
+					From:    from,
+					To:      to,
+				}
+				if !args.DryRun {
+					move.Versions, err = mover.MoveObject(from, to)
+					if err != nil {
+						log.Errorf("Unable to move %s to %s: %s\n", from, to, err)
+						move.Error = err.Error()
+					}
+				}
+				result.Moves = append(result.Moves, move)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// RunOnce - Reconcile every watcher with every backend and return, without starting the daemon or its control socket
+// Each result is passed to report as soon as it's known, and the whole run is returned once it has finished
+// Stored objects whose local file is gone are only reported, unless deleteOrphans is set
+func RunOnce(configLocation string, version string, dryRun bool, deleteOrphans bool, report func(shared.SyncFile)) (*shared.SyncProgress, error) {
+	log.Println("Reconciling watchers once, from", configLocation)
+	config, err := loadConfig(configLocation)
+	if err != nil {
+		return nil, err
+	}
+	if config.Backends, err = buildBackends(config); err != nil {
+		return nil, err
+	}
+	return runOnce(NewFileManager(config, version), dryRun, deleteOrphans, report)
+}
+
+// runOnce - Reconcile every watcher of the file manager with its backends
+func runOnce(fm *FileManager, dryRun bool, deleteOrphans bool, report func(shared.SyncFile)) (*shared.SyncProgress, error) {
+	state := &daemonState{
+		RWMutex: fm.configLock,
+		config:  fm.config,
+		manager: fm,
+	}
+
+	targets, err := state.syncTargets(&shared.SyncArgs{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	job := &syncJob{dryRun: dryRun}
+	for _, target := range targets {
+		target.deleteOrphans = deleteOrphans
+		fm.reconcile(target, dryRun, func(file shared.SyncFile) {
+			job.add(file)
+			report(file)
+		})
+	}
+	job.finish()
+	progress, _ := job.progress(0)
+	return progress, nil
+}
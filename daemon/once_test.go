@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunOnce(t *testing.T) {
+	backend := &InventoryBackend{stored: make(map[string]string)}
+	fm, dir := createFileManager(backend)
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, "local")
+	assert.Nil(t, ioutil.WriteFile(local, []byte("local"), 0600), "Should write file")
+	prefix, err := fm.config.Keys.WatcherPrefix("test-bucket")
+	assert.Nil(t, err, "Should build prefix")
+	backend.stored[prefix+"/deleted"] = "gone"
+
+	var reported []shared.SyncFile
+	progress, err := runOnce(fm, false, false, func(file shared.SyncFile) {
+		reported = append(reported, file)
+	})
+	assert.Nil(t, err, "Should reconcile")
+	assert.Equal(t, shared.SyncSummary{Uploaded: 1, Orphaned: 1}, progress.Summary, "Should upload the new file")
+	assert.Equal(t, progress.Files, reported, "Should report each file")
+	assert.Contains(t, backend.stored, prefix+"/deleted", "Should only report orphans by default")
+
+	progress, err = runOnce(fm, false, true, func(shared.SyncFile) {})
+	assert.Nil(t, err, "Should reconcile")
+	assert.Equal(t, shared.SyncSummary{Unchanged: 1}, progress.Summary, "Should only find the local file")
+	assert.NotContains(t, backend.stored, prefix+"/deleted", "Should remove the orphan")
+}
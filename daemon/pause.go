@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// pauseState - Whether or not uploads are paused, events keep collecting in the backlog while they are
+type pauseState struct {
+	sync.Mutex
+	paused  bool
+	until   time.Time // Zero for pauses which last until they're resumed
+	timer   *time.Timer
+	resumed chan struct{} // Closed when the current pause ends
+}
+
+// pause - Stop handing events to the backends, a non-zero duration resumes automatically
+// Pausing again replaces the duration of the current pause
+func (p *pauseState) pause(duration time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resumed = make(chan struct{})
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.until = time.Time{}
+	if duration > 0 {
+		p.until = time.Now().Add(duration)
+		resumed := p.resumed
+		p.timer = time.AfterFunc(duration, func() {
+			p.resumeIf(resumed)
+		})
+		log.Printf("Pausing uploads until %s\n", p.until.Format(time.RFC3339))
+		return
+	}
+	log.Println("Pausing uploads")
+}
+
+// resume - Start handing events to the backends again, returns false if they weren't paused
+func (p *pauseState) resume() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.resumeLocked()
+}
+
+// resumeIf - Resume, but only if the given pause is still the current one
+func (p *pauseState) resumeIf(resumed chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	if p.resumed == resumed {
+		p.resumeLocked()
+	}
+}
+
+func (p *pauseState) resumeLocked() bool {
+	if !p.paused {
+		return false
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.paused = false
+	p.until = time.Time{}
+	close(p.resumed)
+	log.Println("Resuming uploads")
+	return true
+}
+
+// state - Returns whether or not uploads are paused, when they'll resume, and a channel which is closed when they do
+func (p *pauseState) state() (bool, time.Time, <-chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused, p.until, p.resumed
+}
+
+// pauseStatus - Returns whether or not uploads are paused, along with the number of queued events
+func (f *FileManager) pauseStatus() *shared.PauseStatus {
+	paused, until, _ := f.pause.state()
+	return &shared.PauseStatus{
+		Paused: paused,
+		Until:  until,
+		Queued: f.backlog.Len(),
+	}
+}
@@ -0,0 +1,60 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauseUploads(t *testing.T) {
+	mb := &MockBackend{
+		done: make(chan bool),
+	}
+	fm, dir := createFileManager(mb)
+	defer os.RemoveAll(dir)
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.Nil(t, err, "Should be able to create watcher")
+	defer watcher.Close()
+	fm.RegisterWatcherPath(dir, "test-bucket")
+	assert.Nil(t, watcher.Add(dir), "Should be able to register watcher")
+	go fm.Start(watcher.Events, watcher.Errors)
+
+	fm.pause.pause(0)
+	tmpf := filepath.Join(dir, "tempFile")
+	for _, content := range []string{"first", "second", "third"} {
+		err = ioutil.WriteFile(tmpf, []byte(content), 0666)
+		assert.Nil(t, err, "Should be able to write")
+	}
+
+	select {
+	case <-mb.done:
+		t.Fatal("Should not upload while paused")
+	case <-time.After(time.Second):
+	}
+	status := fm.pauseStatus()
+	assert.True(t, status.Paused, "Should be paused")
+	assert.Equal(t, 1, status.Queued, "Should coalesce the writes")
+
+	// Only the final state is uploaded
+	assert.True(t, fm.pause.resume(), "Should resume")
+	<-mb.done
+	assert.Equal(t, "third", mb.dataContent, "Should upload the latest contents")
+	assert.False(t, fm.pause.resume(), "Should already be resumed")
+
+	// Timed pauses resume on their own
+	fm.pause.pause(50 * time.Millisecond)
+	paused, until, resumed := fm.pause.state()
+	assert.True(t, paused, "Should be paused")
+	assert.False(t, until.IsZero(), "Should know when it will resume")
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Should resume automatically")
+	}
+}
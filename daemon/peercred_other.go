@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package daemon
+
+import "net"
+
+// peerCredentials - SO_PEERCRED is Linux only, elsewhere peers only get read access
+func peerCredentials(conn net.Conn) (*peer, error) {
+	return nil, errPeerCredentialsUnsupported
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// pruneBackends - Enforce the retention policy of each watcher against every backend which supports it
+func pruneBackends(config *shared.BackerConfig, dryRun bool) (*shared.PruneResult, error) {
+	result := &shared.PruneResult{
+		DryRun: dryRun,
+	}
+
+	for _, backend := range config.Backends {
+		pruner, ok := backend.(backends.Pruner)
+		if !ok {
+			log.Debugf("Backend %s does not support pruning\n", backend.GetName())
+			continue
+		}
+
+		for _, watcher := range config.Watchers {
+			prefix, err := config.Keys.WatcherPrefix(watcher.BucketPath)
+			if err != nil {
+				return result, err
+			}
+			expired, err := pruner.Prune(prefix, watcher.Retention, dryRun)
+			if err != nil {
+				return result, err
+			}
+			result.Versions = append(result.Versions, prunedVersions(backend, expired)...)
+		}
+
+		// Once the expired versions are gone, clean up any data they were sharing
+		if collector, ok := backend.(backends.GarbageCollector); ok {
+			garbage, err := collector.CollectGarbage(dryRun)
+			if err != nil {
+				return result, err
+			}
+			result.Versions = append(result.Versions, prunedVersions(backend, garbage)...)
+		}
+	}
+	return result, nil
+}
+
+func prunedVersions(backend backends.Uploader, versions []backends.ObjectVersion) []shared.PrunedVersion {
+	pruned := make([]shared.PrunedVersion, len(versions))
+	for idx, version := range versions {
+		pruned[idx] = shared.PrunedVersion{
+			Backend:      backend.GetName(),
+			Key:          version.Key,
+			VersionID:    version.VersionID,
+			LastModified: version.LastModified,
+			DeleteMarker: version.DeleteMarker,
+		}
+	}
+	return pruned
+}
+
+// startPrune - Replace any running prune schedule with one at the given interval, which may be disabled
+// Must be called while holding the write lock
+func (d *daemonState) startPrune(interval time.Duration) {
+	if d.pruneStop != nil {
+		close(d.pruneStop)
+		d.pruneStop = nil
+	}
+	if interval <= 0 {
+		log.Println("Scheduled pruning is disabled")
+		return
+	}
+	d.pruneStop = make(chan bool)
+	go schedulePrune(d, interval, d.pruneStop)
+}
+
+// schedulePrune - Periodically enforce the retention policies, until stopped
+func schedulePrune(state *daemonState, interval time.Duration, stop <-chan bool) {
+	log.Printf("Enforcing retention policies every %s\n", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		result, err := pruneBackends(state.snapshot(), false)
+		if err != nil {
+			log.Errorln("Unable to prune backends:", err)
+			continue
+		}
+		log.Printf("Pruned %d expired versions\n", len(result.Versions))
+	}
+}
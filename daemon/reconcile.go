@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// startReconcile - Replace any running reconciliation schedule with one at the given interval, which may be disabled
+// Must be called while holding the write lock
+func (d *daemonState) startReconcile(interval time.Duration) {
+	if d.reconcileStop != nil {
+		close(d.reconcileStop)
+		d.reconcileStop = nil
+	}
+	if interval <= 0 {
+		log.Println("Scheduled reconciliation is disabled")
+		return
+	}
+	d.reconcileStop = make(chan bool)
+	go scheduleReconcile(d, interval, d.reconcileStop)
+}
+
+// scheduleReconcile - Periodically compare every watcher with the backends, to catch any changes the watchers missed
+func scheduleReconcile(state *daemonState, interval time.Duration, stop <-chan bool) {
+	log.Printf("Reconciling watchers every %s\n", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// Reconciling would upload files, which is what pausing is meant to prevent
+		if paused, _, _ := state.manager.pause.state(); paused {
+			log.Debugln("Uploads are paused, skipping reconciliation")
+			continue
+		}
+		state.reconcileAll(stop)
+	}
+}
+
+// reconcileAll - Compare every watcher with the backends, one at a time
+// File events always go first, so each watcher waits until the backlog is empty
+func (d *daemonState) reconcileAll(stop <-chan bool) {
+	targets, err := d.syncTargets(&shared.SyncArgs{All: true})
+	if err != nil {
+		log.Errorln("Unable to reconcile watchers:", err)
+		return
+	}
+
+	log.Debugln("Reconciling watchers")
+	for _, target := range targets {
+		for d.manager.backlog.Len() > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		target.deleteOrphans = d.manager.deleteOnRemove()
+		d.manager.reconcile(target, false, logSyncResult)
+	}
+	d.manager.status.recordReconcile()
+	log.Debugln("Reconciliation has finished")
+}
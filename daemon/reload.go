@@ -0,0 +1,170 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// loadConfig - Read the config file and its fragments, and ensure that they are valid
+func loadConfig(location string) (*shared.BackerConfig, error) {
+	if _, err := os.Stat(location); err != nil {
+		return nil, errors.New("cannot read config file: " + location)
+	}
+
+	config, err := shared.LoadConfig(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if problems := checkConfig(config); len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return config, nil
+}
+
+// buildBackends - Create the main backend, followed by any additional ones, failing if any of them can't be used
+// Each backend gets its own copy of the options, so that reloading the config can't change them underneath an upload
+// Building them only checks the buckets, so a reload which is rolled back leaves nothing behind
+func buildBackends(config *shared.BackerConfig) ([]backends.Uploader, error) {
+	var uploaders []backends.Uploader
+	for _, options := range append([]backends.S3Options{config.S3}, config.AdditionalBackends...) {
+		options := options
+		uploader, err := backends.NewS3Uploader(&options)
+		if err != nil {
+			return nil, err
+		}
+		uploaders = append(uploaders, uploader)
+	}
+	return uploaders, nil
+}
+
+// reload - Re-read the config file and apply any changes to the running daemon
+// Queued events are kept, if the new config is invalid the current one stays in place
+func (d *daemonState) reload() (*shared.ReloadResult, error) {
+	// Concurrent reloads would otherwise each compare against the config the other is replacing
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	log.Println("Reloading config from", d.configLocation)
+	next, err := loadConfig(d.configLocation)
+	if err != nil {
+		log.Errorln("Invalid config, keeping the current one:", err)
+		return nil, err
+	}
+
+	// Only rebuild the backends if their options have actually changed
+	// Their preflight checks contact S3, so they run before anything is replaced
+	d.RLock()
+	uploaders := d.config.Backends
+	backendsChanged := !reflect.DeepEqual(d.config.S3, next.S3) || !reflect.DeepEqual(d.config.AdditionalBackends, next.AdditionalBackends)
+	d.RUnlock()
+	if backendsChanged {
+		log.Println("Backend options have changed, rebuilding backends")
+		if uploaders, err = buildBackends(next); err != nil {
+			log.Errorln("Unable to use the new backends, keeping the current config:", err)
+			return nil, err
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	current, err := watcherMap(d.config.Watchers)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := watcherMap(next.Watchers)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &shared.ReloadResult{Backends: backendsChanged}
+	for path, bucketPath := range updated {
+		previous, ok := current[path]
+		if !ok {
+			result.Added = append(result.Added, path)
+		} else if previous != bucketPath {
+			result.Updated = append(result.Updated, path)
+		}
+	}
+	for path := range current {
+		if _, ok := updated[path]; !ok {
+			result.Removed = append(result.Removed, path)
+		}
+	}
+
+	// Add the new watches first, that's the only step which can fail
+	for idx, path := range result.Added {
+		err = d.watcher.Add(path)
+		if err != nil {
+			for _, added := range result.Added[:idx] {
+				d.watcher.Remove(added)
+			}
+			log.Errorln("Unable to watch new path, keeping the current config:", err)
+			return nil, err
+		}
+	}
+	for _, path := range result.Removed {
+		err = d.watcher.Remove(path)
+		if err != nil {
+			log.Warnf("Unable to remove watch for %s: %s\n", path, err)
+		}
+		d.manager.UnregisterWatcherPath(path)
+	}
+	for _, path := range result.Updated {
+		d.manager.UnregisterWatcherPath(path)
+	}
+	for _, path := range append(result.Added, result.Updated...) {
+		d.manager.RegisterWatcherPath(path, updated[path])
+	}
+
+	pruneChanged := d.config.PruneInterval != next.PruneInterval
+	reconcileChanged := d.config.ReconcileInterval != next.ReconcileInterval
+
+	// Replace the config in place, everything else holds a pointer to it
+	*d.config = *next
+	d.config.Backends = uploaders
+
+	if pruneChanged {
+		interval, _ := d.config.GetPruneInterval()
+		d.startPrune(interval)
+	}
+	if reconcileChanged {
+		interval, _ := d.config.GetReconcileInterval()
+		d.startReconcile(interval)
+	}
+
+	log.Printf("Reloaded config, added %d, removed %d and updated %d watchers\n", len(result.Added), len(result.Removed), len(result.Updated))
+	return result, nil
+}
+
+// handleReload - Reload the config whenever the daemon receives SIGHUP
+func handleReload(d *daemonState) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		// Errors have already been logged, and the current config is still running
+		d.reload()
+	}
+}
+
+// watcherMap - Returns the bucket path of each watcher, keyed by its absolute path
+func watcherMap(watchers []shared.Watcher) (map[string]string, error) {
+	paths := make(map[string]string, len(watchers))
+	for _, watcher := range watchers {
+		path, err := watcher.GetPath()
+		if err != nil {
+			return nil, err
+		}
+		paths[path] = watcher.BucketPath
+	}
+	return paths, nil
+}
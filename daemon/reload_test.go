@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	fm, dir := createFileManager(&MockBackend{})
+	defer os.RemoveAll(dir)
+	fm.RegisterWatcherPath(dir, "test-bucket")
+	fm.config.S3 = backends.S3Options{Region: "us-east-1", Bucket: "test-bucket"}
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.Nil(t, err, "Should create watcher")
+	defer watcher.Close()
+
+	state := &daemonState{
+		RWMutex:        fm.configLock,
+		configLocation: filepath.Join(dir, "config.json"),
+		config:         fm.config,
+		manager:        fm,
+		watcher:        watcher,
+	}
+	uploaders := fm.uploaderList()
+
+	// Invalid configs leave everything in place
+	err = ioutil.WriteFile(state.configLocation, []byte("{\"watchers\": ["), 0600)
+	assert.Nil(t, err, "Should write config")
+	_, err = state.reload()
+	assert.NotNil(t, err, "Should reject invalid config")
+	assert.Equal(t, "test-bucket", fm.roots()[dir], "Should keep the current watchers")
+
+	added, err := ioutil.TempDir(dir, "added")
+	assert.Nil(t, err, "Should create directory")
+	writeConfig(t, state.configLocation, &shared.BackerConfig{
+		S3:             fm.config.S3,
+		DeleteOnRemove: false,
+		Watchers: []shared.Watcher{
+			{BucketPath: "renamed", Path: dir},
+			{BucketPath: "added", Path: added},
+		},
+	})
+
+	result, err := state.reload()
+	assert.Nil(t, err, "Should reload config")
+	assert.Equal(t, []string{added}, result.Added, "Should add new watcher")
+	assert.Equal(t, []string{dir}, result.Updated, "Should update bucket path")
+	assert.False(t, result.Backends, "Should not rebuild unchanged backends")
+	assert.Equal(t, map[string]string{dir: "renamed", added: "added"}, fm.roots(), "Should register the new watchers")
+	assert.Equal(t, uploaders, fm.uploaderList(), "Should keep the existing backends")
+	assert.False(t, fm.deleteOnRemove(), "Should apply option changes")
+
+	writeConfig(t, state.configLocation, &shared.BackerConfig{
+		S3:       fm.config.S3,
+		Watchers: []shared.Watcher{{BucketPath: "added", Path: added}},
+	})
+	result, err = state.reload()
+	assert.Nil(t, err, "Should reload config")
+	assert.Equal(t, []string{dir}, result.Removed, "Should remove watcher")
+	assert.Equal(t, map[string]string{added: "added"}, fm.roots(), "Should unregister the removed watcher")
+}
+
+func writeConfig(t *testing.T, location string, config *shared.BackerConfig) {
+	data, err := json.Marshal(config)
+	assert.Nil(t, err, "Should marshal config")
+	err = ioutil.WriteFile(location, data, 0600)
+	assert.Nil(t, err, "Should write config")
+}
@@ -0,0 +1,108 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// Clients which haven't finished the TLS handshake by then are disconnected
+var remoteHandshakeTimeout = 10 * time.Second
+
+// remoteTLSConfig - Require clients to present a certificate signed by the configured CA
+func remoteTLSConfig(config *shared.RemoteConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(config.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + config.CA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// certificateRole - Returns the role of a client, based on either the common name or the DNS names of its certificate
+// Only one of them is matched, otherwise a CA which issues server certificates could grant access by accident
+func certificateRole(config *shared.RemoteConfig, cert *x509.Certificate) accessRole {
+	names := []string{cert.Subject.CommonName}
+	if config.MatchName == shared.MatchDNSName {
+		names = cert.DNSNames
+	}
+	if matchesAny(config.Admins, names) {
+		return roleWrite
+	}
+	if matchesAny(config.Readers, names) {
+		return roleRead
+	}
+	return roleNone
+}
+
+// listenRemote - Serve the RPC server over mutual TLS
+func listenRemote(config *shared.RemoteConfig, state *daemonState) (net.Listener, error) {
+	tlsConfig, err := remoteTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	l, err := tls.Listen("tcp", config.Listen, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Remote management listening on", l.Addr())
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Debugln("Stopped accepting remote connections:", err)
+				return
+			}
+			go serveRemote(conn.(*tls.Conn), state)
+		}
+	}()
+	return l, nil
+}
+
+func serveRemote(conn *tls.Conn, state *daemonState) {
+	// Verify the client before deciding what it's allowed to do, without letting it hold the connection open
+	err := conn.SetDeadline(time.Now().Add(remoteHandshakeTimeout))
+	if err == nil {
+		err = conn.Handshake()
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Warnf("Rejecting remote connection from %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	cert := conn.ConnectionState().PeerCertificates[0]
+
+	state.RLock()
+	role := certificateRole(&state.config.Remote, cert)
+	state.RUnlock()
+	if role == roleNone {
+		log.Warnf("Rejecting remote connection from %s, certificate %s has no role\n", conn.RemoteAddr(), cert.Subject.CommonName)
+		conn.Close()
+		return
+	}
+	log.Debugf("Remote connection from %s, certificate %s has %s access\n", conn.RemoteAddr(), cert.Subject.CommonName, role)
+	serveAuthorized(conn, role, state)
+}
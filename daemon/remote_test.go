@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteManagement(t *testing.T) {
+	fm, dir := createFileManager(&MockBackend{})
+	defer os.RemoveAll(dir)
+	fm.RegisterWatcherPath(dir, "test-bucket")
+
+	ca, caKey := newCertificate(t, "backer-ca", nil, nil)
+	server, serverKey := newCertificate(t, "localhost", ca, caKey)
+	admin, adminKey := newCertificate(t, "admin", ca, caKey)
+	reader, readerKey := newCertificate(t, "monitoring", ca, caKey)
+	stranger, strangerKey := newCertificate(t, "stranger", ca, caKey)
+	rogueCA, rogueKey := newCertificate(t, "rogue-ca", nil, nil)
+	rogue, rogueLeafKey := newCertificate(t, "admin", rogueCA, rogueKey)
+
+	fm.config.Remote = shared.RemoteConfig{
+		Listen:  "127.0.0.1:0",
+		CA:      writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw),
+		Cert:    writePEM(t, dir, "server.pem", "CERTIFICATE", server.Raw),
+		Key:     writeKey(t, dir, "server-key.pem", serverKey),
+		Admins:  []string{"admin"},
+		Readers: []string{"monitoring"},
+	}
+	assert.Nil(t, fm.config.Remote.Validate(), "Should be a valid config")
+
+	state := &daemonState{
+		RWMutex: fm.configLock,
+		config:  fm.config,
+		manager: fm,
+	}
+	l, err := listenRemote(&fm.config.Remote, state)
+	assert.Nil(t, err, "Should listen")
+	defer l.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	dial := func(cert *x509.Certificate, key *ecdsa.PrivateKey) (*rpc.Client, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+			RootCAs:      roots,
+			ServerName:   "localhost",
+		})
+		if err != nil {
+			return nil, err
+		}
+		return rpc.NewClient(conn), nil
+	}
+
+	client, err := dial(admin, adminKey)
+	assert.Nil(t, err, "Admins should connect")
+	var status = &shared.PauseStatus{}
+	assert.Nil(t, client.Call("RPC.Pause", &shared.PauseArgs{}, &status), "Admins can pause")
+	client.Close()
+
+	client, err = dial(reader, readerKey)
+	assert.Nil(t, err, "Readers should connect")
+	var watchers = &shared.FileWatchers{}
+	assert.Nil(t, client.Call("RPC.ListWatchers", 0, &watchers), "Readers can list watchers")
+	assert.NotNil(t, client.Call("RPC.Resume", 0, &status), "Readers can't resume")
+	client.Close()
+
+	// Certificates without a role are disconnected
+	client, err = dial(stranger, strangerKey)
+	if err == nil {
+		assert.NotNil(t, client.Call("RPC.ListWatchers", 0, &watchers), "Should reject certificates without a role")
+		client.Close()
+	}
+
+	// As are certificates from another CA
+	client, err = dial(rogue, rogueLeafKey)
+	if err == nil {
+		assert.NotNil(t, client.Call("RPC.ListWatchers", 0, &watchers), "Should reject certificates from other CAs")
+		client.Close()
+	}
+
+	// And clients which never start the handshake
+	remoteHandshakeTimeout = 100 * time.Millisecond
+	defer func() { remoteHandshakeTimeout = 10 * time.Second }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err, "Should connect")
+	defer conn.Close()
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)), "Should set a deadline")
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.False(t, ok && netErr.Timeout(), "Should be disconnected before our own deadline")
+}
+
+func TestCertificateRole(t *testing.T) {
+	ca, caKey := newCertificate(t, "backer-ca", nil, nil)
+	cert, _ := newCertificate(t, "admin", ca, caKey)
+	cert.DNSNames = []string{"monitoring"}
+	config := &shared.RemoteConfig{Admins: []string{"monitoring"}, Readers: []string{"admin"}}
+
+	assert.Equal(t, roleRead, certificateRole(config, cert), "Should only match the common name")
+	config.MatchName = shared.MatchDNSName
+	assert.Equal(t, roleWrite, certificateRole(config, cert), "Should only match the DNS names")
+	config.MatchName = "email"
+	config.Listen, config.CA, config.Cert, config.Key = ":7118", "ca.pem", "cert.pem", "key.pem"
+	assert.NotNil(t, config.Validate(), "Should reject unknown names")
+}
+
+// newCertificate - Create a certificate signed by the parent, or a self signed CA if there isn't one
+func newCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "Should generate key")
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err, "Should generate serial")
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err, "Should create certificate")
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "Should parse certificate")
+	return cert, key
+}
+
+func writePEM(t *testing.T, dir string, name string, blockType string, data []byte) string {
+	location := filepath.Join(dir, name)
+	err := ioutil.WriteFile(location, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	assert.Nil(t, err, "Should write "+name)
+	return location
+}
+
+func writeKey(t *testing.T, dir string, name string, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err, "Should marshal key")
+	return writePEM(t, dir, name, "EC PRIVATE KEY", der)
+}
@@ -1,6 +1,9 @@
 package daemon
 
 import (
+	"errors"
+	"time"
+
 	"github.com/nickrobison/backer/shared"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,29 +11,245 @@ import (
 // RPC - RPC interface
 type RPC struct {
 	Config *shared.BackerConfig
+	state  *daemonState
+	role   accessRole // What the client on the other end of the socket is allowed to do
 }
 
 // SayHello - Dummy Function (to remove)
 func (r *RPC) SayHello(args int, reply *string) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
 	log.Println("In rpc call")
 	*reply = "Hello there!"
 	return nil
 }
 
+// Version - Report the protocol and release of the daemon, so clients can check they're compatible
+func (r *RPC) Version(args *shared.VersionArgs, info *shared.VersionInfo) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	log.Debugln("Client connected with protocol", args.Protocol)
+	*info = shared.VersionInfo{
+		Protocol: shared.ProtocolVersion,
+		Backer:   r.state.manager.version,
+	}
+	return nil
+}
+
 // ListWatchers - Implementation from the interface definition
 func (r *RPC) ListWatchers(args int, watchers *shared.FileWatchers) error {
-	var watcherPaths = make([]string, len(r.Config.Watchers))
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	log.Debugln("Returning watcher paths")
+	paths, err := r.state.watcherPaths()
+	if err != nil {
+		return err
+	}
+	*watchers = *paths
+	return nil
+}
 
-	for i, watcher := range r.Config.Watchers {
-		path, err := watcher.GetPath()
-		if err != nil {
-			return err
-		}
-		watcherPaths[i] = path
+// Prune - Enforce the retention policies, optionally only reporting what would be removed
+func (r *RPC) Prune(args *shared.PruneArgs, result *shared.PruneResult) error {
+	if err := r.authorize(mutating(args.DryRun)); err != nil {
+		return err
+	}
+	log.Debugln("Pruning backends, dry run:", args.DryRun)
+	pruned, err := pruneBackends(r.state.snapshot(), args.DryRun)
+	if err != nil {
+		return err
 	}
+	*result = *pruned
+	return nil
+}
 
-	log.Debugln("Returning watcher paths")
+// Diff - Compare a local file against one of its stored versions, or two stored versions against each other
+func (r *RPC) Diff(args *shared.DiffArgs, result *shared.DiffResult) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	log.Debugln("Diffing", args.Path)
+	diff, err := diffFile(r.state.snapshot(), args)
+	if err != nil {
+		return err
+	}
+	*result = *diff
+	return nil
+}
+
+// Log - Returns the version history of a file
+func (r *RPC) Log(args *shared.LogArgs, result *shared.FileLog) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	log.Debugln("Retrieving history of", args.Path)
+	history, err := fileLog(r.state.snapshot(), args)
+	if err != nil {
+		return err
+	}
+	*result = *history
+	return nil
+}
+
+// ListObjects - Returns the current version of every stored object, along with its provenance
+func (r *RPC) ListObjects(args *shared.ListArgs, objects *shared.ObjectList) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	log.Debugln("Listing objects")
+	list, err := listObjects(r.state.snapshot(), args)
+	if err != nil {
+		return err
+	}
+	*objects = *list
+	return nil
+}
+
+// ListObjectVersions - Returns the IDs of each stored version of a file
+func (r *RPC) ListObjectVersions(args *shared.Args, object *shared.BucketObjects) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	history, err := fileLog(r.state.snapshot(), &shared.LogArgs{Path: args.Path})
+	if err != nil {
+		return err
+	}
+
+	object.Key = args.Path
+	for _, version := range history.Versions {
+		object.Version = append(object.Version, version.VersionID)
+	}
+	return nil
+}
+
+// MigrateKeys - Move objects from a previous key template to the current one
+func (r *RPC) MigrateKeys(args *shared.MigrateArgs, result *shared.MigrateResult) error {
+	if err := r.authorize(mutating(args.DryRun)); err != nil {
+		return err
+	}
+	log.Debugln("Migrating keys from", args.FromTemplate)
+	migrated, err := migrateKeys(r.state.snapshot(), args)
+	if err != nil {
+		return err
+	}
+	*result = *migrated
+	return nil
+}
+
+// Status - Returns the health of each watcher, backend and queue
+func (r *RPC) Status(args int, report *shared.StatusReport) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	log.Debugln("Returning daemon status")
+	*report = *r.state.manager.Status()
+	return nil
+}
+
+// AddWatcher - Start watching a new path, and add it to the config file
+func (r *RPC) AddWatcher(args *shared.WatchArgs, watchers *shared.FileWatchers) error {
+	if err := r.authorize(roleWrite); err != nil {
+		return err
+	}
+	log.Debugln("Adding watcher for", args.Path)
+	err := r.state.addWatcher(args)
+	if err != nil {
+		return err
+	}
+	return r.ListWatchers(0, watchers)
+}
+
+// RemoveWatcher - Stop watching a path, and remove it from the config file
+func (r *RPC) RemoveWatcher(args *shared.WatchArgs, watchers *shared.FileWatchers) error {
+	if err := r.authorize(roleWrite); err != nil {
+		return err
+	}
+	log.Debugln("Removing watcher for", args.Path)
+	err := r.state.removeWatcher(args)
+	if err != nil {
+		return err
+	}
+	return r.ListWatchers(0, watchers)
+}
+
+// Reload - Re-read the config file and apply any changes, the current config is kept if the new one is invalid
+func (r *RPC) Reload(args int, result *shared.ReloadResult) error {
+	if err := r.authorize(roleWrite); err != nil {
+		return err
+	}
+	log.Debugln("Reloading config")
+	reloaded, err := r.state.reload()
+	if err != nil {
+		return err
+	}
+	*result = *reloaded
+	return nil
+}
+
+// Sync - Start reconciling local files with the backends, the results are collected with SyncProgress
+func (r *RPC) Sync(args *shared.SyncArgs, job *shared.SyncJob) error {
+	if err := r.authorize(mutating(args.DryRun)); err != nil {
+		return err
+	}
+	log.Debugln("Starting sync of", args.Path, "all:", args.All)
+	id, err := r.state.startSync(args)
+	if err != nil {
+		return err
+	}
+	job.ID = id
+	return nil
+}
+
+// SyncProgress - Returns the results of a sync which have arrived since the given offset
+func (r *RPC) SyncProgress(args *shared.SyncProgressArgs, progress *shared.SyncProgress) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	result, err := r.state.syncProgress(args)
+	if err != nil {
+		return err
+	}
+	*progress = *result
+	return nil
+}
+
+// Events - Returns the pipeline events after the given sequence number, optionally waiting for new ones
+func (r *RPC) Events(args *shared.EventsArgs, batch *shared.EventBatch) error {
+	if err := r.authorize(roleRead); err != nil {
+		return err
+	}
+	if args.Wait {
+		*batch = *r.state.manager.events.wait(args.After, shared.EventWait)
+		return nil
+	}
+	events, _ := r.state.manager.events.since(args.After)
+	*batch = *events
+	return nil
+}
+
+// Pause - Stop uploading files, events are queued until uploads are resumed
+func (r *RPC) Pause(args *shared.PauseArgs, status *shared.PauseStatus) error {
+	if err := r.authorize(roleWrite); err != nil {
+		return err
+	}
+	r.state.manager.pause.pause(args.Duration)
+	*status = *r.state.manager.pauseStatus()
+	return nil
+}
 
-	watchers.Paths = watcherPaths
+// Resume - Start uploading files again, including any which changed while paused
+func (r *RPC) Resume(args int, status *shared.PauseStatus) error {
+	if err := r.authorize(roleWrite); err != nil {
+		return err
+	}
+	*status = *r.state.manager.pauseStatus()
+	if !r.state.manager.pause.resume() {
+		return errors.New("uploads are not paused")
+	}
+	status.Paused = false
+	status.Until = time.Time{}
 	return nil
 }
@@ -1,3 +1,4 @@
+//go:build !windows
 // +build !windows
 
 package daemon
@@ -5,13 +6,24 @@ package daemon
 import (
 	"net"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
 )
 
-const unixSocket = "/tmp/backer.sock"
+// Location of the socket the daemon is listening on
+var unixSocket string
 
-func getSocket() (net.Listener, error) {
+func getSocket(config *shared.SocketConfig) (net.Listener, error) {
+	unixSocket = config.GetPath()
+	mode, err := config.GetMode()
+	if err != nil {
+		return nil, err
+	}
 
 	if fileExists(unixSocket) {
 		log.Warnf("File: %s already, exists, application may have crashed.\n", unixSocket)
@@ -21,15 +33,58 @@ func getSocket() (net.Listener, error) {
 		}
 	}
 
+	err = os.MkdirAll(filepath.Dir(unixSocket), 0755)
+	if err != nil {
+		return nil, err
+	}
+
 	l, err := net.Listen("unix", unixSocket)
 	if err != nil {
 		return nil, err
 	}
-	// Open up permissions
-	os.Chmod(unixSocket, 0777)
+
+	// Restrict who can connect, before anyone gets the chance to
+	err = chownSocket(config)
+	if err == nil {
+		err = os.Chmod(unixSocket, mode)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	log.Debugf("Listening on %s with mode %s\n", unixSocket, mode)
 	return l, nil
 }
 
+// chownSocket - Set the configured owner and group of the socket
+func chownSocket(config *shared.SocketConfig) error {
+	if config.Owner == "" && config.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if config.Owner != "" {
+		account, err := user.Lookup(config.Owner)
+		if err != nil {
+			account, err = user.LookupId(config.Owner)
+		}
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(account.Uid)
+	}
+	if config.Group != "" {
+		group, err := user.LookupGroup(config.Group)
+		if err != nil {
+			group, err = user.LookupGroupId(config.Group)
+		}
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(group.Gid)
+	}
+	return os.Chown(unixSocket, uid, gid)
+}
+
 func removeSocket() {
 	log.Debugln("Removing socket:", unixSocket)
 	os.Remove(unixSocket)
@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 package daemon
@@ -9,11 +10,14 @@ import (
 	"github.com/Microsoft/go-winio"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/shared"
 )
 
 const windowsPipe string = `\\.\pipe\backer`
 
-func getSocket() (net.Listener, error) {
+// getSocket - Named pipes don't have a path or file permissions, so the socket config is ignored
+func getSocket(config *shared.SocketConfig) (net.Listener, error) {
 	l, err := winio.ListenPipe(windowsPipe, nil)
 	if err != nil {
 		return nil, err
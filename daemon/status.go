@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nickrobison/backer/shared"
+)
+
+// watcherState - Running state of a single watcher
+type watcherState struct {
+	lastSync      time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// backendState - Running state of a single backend
+type backendState struct {
+	inFlight         int
+	bytesTransferred int64
+	lastSuccess      time.Time
+	lastError        string
+	lastErrorTime    time.Time
+}
+
+// statusTracker - Records the outcome of every operation, so the daemon can report its health
+type statusTracker struct {
+	sync.Mutex
+	watchers      map[string]*watcherState
+	backends      map[string]*backendState
+	overflows     int
+	lastReconcile time.Time
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{
+		watchers: make(map[string]*watcherState),
+		backends: make(map[string]*backendState),
+	}
+}
+
+func (s *statusTracker) watcher(root string) *watcherState {
+	state, ok := s.watchers[root]
+	if !ok {
+		state = &watcherState{}
+		s.watchers[root] = state
+	}
+	return state
+}
+
+func (s *statusTracker) backend(name string) *backendState {
+	state, ok := s.backends[name]
+	if !ok {
+		state = &backendState{}
+		s.backends[name] = state
+	}
+	return state
+}
+
+// recordFile - Record the result of synchronizing a file of the given watcher
+func (s *statusTracker) recordFile(root string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	state := s.watcher(root)
+	if err != nil {
+		state.lastError = err.Error()
+		state.lastErrorTime = time.Now()
+		return
+	}
+	state.lastSync = time.Now()
+}
+
+// startTransfer - Mark the start of an operation against the backend
+func (s *statusTracker) startTransfer(backend string) {
+	s.Lock()
+	defer s.Unlock()
+	s.backend(backend).inFlight++
+}
+
+// finishTransfer - Record the result of an operation against the backend
+func (s *statusTracker) finishTransfer(backend string, bytes int64, err error) {
+	s.Lock()
+	defer s.Unlock()
+	state := s.backend(backend)
+	state.inFlight--
+	state.bytesTransferred += bytes
+	if err != nil {
+		state.lastError = err.Error()
+		state.lastErrorTime = time.Now()
+		return
+	}
+	state.lastSuccess = time.Now()
+}
+
+// recordOverflow - Record that file events have been dropped
+func (s *statusTracker) recordOverflow() {
+	s.Lock()
+	defer s.Unlock()
+	s.overflows++
+}
+
+// recordReconcile - Record that every watcher has been compared with the backends
+func (s *statusTracker) recordReconcile() {
+	s.Lock()
+	defer s.Unlock()
+	s.lastReconcile = time.Now()
+}
+
+// report - Build the status of each watcher root and backend
+func (s *statusTracker) report(watcherRoots map[string]string, uploaders []string) *shared.StatusReport {
+	s.Lock()
+	defer s.Unlock()
+
+	report := &shared.StatusReport{
+		Healthy:        true,
+		EventOverflows: s.overflows,
+		LastReconcile:  s.lastReconcile,
+	}
+
+	for root, bucketPath := range watcherRoots {
+		state := s.watcher(root)
+		status := shared.WatcherStatus{
+			Path:          root,
+			BucketPath:    bucketPath,
+			LastSync:      state.lastSync,
+			LastError:     state.lastError,
+			LastErrorTime: state.lastErrorTime,
+		}
+		// The watch dies along with its path
+		if _, err := os.Stat(root); err == nil {
+			status.Alive = true
+		}
+		files, err := listFiles(root)
+		if err == nil {
+			status.FileCount = len(files)
+		}
+		status.Healthy = status.Alive && recovered(state.lastErrorTime, state.lastSync)
+		report.Healthy = report.Healthy && status.Healthy
+		report.Watchers = append(report.Watchers, status)
+	}
+	sort.Slice(report.Watchers, func(i, j int) bool {
+		return report.Watchers[i].Path < report.Watchers[j].Path
+	})
+
+	for _, name := range uploaders {
+		state := s.backend(name)
+		status := shared.BackendStatus{
+			Name:             name,
+			InFlight:         state.inFlight,
+			BytesTransferred: state.bytesTransferred,
+			LastSuccess:      state.lastSuccess,
+			LastError:        state.lastError,
+			LastErrorTime:    state.lastErrorTime,
+			Healthy:          recovered(state.lastErrorTime, state.lastSuccess),
+		}
+		report.Healthy = report.Healthy && status.Healthy
+		report.Backends = append(report.Backends, status)
+	}
+	return report
+}
+
+// recovered - Returns true if there has never been an error, or if there's been a success since the last one
+func recovered(lastError time.Time, lastSuccess time.Time) bool {
+	return lastError.IsZero() || lastSuccess.After(lastError)
+}
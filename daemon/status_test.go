@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusReport(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.Nil(t, err, "Should have working directory")
+	roots := map[string]string{dir: "test-bucket"}
+
+	tracker := newStatusTracker()
+	report := tracker.report(roots, []string{"MockBackend"})
+	assert.True(t, report.Healthy, "Should start healthy")
+	assert.True(t, report.Watchers[0].Alive, "Watcher should be alive")
+
+	// A failed upload makes both the backend and the watcher unhealthy
+	tracker.startTransfer("MockBackend")
+	tracker.finishTransfer("MockBackend", 10, errors.New("upload failed"))
+	tracker.recordFile(dir, errors.New("upload failed"))
+	report = tracker.report(roots, []string{"MockBackend"})
+	assert.False(t, report.Healthy, "Should be unhealthy")
+	assert.False(t, report.Backends[0].Healthy, "Backend should be unhealthy")
+	assert.Equal(t, "upload failed", report.Backends[0].LastError, "Should have the last error")
+	assert.Equal(t, int64(10), report.Backends[0].BytesTransferred, "Should count the bytes")
+
+	// Until the next success
+	tracker.startTransfer("MockBackend")
+	tracker.finishTransfer("MockBackend", 10, nil)
+	tracker.recordFile(dir, nil)
+	report = tracker.report(roots, []string{"MockBackend"})
+	assert.True(t, report.Healthy, "Should recover")
+	assert.Equal(t, 0, report.Backends[0].InFlight, "Should not have anything in flight")
+
+	// Dropped events are counted, but don't affect health
+	tracker.recordOverflow()
+	tracker.recordReconcile()
+	report = tracker.report(roots, []string{"MockBackend"})
+	assert.True(t, report.Healthy, "Should stay healthy")
+	assert.Equal(t, 1, report.EventOverflows, "Should count overflows")
+	assert.False(t, report.LastReconcile.IsZero(), "Should record the reconciliation")
+
+	// Missing watch paths are dead
+	report = tracker.report(map[string]string{"/does/not/exist": "missing"}, nil)
+	assert.False(t, report.Healthy, "Should be unhealthy")
+	assert.False(t, report.Watchers[0].Alive, "Watcher should be dead")
+}
@@ -0,0 +1,431 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// localFile - A file to be reconciled, along with where it's stored
+type localFile struct {
+	path     string
+	key      string
+	checksum string
+}
+
+// syncTarget - The files of a single watcher which should be reconciled
+type syncTarget struct {
+	root    string
+	watcher string
+	files   []string
+	full    bool     // Files cover the whole watcher, so stored objects without a local file are orphaned
+	exclude []string // Prefixes of other watchers which are nested inside this one
+	shared  bool     // Another watcher has the same prefix, so its objects can't be told apart
+
+	deleteOrphans bool // Remove orphaned objects from the backends
+}
+
+// reconcile - Compare the files of a watcher with each backend, uploading any which are missing or out of date
+// Backends which support it are compared using their stored checksums, so no data is sent for files which are in sync
+// Orphans are never removed if any local file failed, as its stored copy may be the only one left
+func (f *FileManager) reconcile(target syncTarget, dryRun bool, report func(shared.SyncFile)) {
+	keys := f.keys()
+	var files []localFile
+	local := make(map[string]bool, len(target.files))
+	failed := false
+	for _, path := range target.files {
+		key, err := keys.ObjectKey(target.root, target.watcher, path)
+		if err == nil {
+			local[key] = true
+			var checksum string
+			checksum, err = f.checksumFile(path)
+			if err == nil {
+				files = append(files, localFile{path: path, key: key, checksum: checksum})
+				continue
+			}
+		}
+		failed = true
+		f.status.recordFile(target.root, err)
+		report(shared.SyncFile{Path: path, Status: shared.SyncFailed, Error: err.Error()})
+	}
+	deleteOrphans := target.deleteOrphans && !dryRun
+	if deleteOrphans && failed {
+		log.Warnf("Not removing orphaned objects of %s, some of its files couldn't be read\n", target.root)
+		deleteOrphans = false
+	}
+
+	prefix, err := keys.WatcherPrefix(target.watcher)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	for _, backend := range f.uploaderList() {
+		name := backend.GetName()
+		inventory, ok := backend.(backends.Inventory)
+		if !ok {
+			for _, file := range files {
+				if dryRun {
+					report(syncResult(name, file, errors.New("backend does not support dry runs")))
+					continue
+				}
+				inSync, err := f.transfer(backend, target, file, true)
+				if err == nil && inSync {
+					report(shared.SyncFile{Backend: name, Path: file.path, Key: file.key, Status: shared.SyncUnchanged})
+					continue
+				}
+				report(syncResult(name, file, err))
+			}
+			continue
+		}
+
+		stored, err := inventory.Checksums(prefix)
+		if err != nil {
+			log.Errorf("Unable to list objects on backend %s: %s\n", name, err)
+			for _, file := range files {
+				report(syncResult(name, file, err))
+			}
+			continue
+		}
+
+		for _, file := range files {
+			if checksum, ok := stored[file.key]; ok && checksum == file.checksum {
+				report(shared.SyncFile{Backend: name, Path: file.path, Key: file.key, Status: shared.SyncUnchanged})
+				continue
+			}
+			if dryRun {
+				report(syncResult(name, file, nil))
+				continue
+			}
+			_, err := f.transfer(backend, target, file, false)
+			report(syncResult(name, file, err))
+		}
+
+		// Without a prefix of its own, the objects of the watcher are mixed with those of the others
+		if !target.full || prefix == "" || target.shared {
+			continue
+		}
+		for _, key := range orphanedKeys(stored, local, target.exclude) {
+			result := shared.SyncFile{Backend: name, Key: key, Status: shared.SyncOrphaned}
+			if deleteOrphans {
+				f.status.startTransfer(name)
+				started := time.Now()
+				err := backend.DeleteFile(key, key)
+				f.status.finishTransfer(name, 0, err)
+				f.recordResult(shared.EventDeleted, key, name, started, err)
+				if err != nil {
+					result.Error = err.Error()
+				} else {
+					result.Status = shared.SyncDeleted
+				}
+			}
+			report(result)
+		}
+	}
+}
+
+// transfer - Send a single file to a backend, checkFirst skips the upload if the backend already has the file
+func (f *FileManager) transfer(backend backends.Uploader, target syncTarget, file localFile, checkFirst bool) (bool, error) {
+	reader, err := os.Open(file.path)
+	if err != nil {
+		f.status.recordFile(target.root, err)
+		return false, err
+	}
+	defer reader.Close()
+
+	name := backend.GetName()
+	started := time.Now()
+	f.status.startTransfer(name)
+	counter := backends.NewCountingReader(reader)
+	metadata := f.buildMetadata(file.path, target.watcher, SYNC, file.checksum)
+	inSync := false
+	if checkFirst {
+		inSync, err = backend.FileInSync(file.path, file.key, counter, metadata)
+	} else {
+		err = backend.UploadFile(file.path, counter, file.key, metadata)
+	}
+	f.status.finishTransfer(name, counter.Count(), err)
+	f.status.recordFile(target.root, err)
+	if !inSync {
+		f.recordResult(shared.EventUploaded, file.path, name, started, err)
+	}
+	return inSync, err
+}
+
+func syncResult(backend string, file localFile, err error) shared.SyncFile {
+	result := shared.SyncFile{
+		Backend: backend,
+		Path:    file.path,
+		Key:     file.key,
+		Status:  shared.SyncUploaded,
+	}
+	if err != nil {
+		result.Status = shared.SyncFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// orphanedKeys - Returns the stored keys which don't belong to any of the local files, or to any of the excluded prefixes
+// Local files count whether or not they could be read
+func orphanedKeys(stored map[string]string, local map[string]bool, exclude []string) []string {
+	var orphaned []string
+	for key := range stored {
+		if !local[key] && !hasPrefix(key, exclude) {
+			orphaned = append(orphaned, key)
+		}
+	}
+	sort.Strings(orphaned)
+	return orphaned
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// logSyncResult - Report the results of background reconciliation to the log
+func logSyncResult(file shared.SyncFile) {
+	switch file.Status {
+	case shared.SyncUploaded:
+		log.Debugf("Updated file %s on backend %s\n", file.Path, file.Backend)
+	case shared.SyncFailed:
+		log.Errorf("Unable to sync %s to backend %s: %s\n", file.Path, file.Backend, file.Error)
+	case shared.SyncOrphaned:
+		if file.Error != "" {
+			log.Errorf("Unable to remove orphaned object %s from backend %s: %s\n", file.Key, file.Backend, file.Error)
+			return
+		}
+		log.Warnf("Object %s on backend %s has no local file\n", file.Key, file.Backend)
+	case shared.SyncDeleted:
+		log.Printf("Removed orphaned object %s from backend %s\n", file.Key, file.Backend)
+	}
+}
+
+// How long the results of a finished reconciliation are kept, if the client which started it stops polling
+const syncJobExpiry = 10 * time.Minute
+
+// syncJob - Results of a reconciliation started from the CLI, which are collected by polling
+type syncJob struct {
+	sync.Mutex
+	dryRun   bool
+	files    []shared.SyncFile
+	summary  shared.SyncSummary
+	done     bool
+	finished time.Time
+}
+
+func (j *syncJob) add(file shared.SyncFile) {
+	j.Lock()
+	defer j.Unlock()
+	j.files = append(j.files, file)
+	switch file.Status {
+	case shared.SyncUploaded:
+		j.summary.Uploaded++
+	case shared.SyncUnchanged:
+		j.summary.Unchanged++
+	case shared.SyncFailed:
+		j.summary.Failed++
+	case shared.SyncOrphaned:
+		j.summary.Orphaned++
+	}
+}
+
+func (j *syncJob) finish() {
+	j.Lock()
+	defer j.Unlock()
+	j.done = true
+	j.finished = time.Now()
+}
+
+// expired - Returns whether the job finished long enough ago that nobody is collecting its results
+func (j *syncJob) expired(now time.Time) bool {
+	j.Lock()
+	defer j.Unlock()
+	return j.done && now.Sub(j.finished) > syncJobExpiry
+}
+
+// progress - Returns the results after the given offset, and whether or not they have all been returned
+func (j *syncJob) progress(offset int) (*shared.SyncProgress, bool) {
+	j.Lock()
+	defer j.Unlock()
+	if offset < 0 || offset > len(j.files) {
+		offset = len(j.files)
+	}
+	progress := &shared.SyncProgress{
+		Files:   append([]shared.SyncFile(nil), j.files[offset:]...),
+		Done:    j.done,
+		DryRun:  j.dryRun,
+		Summary: j.summary,
+	}
+	return progress, j.done
+}
+
+// syncJobs - Reconciliations which are running, or whose results haven't been collected yet
+// Finished jobs are dropped once their results have been collected, or once they expire
+type syncJobs struct {
+	sync.Mutex
+	next int
+	jobs map[string]*syncJob
+}
+
+func (s *syncJobs) add(job *syncJob) string {
+	s.Lock()
+	defer s.Unlock()
+	if s.jobs == nil {
+		s.jobs = make(map[string]*syncJob)
+	}
+	now := time.Now()
+	for id, existing := range s.jobs {
+		if existing.expired(now) {
+			delete(s.jobs, id)
+		}
+	}
+	s.next++
+	id := strconv.Itoa(s.next)
+	s.jobs[id] = job
+	return id
+}
+
+func (s *syncJobs) get(id string) (*syncJob, bool) {
+	s.Lock()
+	defer s.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+func (s *syncJobs) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.jobs, id)
+}
+
+// syncTargets - Resolve the files to reconcile for the given arguments
+func (d *daemonState) syncTargets(args *shared.SyncArgs) ([]syncTarget, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var watchers []shared.Watcher
+	var path string
+	if args.All {
+		watchers = d.config.Watchers
+	} else {
+		var err error
+		path, err = filepath.Abs(args.Path)
+		if err != nil {
+			return nil, err
+		}
+		watcher, err := d.config.FindWatcher(path)
+		if err != nil {
+			return nil, err
+		}
+		watchers = []shared.Watcher{*watcher}
+	}
+
+	prefixes, err := d.watcherPrefixes()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]int, len(prefixes))
+	for _, prefix := range prefixes {
+		owners[prefix]++
+	}
+
+	var targets []syncTarget
+	for _, watcher := range watchers {
+		root, err := watcher.GetPath()
+		if err != nil {
+			return nil, err
+		}
+		target := root
+		if !args.All {
+			target = path
+		}
+		files, err := listFiles(target)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, syncTarget{
+			root:    root,
+			watcher: watcher.BucketPath,
+			files:   files,
+			full:    target == root,
+			exclude: nestedPrefixes(prefixes[watcher.BucketPath], prefixes),
+			shared:  owners[prefixes[watcher.BucketPath]] > 1,
+		})
+	}
+	return targets, nil
+}
+
+// watcherPrefixes - Returns the key prefix of each watcher, keyed by its bucket path
+func (d *daemonState) watcherPrefixes() (map[string]string, error) {
+	prefixes := make(map[string]string, len(d.config.Watchers))
+	for _, watcher := range d.config.Watchers {
+		prefix, err := d.config.Keys.WatcherPrefix(watcher.BucketPath)
+		if err != nil {
+			return nil, err
+		}
+		prefixes[watcher.BucketPath] = prefix
+	}
+	return prefixes, nil
+}
+
+// nestedPrefixes - Returns the prefixes which are inside the given one, their objects belong to other watchers
+func nestedPrefixes(prefix string, prefixes map[string]string) []string {
+	var nested []string
+	for _, other := range prefixes {
+		if other != prefix && (prefix == "" || strings.HasPrefix(other, prefix+"/")) {
+			nested = append(nested, other)
+		}
+	}
+	return nested
+}
+
+// startSync - Reconcile the requested files in the background, returning the ID used to collect the results
+func (d *daemonState) startSync(args *shared.SyncArgs) (string, error) {
+	if !args.All && args.Path == "" {
+		return "", errors.New("must specify a path, or sync all watchers")
+	}
+	targets, err := d.syncTargets(args)
+	if err != nil {
+		return "", err
+	}
+
+	job := &syncJob{dryRun: args.DryRun}
+	id := d.jobs.add(job)
+	go func() {
+		for _, target := range targets {
+			d.manager.reconcile(target, args.DryRun, job.add)
+		}
+		job.finish()
+		log.Printf("Sync %s has finished\n", id)
+	}()
+	return id, nil
+}
+
+// syncProgress - Returns the results of a reconciliation, it's forgotten once all of them have been collected
+func (d *daemonState) syncProgress(args *shared.SyncProgressArgs) (*shared.SyncProgress, error) {
+	job, ok := d.jobs.get(args.ID)
+	if !ok {
+		return nil, errors.New("unknown sync " + args.ID)
+	}
+	progress, done := job.progress(args.Offset)
+	if done {
+		d.jobs.remove(args.ID)
+	}
+	return progress, nil
+}
@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcile(t *testing.T) {
+	backend := &InventoryBackend{stored: make(map[string]string)}
+	fm, dir := createFileManager(backend)
+	defer os.RemoveAll(dir)
+
+	unchanged := filepath.Join(dir, "unchanged")
+	changed := filepath.Join(dir, "changed")
+	assert.Nil(t, ioutil.WriteFile(unchanged, []byte("same"), 0600), "Should write file")
+	assert.Nil(t, ioutil.WriteFile(changed, []byte("different"), 0600), "Should write file")
+
+	key := func(path string) string {
+		key, err := fm.config.Keys.ObjectKey(dir, "test-bucket", path)
+		assert.Nil(t, err, "Should build key")
+		return key
+	}
+	prefix, err := fm.config.Keys.WatcherPrefix("test-bucket")
+	assert.Nil(t, err, "Should build prefix")
+	backend.stored[key(unchanged)] = hashData(t, []byte("same"))
+	backend.stored[key(changed)] = hashData(t, []byte("old"))
+	backend.stored[prefix+"/deleted"] = "gone"
+
+	files, err := listFiles(dir)
+	assert.Nil(t, err, "Should list files")
+	target := syncTarget{root: dir, watcher: "test-bucket", files: files, full: true}
+
+	// Dry runs don't upload anything
+	job := &syncJob{dryRun: true}
+	fm.reconcile(target, true, job.add)
+	progress, _ := job.progress(0)
+	assert.Equal(t, shared.SyncSummary{Uploaded: 1, Unchanged: 1, Orphaned: 1}, progress.Summary, "Should report what would change")
+	assert.Equal(t, hashData(t, []byte("old")), backend.stored[key(changed)], "Should not upload during a dry run")
+
+	job = &syncJob{}
+	fm.reconcile(target, false, job.add)
+	progress, _ = job.progress(0)
+	assert.Equal(t, shared.SyncSummary{Uploaded: 1, Unchanged: 1, Orphaned: 1}, progress.Summary, "Should upload the changed file")
+	assert.Equal(t, hashData(t, []byte("different")), backend.stored[key(changed)], "Should store the new checksum")
+	assert.Equal(t, shared.SyncOrphaned, progress.Files[2].Status, "Should report orphans last")
+	assert.Equal(t, prefix+"/deleted", progress.Files[2].Key, "Should report the orphaned key")
+
+	// Partial syncs can't tell which objects are orphaned
+	target.files = []string{changed}
+	target.full = false
+	job = &syncJob{}
+	fm.reconcile(target, false, job.add)
+	progress, _ = job.progress(1)
+	assert.Len(t, progress.Files, 0, "Should only return results after the offset")
+	assert.Equal(t, shared.SyncSummary{Unchanged: 1}, progress.Summary, "Should only check the requested file")
+
+	// Objects of nested watchers are never orphaned
+	backend.stored[prefix+"/nested/file"] = "nested"
+	target = syncTarget{root: dir, watcher: "test-bucket", files: files, full: true, exclude: []string{prefix + "/nested"}, deleteOrphans: true}
+	job = &syncJob{}
+	fm.reconcile(target, false, job.add)
+	progress, _ = job.progress(2)
+	assert.Equal(t, []shared.SyncFile{{Backend: "InventoryBackend", Key: prefix + "/deleted", Status: shared.SyncDeleted}}, progress.Files, "Should delete the orphan")
+	assert.NotContains(t, backend.stored, prefix+"/deleted", "Should remove the orphan from the backend")
+	assert.Contains(t, backend.stored, prefix+"/nested/file", "Should keep objects of nested watchers")
+
+	// A file which can't be read still has its stored copy, and no orphans are removed at all
+	vanished := filepath.Join(dir, "vanished")
+	backend.stored[key(vanished)] = "stored"
+	backend.stored[prefix+"/deleted"] = "gone"
+	target.files = append(files, vanished)
+	job = &syncJob{}
+	fm.reconcile(target, false, job.add)
+	progress, _ = job.progress(0)
+	assert.Equal(t, shared.SyncFailed, progress.Files[0].Status, "Should fail the unreadable file")
+	assert.Equal(t, shared.SyncSummary{Unchanged: 2, Failed: 1, Orphaned: 1}, progress.Summary, "Should still report orphans")
+	assert.Contains(t, backend.stored, key(vanished), "Should keep the copy of the unreadable file")
+	assert.Contains(t, backend.stored, prefix+"/deleted", "Should not delete orphans when a file failed")
+
+	// Watchers with the same prefix can't tell their objects apart
+	target.files = files
+	target.shared = true
+	job = &syncJob{}
+	fm.reconcile(target, false, job.add)
+	progress, _ = job.progress(0)
+	assert.Equal(t, 0, progress.Summary.Orphaned, "Should not look for orphans under a shared prefix")
+	assert.Contains(t, backend.stored, prefix+"/deleted", "Should not delete objects under a shared prefix")
+}
+
+func TestNestedPrefixes(t *testing.T) {
+	prefixes := map[string]string{
+		"nginx":   "host/nginx",
+		"conf.d":  "host/nginx/conf.d",
+		"nginx-2": "host/nginx-2",
+	}
+	assert.Equal(t, []string{"host/nginx/conf.d"}, nestedPrefixes("host/nginx", prefixes), "Should only exclude nested watchers")
+	assert.Len(t, nestedPrefixes("host/nginx-2", prefixes), 0, "Should not exclude siblings")
+}
+
+func TestSyncJobsExpire(t *testing.T) {
+	var jobs syncJobs
+	collected := &syncJob{}
+	collectedID := jobs.add(collected)
+	abandoned := &syncJob{}
+	abandonedID := jobs.add(abandoned)
+	running := &syncJob{}
+	runningID := jobs.add(running)
+
+	collected.finish()
+	abandoned.finish()
+	abandoned.finished = time.Now().Add(-2 * syncJobExpiry)
+	jobs.add(&syncJob{})
+
+	_, ok := jobs.get(abandonedID)
+	assert.False(t, ok, "Should drop finished jobs which nobody collected")
+	_, ok = jobs.get(collectedID)
+	assert.True(t, ok, "Should keep recent results")
+	_, ok = jobs.get(runningID)
+	assert.True(t, ok, "Should keep running jobs")
+}
+
+type InventoryBackend struct {
+	stored map[string]string
+}
+
+func (b *InventoryBackend) UploadFile(name string, data io.Reader, key string, metadata *backends.ObjectMetadata) error {
+	_, err := io.Copy(ioutil.Discard, data)
+	b.stored[key] = metadata.Checksum
+	return err
+}
+
+func (b *InventoryBackend) DeleteFile(name string, key string) error {
+	delete(b.stored, key)
+	return nil
+}
+
+func (b *InventoryBackend) GetName() string {
+	return "InventoryBackend"
+}
+
+func (b *InventoryBackend) FileInSync(name string, key string, data io.Reader, metadata *backends.ObjectMetadata) (bool, error) {
+	if b.stored[key] == metadata.Checksum {
+		return true, nil
+	}
+	return false, b.UploadFile(name, data, key, metadata)
+}
+
+func (b *InventoryBackend) Checksums(prefix string) (map[string]string, error) {
+	stored := make(map[string]string, len(b.stored))
+	for key, checksum := range b.stored {
+		stored[key] = checksum
+	}
+	return stored, nil
+}
@@ -0,0 +1,309 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// checkConfig - Problems which stop the daemon from starting, or a reload from being applied
+// Parses the key template, when it's valid, and checks the keys of the files which exist right now
+func checkConfig(config *shared.BackerConfig) []shared.ConfigProblem {
+	var problems []shared.ConfigProblem
+	add := func(field string, err error) {
+		problems = append(problems, shared.ConfigProblem{Field: field, Message: err.Error()})
+	}
+
+	bucketPaths := make(map[string]int)
+	paths := make(map[string]int)
+	for idx, watcher := range config.Watchers {
+		// Each watcher would treat the objects of the other as orphans
+		if other, ok := bucketPaths[watcher.BucketPath]; ok && watcher.BucketPath != "" {
+			add(fmt.Sprintf("watchers[%d].bucketPath", idx), fmt.Errorf("%s is also used by watchers[%d], so their objects overwrite each other", watcher.BucketPath, other))
+		} else {
+			bucketPaths[watcher.BucketPath] = idx
+		}
+
+		field := fmt.Sprintf("watchers[%d].path", idx)
+		path, err := watcher.GetPath()
+		if err != nil {
+			add(field, err)
+			continue
+		}
+		if _, err = os.Stat(path); err != nil {
+			add(field, fmt.Errorf("%s does not exist", path))
+		}
+		if other, ok := paths[path]; ok {
+			add(field, fmt.Errorf("%s is already watched by watchers[%d]", path, other))
+		} else {
+			paths[path] = idx
+		}
+		if watcher.StorageClass != "" {
+			if err = backends.CheckStorageClass(watcher.StorageClass); err != nil {
+				add(fmt.Sprintf("watchers[%d].storageClass", idx), err)
+			}
+		}
+	}
+
+	keys, err := shared.NewKeyBuilder(config.KeyTemplate)
+	if err != nil {
+		add("keyTemplate", fmt.Errorf("invalid key template: %s", err))
+	} else {
+		config.Keys = keys
+		checkKeys(config, add)
+	}
+
+	if _, err = config.GetPruneInterval(); err != nil {
+		add("pruneInterval", fmt.Errorf("invalid prune interval: %s", err))
+	}
+	if _, err = config.GetReconcileInterval(); err != nil {
+		add("reconcileInterval", fmt.Errorf("invalid reconcile interval: %s", err))
+	}
+	if _, err = config.Socket.GetMode(); err != nil {
+		add("socket.mode", fmt.Errorf("invalid socket mode: %s", err))
+	}
+	if err = config.Socket.Validate(); err != nil {
+		add("socket.allowUnidentified", err)
+	}
+	if err = config.API.Validate(); err != nil {
+		add("api", err)
+	}
+	if err = config.Remote.Validate(); err != nil {
+		add("remote", err)
+	}
+
+	if err = config.S3.Validate(); err != nil {
+		add("s3", err)
+	}
+	// Backends are told apart by name in the status and results
+	names := map[string]bool{config.S3.GetName(): true}
+	for idx, options := range config.AdditionalBackends {
+		if err = options.Validate(); err != nil {
+			add(fmt.Sprintf("backends[%d]", idx), err)
+		}
+		name := options.GetName()
+		if names[name] {
+			add(fmt.Sprintf("backends[%d].name", idx), fmt.Errorf("backend name %s is already used", name))
+		}
+		names[name] = true
+	}
+	return problems
+}
+
+// ValidateConfig - Check a config file more thoroughly than the daemon does when it starts
+// Along with everything the daemon checks, this looks for unknown keys, missing credentials and overlapping watchers
+func ValidateConfig(location string) *shared.ConfigReport {
+	report := &shared.ConfigReport{Location: location, Valid: true}
+	tree, err := shared.ReadConfigTree(location)
+	if err != nil {
+		report.Add(shared.ConfigProblem{Message: err.Error()})
+		return report
+	}
+	config, err := shared.LoadConfig(location)
+	if err != nil {
+		report.Add(shared.ConfigProblem{Message: err.Error()})
+		return report
+	}
+
+	// The daemon ignores unknown keys, but they're usually a typo of an option which was meant to be set
+	// Fragments are already checked strictly when they're loaded
+	for _, key := range unknownKeys(tree, reflect.TypeOf(*config), "") {
+		report.Add(shared.ConfigProblem{Field: key, Message: "unknown key"})
+	}
+
+	for _, problem := range checkConfig(config) {
+		report.Add(problem)
+	}
+	checkWatchers(config, report)
+
+	checkCredentials("s3", &config.S3, report)
+	for idx := range config.AdditionalBackends {
+		checkCredentials(fmt.Sprintf("backends[%d]", idx), &config.AdditionalBackends[idx], report)
+	}
+	return report
+}
+
+// CheckBackends - Compare the bucket settings of every backend with the config, without changing anything
+func CheckBackends(location string) (*shared.BackendReport, error) {
+	return compareBackends(location, false)
+}
+
+// ApplyBackends - Create the buckets which the config asks for, and bring their lifecycle rules and object lock in line
+// This is the only place backer changes a bucket, the daemon only checks them
+func ApplyBackends(location string) (*shared.BackendReport, error) {
+	return compareBackends(location, true)
+}
+
+// compareBackends - Report the bucket settings of every backend, after applying the config if asked to
+func compareBackends(location string, apply bool) (*shared.BackendReport, error) {
+	config, err := loadConfig(location)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &shared.BackendReport{Location: location, InSync: true}
+	for _, options := range append([]backends.S3Options{config.S3}, config.AdditionalBackends...) {
+		options := options
+		check := shared.BackendCheck{Backend: options.GetName(), Bucket: options.Bucket}
+		err := options.Validate()
+		if err == nil {
+			var client *backends.S3Uploader
+			if client, err = backends.NewS3Client(&options); err == nil && apply {
+				if err = client.ApplyBucketSettings(); err == nil {
+					err = client.ApplyObjectLock()
+				}
+			}
+			if err == nil {
+				check.Settings, err = client.CheckBucket()
+			}
+		}
+		if err != nil {
+			check.Error = err.Error()
+			report.InSync = false
+		}
+		for _, setting := range check.Settings {
+			if !setting.InSync {
+				report.InSync = false
+			}
+		}
+		report.Backends = append(report.Backends, check)
+	}
+	return report, nil
+}
+
+// checkCredentials - Check that a backend has credentials, its options are checked along with the rest of the config
+func checkCredentials(field string, options *backends.S3Options, report *shared.ConfigReport) {
+	if err := options.CheckCredentials(); err != nil {
+		report.Add(shared.ConfigProblem{Field: field + ".credentials", Message: "no credentials available: " + err.Error()})
+	}
+}
+
+// checkKeys - Look for files whose keys collide, templates which drop part of the path are the usual culprit
+func checkKeys(config *shared.BackerConfig, add func(field string, err error)) {
+	owners := make(map[string]string)
+	for idx, watcher := range config.Watchers {
+		root, err := watcher.GetPath()
+		if err != nil {
+			continue
+		}
+		files, err := listFiles(root)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			key, err := config.Keys.ObjectKey(root, watcher.BucketPath, file)
+			if err != nil {
+				add("keyTemplate", err)
+				continue
+			}
+			if other, ok := owners[key]; ok && other != file {
+				add(fmt.Sprintf("watchers[%d]", idx), fmt.Errorf("%s and %s would both be stored as %s", other, file, key))
+				continue
+			}
+			owners[key] = file
+		}
+	}
+}
+
+// checkWatchers - Warn about watchers which overlap, or which aren't configured at all
+func checkWatchers(config *shared.BackerConfig, report *shared.ConfigReport) {
+	if len(config.Watchers) == 0 {
+		report.Add(shared.ConfigProblem{Field: "watchers", Message: "no watchers are configured", Warning: true})
+	}
+
+	roots := make([]string, len(config.Watchers))
+	for idx, watcher := range config.Watchers {
+		field := fmt.Sprintf("watchers[%d]", idx)
+		path, err := watcher.GetPath()
+		if err != nil {
+			continue
+		}
+		roots[idx] = path
+
+		if watcher.BucketPath == "" {
+			report.Add(shared.ConfigProblem{Field: field + ".bucketPath", Message: "no bucket path, files are stored without a watcher prefix", Warning: true})
+		}
+	}
+
+	for idx, path := range roots {
+		for otherIdx, other := range roots {
+			if other != "" && strings.HasPrefix(path, other+string(os.PathSeparator)) {
+				report.Add(shared.ConfigProblem{
+					Field:   fmt.Sprintf("watchers[%d].path", idx),
+					Message: fmt.Sprintf("%s is inside watchers[%d], so its files are uploaded by both", path, otherIdx),
+					Warning: true,
+				})
+			}
+		}
+	}
+}
+
+// unknownKeys - Returns the keys of the decoded JSON which don't match a field of the given type
+// Keys are matched without regard to case, the same way encoding/json does
+func unknownKeys(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for idx := 0; idx < t.NumField(); idx++ {
+			field := t.Field(idx)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || field.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[strings.ToLower(name)] = field.Type
+		}
+
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				unknown = append(unknown, fieldPath)
+				continue
+			}
+			unknown = append(unknown, unknownKeys(object[key], fieldType, fieldPath)...)
+		}
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for idx, element := range array {
+			unknown = append(unknown, unknownKeys(element, t.Elem(), fmt.Sprintf("%s[%d]", path, idx))...)
+		}
+	}
+	return unknown
+}
+
+// ShowConfig - Returns the config file with every default filled in and secrets masked
+func ShowConfig(location string) (*shared.BackerConfig, error) {
+	config, err := shared.LoadConfig(location)
+	if err != nil {
+		return nil, err
+	}
+	return config.Resolved(), nil
+}
@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backer-validate")
+	assert.Nil(t, err, "Should create temp dir")
+	defer os.RemoveAll(dir)
+
+	nested := filepath.Join(dir, "nested")
+	for _, path := range []string{filepath.Join(dir, "a"), filepath.Join(nested, "a")} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0700), "Should create directory")
+		assert.Nil(t, ioutil.WriteFile(path, []byte("data"), 0600), "Should write file")
+	}
+
+	location := filepath.Join(dir, "config.json")
+	config := `{
+		"keyTemplate": "{{.Base}}",
+		"watchers": [
+			{"path": "` + dir + `", "bucketPath": "etc"},
+			{"path": "` + nested + `", "bucketPath": "etc", "retension": {}}
+		],
+		"s3": {"region": "us-east-1", "bucket": "Invalid_Bucket"},
+		"syncOnStartUp": true
+	}`
+	assert.Nil(t, ioutil.WriteFile(location, []byte(config), 0600), "Should write config")
+
+	report := ValidateConfig(location)
+	assert.False(t, report.Valid, "Should be invalid")
+	problems := make(map[string]shared.ConfigProblem)
+	for _, problem := range report.Problems {
+		problems[problem.Field] = problem
+	}
+	assert.Contains(t, problems, "watchers[1].retension", "Should report unknown keys")
+	assert.NotContains(t, problems, "syncOnStartUp", "Keys are matched without case")
+	assert.Contains(t, problems["watchers[1].bucketPath"].Message, "also used by watchers[0]", "Should report shared bucket paths")
+	assert.True(t, problems["watchers[1].path"].Warning, "Nested watchers are a warning")
+	assert.True(t, strings.HasSuffix(problems["watchers[1]"].Message, "stored as a"), "Should report colliding keys")
+	assert.Contains(t, problems["s3"].Message, "invalid bucket name", "Should check backend options")
+	assert.Contains(t, problems, "s3.credentials", "Should check for credentials")
+
+	// Watchers which share a bucket path would remove each other's objects, so the daemon refuses to start
+	_, err = loadConfig(location)
+	assert.NotNil(t, err, "Should not load")
+	assert.Contains(t, err.Error(), "also used by watchers[0]", "Should reject shared bucket paths")
+
+	// As do watchers of the same path, and files whose keys collide
+	watchers := []shared.Watcher{
+		{Path: dir, BucketPath: "etc"},
+		{Path: nested, BucketPath: "nested"},
+		{Path: dir, BucketPath: "other"},
+	}
+	problems = make(map[string]shared.ConfigProblem)
+	invalid := backends.S3Options{Region: "us-east-1", Bucket: "backups", Tags: map[string]string{"host": "{{.Hostname}}"}}
+	for _, problem := range checkConfig(&shared.BackerConfig{KeyTemplate: "{{.Base}}", Watchers: watchers, AdditionalBackends: []backends.S3Options{invalid}}) {
+		problems[problem.Field] = problem
+	}
+	assert.Contains(t, problems["watchers[2].path"].Message, "already watched by watchers[0]", "Should reject duplicate paths")
+	assert.True(t, strings.HasSuffix(problems["watchers[1]"].Message, "stored as a"), "Should reject colliding keys")
+	assert.Contains(t, problems["s3"].Message, "region is required", "Should check the main backend")
+	assert.Contains(t, problems["backends[0]"].Message, "invalid template for tag host", "Should check every backend")
+
+	report = ValidateConfig(filepath.Join(dir, "missing.json"))
+	assert.False(t, report.Valid, "Missing files are invalid")
+}
@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nickrobison/backer/backends"
+	"github.com/nickrobison/backer/shared"
+)
+
+// daemonState - Running state of the daemon, shared between the RPC handlers and the background tasks
+// Anything which reads the config must hold the read lock or use a snapshot, changes to the config require the write lock
+// The lock is shared with the FileManager, so that it never sees a partially reloaded config
+type daemonState struct {
+	*sync.RWMutex
+	configLocation string
+	config         *shared.BackerConfig
+	manager        *FileManager
+	watcher        *fsnotify.Watcher
+	pruneStop      chan bool
+	reconcileStop  chan bool
+	jobs           syncJobs
+	api            *apiServer
+	// Serializes reloads and changes to the config file, reloads read the file before they take the write lock
+	reloadLock sync.Mutex
+}
+
+// snapshot - Returns a copy of the running config, for work which talks to the backends
+// The lock is only held while copying, so a slow backend doesn't hold up reloads and uploads
+func (d *daemonState) snapshot() *shared.BackerConfig {
+	d.RLock()
+	defer d.RUnlock()
+	config := *d.config
+	config.Watchers = append([]shared.Watcher(nil), d.config.Watchers...)
+	config.Backends = append([]backends.Uploader(nil), d.config.Backends...)
+	return &config
+}
+
+// addWatcher - Start watching a new path, and persist it to the config file
+func (d *daemonState) addWatcher(args *shared.WatchArgs) error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+	path, err := filepath.Abs(args.Path)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(path); err != nil {
+		return err
+	}
+
+	d.Lock()
+	if d.config.HasWatcher(path) {
+		d.Unlock()
+		return errors.New("already watching " + path)
+	}
+
+	err = d.watcher.Add(path)
+	if err != nil {
+		d.Unlock()
+		return err
+	}
+	d.manager.RegisterWatcherPath(path, args.BucketPath)
+	previous := d.config.Watchers
+	d.config.Watchers = append(previous[:len(previous):len(previous)], shared.Watcher{
+		BucketPath: args.BucketPath,
+		Path:       path,
+	})
+	err = d.config.Save(d.configLocation)
+	if err != nil {
+		// Undo the change, so the running config still matches the file
+		d.config.Watchers = previous
+		d.manager.UnregisterWatcherPath(path)
+		if removeErr := d.watcher.Remove(path); removeErr != nil {
+			log.Warnf("Unable to remove watch for %s: %s\n", path, removeErr)
+		}
+		d.Unlock()
+		return err
+	}
+	d.Unlock()
+	log.Printf("Added watcher for %s\n", path)
+
+	// Bring the backends up to date with the new path
+	if args.Sync {
+		d.manager.syncFiles(path, args.BucketPath)
+	}
+	return nil
+}
+
+// removeWatcher - Stop watching a path, and remove it from the config file
+func (d *daemonState) removeWatcher(args *shared.WatchArgs) error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+	path, err := filepath.Abs(args.Path)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	// Fragments belong to whoever installed them, so they'd only bring the watcher back on the next reload
+	for _, watcher := range d.config.Watchers {
+		if watcherPath, err := watcher.GetPath(); err == nil && watcherPath == path && watcher.Source != "" {
+			return errors.New(path + " is defined in " + watcher.Source + ", remove it from there")
+		}
+	}
+	previous := append([]shared.Watcher(nil), d.config.Watchers...)
+	if !d.config.RemoveWatcher(path) {
+		return errors.New("not watching " + path)
+	}
+	// Only stop watching once the file is updated, so the running config still matches it if saving fails
+	if err = d.config.Save(d.configLocation); err != nil {
+		d.config.Watchers = previous
+		return err
+	}
+
+	// The watch is already gone if the path has been deleted
+	err = d.watcher.Remove(path)
+	if err != nil {
+		log.Warnf("Unable to remove watch for %s: %s\n", path, err)
+	}
+	d.manager.UnregisterWatcherPath(path)
+	log.Printf("Removed watcher for %s\n", path)
+	return nil
+}
+
+// watcherPaths - Returns the absolute path of each configured watcher
+func (d *daemonState) watcherPaths() (*shared.FileWatchers, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var watcherPaths = make([]string, len(d.config.Watchers))
+	for i, watcher := range d.config.Watchers {
+		path, err := watcher.GetPath()
+		if err != nil {
+			return nil, err
+		}
+		watcherPaths[i] = path
+	}
+	return &shared.FileWatchers{Paths: watcherPaths}, nil
+}
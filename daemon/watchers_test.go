@@ -0,0 +1,55 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nickrobison/backer/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherChangesNeedSave(t *testing.T) {
+	fm, dir := createFileManager(&MockBackend{})
+	defer os.RemoveAll(dir)
+	fm.RegisterWatcherPath(dir, "test-bucket")
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.Nil(t, err, "Should create watcher")
+	defer watcher.Close()
+
+	// The config can't be written into a directory which doesn't exist
+	state := &daemonState{
+		RWMutex:        fm.configLock,
+		configLocation: filepath.Join(dir, "missing", "config.json"),
+		config:         fm.config,
+		manager:        fm,
+		watcher:        watcher,
+	}
+	watchers := append([]shared.Watcher(nil), fm.config.Watchers...)
+
+	added, err := ioutil.TempDir(dir, "added")
+	assert.Nil(t, err, "Should create directory")
+	err = state.addWatcher(&shared.WatchArgs{Path: added, BucketPath: "added"})
+	assert.NotNil(t, err, "Should fail to save")
+	assert.Equal(t, watchers, fm.config.Watchers, "Should not add the watcher")
+	assert.Equal(t, map[string]string{dir: "test-bucket"}, fm.roots(), "Should not register the watcher")
+
+	err = state.removeWatcher(&shared.WatchArgs{Path: dir})
+	assert.NotNil(t, err, "Should fail to save")
+	assert.Equal(t, watchers, fm.config.Watchers, "Should keep the watcher")
+	assert.Equal(t, map[string]string{dir: "test-bucket"}, fm.roots(), "Should keep watching")
+
+	// Once the file can be written, both changes go through
+	state.configLocation = filepath.Join(dir, "config.json")
+	snapshot := state.snapshot()
+	assert.Nil(t, state.addWatcher(&shared.WatchArgs{Path: added, BucketPath: "added"}), "Should add the watcher")
+	assert.Nil(t, state.removeWatcher(&shared.WatchArgs{Path: dir}), "Should remove the watcher")
+	assert.Equal(t, map[string]string{added: "added"}, fm.roots(), "Should only watch the new path")
+	saved, err := shared.LoadConfig(state.configLocation)
+	assert.Nil(t, err, "Should load the saved config")
+	assert.Equal(t, fm.config.Watchers, saved.Watchers, "Should save the running watchers")
+	assert.Equal(t, watchers, snapshot.Watchers, "Snapshots don't see later changes")
+}
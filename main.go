@@ -6,6 +6,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/nickrobison/backer/daemon"
+	"github.com/nickrobison/backer/shared"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -32,6 +33,7 @@ func main() {
 	// Flags
 	app.Flags = buildFlags()
 	app.Action = parseFlags
+	app.Before = setupOutput
 
 	// Commands
 	app.Commands = buildCommnds()
@@ -54,6 +56,42 @@ func buildFlags() []cli.Flag {
 			Name:  "debug",
 			Usage: "Enabled debug logging",
 		},
+		cli.StringFlag{
+			Name:   "socket",
+			Value:  shared.DefaultSocket,
+			Usage:  "Connect to the daemon's control socket at `PATH`",
+			EnvVar: "BACKER_SOCKET",
+		},
+		cli.StringFlag{
+			Name:   "host",
+			Usage:  "Manage the daemon at `HOST:PORT` over mutual TLS, instead of the local socket",
+			EnvVar: "BACKER_HOST",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "Client certificate `FILE` for --host",
+			EnvVar: "BACKER_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "Private key `FILE` of the client certificate",
+			EnvVar: "BACKER_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca",
+			Usage:  "CA `FILE` used to verify the daemon, defaults to the system roots",
+			EnvVar: "BACKER_TLS_CA",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Give up on commands the daemon hasn't answered within `DURATION`, defaults to waiting",
+		},
+		cli.StringFlag{
+			Name:   "output, o",
+			Value:  outputTable,
+			Usage:  "Print results as `FORMAT`, one of table, json, yaml or csv",
+			EnvVar: "BACKER_OUTPUT",
+		},
 	}
 }
 
@@ -76,18 +114,240 @@ func buildCommnds() []cli.Command {
 					Aliases: []string{"o"},
 					Usage:   "List objects in S3 Bucket",
 					Action:  listObjects,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "metadata, m",
+							Usage: "Show the provenance of each object, this needs a request per object",
+						},
+					},
+				},
+				{
+					Name:      "versions",
+					Aliases:   []string{"v"},
+					Usage:     "List versions for given object",
+					ArgsUsage: "FILE",
+					Action:    listObjectVersions,
+				},
+			},
+		},
+		{
+			Name:  "watch",
+			Usage: "Add or remove watchers without restarting the daemon, changes are saved to the config file",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Start watching a file or directory",
+					ArgsUsage: "PATH",
+					Action:    addWatcher,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "bucket-path",
+							Usage: "Store the files under `NAME` in the bucket, defaults to the base name of the path",
+						},
+						cli.BoolFlag{
+							Name:  "sync",
+							Usage: "Upload any files which are out of sync once the watcher is added",
+						},
+					},
+				},
+				{
+					Name:      "remove",
+					Aliases:   []string{"rm"},
+					Usage:     "Stop watching a file or directory, stored objects are left in place",
+					ArgsUsage: "PATH",
+					Action:    removeWatcher,
+				},
+			},
+		},
+		{
+			Name:   "reload",
+			Usage:  "Re-read the config file and apply any changes, the daemon also reloads on SIGHUP",
+			Action: reloadConfig,
+		},
+		{
+			Name:   "pause",
+			Usage:  "Stop uploading files, changes are queued until uploads are resumed",
+			Action: pauseUploads,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "for",
+					Usage: "Resume automatically after `DURATION`, such as 30m",
+				},
+			},
+		},
+		{
+			Name:   "resume",
+			Usage:  "Start uploading files again, including any which changed while paused",
+			Action: resumeUploads,
+		},
+		{
+			Name:   "status",
+			Usage:  "Show the health of each watcher, backend and queue, exits non-zero if anything is unhealthy",
+			Action: daemonStatus,
+		},
+		{
+			Name:   "events",
+			Usage:  "Show recent steps taken by the upload pipeline",
+			Action: pipelineEvents,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "Keep printing new events as they happen",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print each event as a line of JSON, the same as --output json",
+				},
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "Compare a local file against a stored version, or two stored versions against each other",
+			ArgsUsage: "FILE",
+			Action:    diffFile,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "Stored `VERSION` to compare from, defaults to the latest",
+				},
+				cli.StringFlag{
+					Name:  "against",
+					Usage: "Stored `VERSION` to compare to, defaults to the local file",
+				},
+			},
+		},
+		{
+			Name:      "log",
+			Usage:     "Show the version history of a file",
+			ArgsUsage: "FILE",
+			Action:    fileLog,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "patch, p",
+					Usage: "Show the changes made by each version",
+				},
+				cli.BoolFlag{
+					Name:  "metadata, m",
+					Usage: "Show the provenance of each version, this needs a request per version",
+				},
+			},
+		},
+		{
+			Name:   "migrate",
+			Usage:  "Move the latest version of stored objects from a previous key template to the current one, history stays under the old keys",
+			Action: migrateKeys,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Value: shared.LegacyKeyTemplate,
+					Usage: "Key `TEMPLATE` the objects are currently stored under",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report the objects which would be moved",
+				},
+			},
+		},
+		{
+			Name:      "sync",
+			Usage:     "Upload any files which are missing or out of date, and report stored objects whose local file is gone",
+			ArgsUsage: "[PATH]",
+			Action:    syncFiles,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Sync every watcher",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report the files which would be uploaded",
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Check or display a config file, without a daemon",
+			Subcommands: []cli.Command{
+				{
+					Name:      "validate",
+					Usage:     "Check the config file for errors, exits non-zero if the daemon wouldn't start or would misbehave",
+					ArgsUsage: "[FILE]",
+					Action:    validateConfig,
+				},
+				{
+					Name:      "show",
+					Usage:     "Print the config with every default filled in, and secrets masked",
+					ArgsUsage: "[FILE]",
+					Action:    showConfig,
+				},
+			},
+		},
+		{
+			Name:  "backend",
+			Usage: "Manage the buckets of the backends, without a daemon",
+			Subcommands: []cli.Command{
+				{
+					Name:      "check",
+					Usage:     "Compare the versioning, lifecycle rules and object lock of each bucket with the config, exits non-zero on drift",
+					ArgsUsage: "[FILE]",
+					Action:    checkBackends,
 				},
 				{
-					Name:    "versions",
-					Aliases: []string{"v"},
-					Usage:   "List versions for given object",
-					Action:  listObjectVersions,
+					Name:      "apply",
+					Usage:     "Create the buckets with createBucket set, and apply the lifecycle rules and object lock of the config, object lock can't be undone",
+					ArgsUsage: "[FILE]",
+					Action:    applyBackends,
+				},
+			},
+		},
+		{
+			Name:   "run",
+			Usage:  "Reconcile every watcher with every backend and exit, without a daemon, for cron and CI",
+			Action: runOnce,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "Exit once every watcher has been reconciled",
+				},
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "Load config from `FILE`, defaults to the global --config",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report the files which would be uploaded",
+				},
+				cli.BoolFlag{
+					Name:  "delete-orphans",
+					Usage: "Remove stored objects whose local file is gone, instead of only reporting them",
+				},
+			},
+		},
+		{
+			Name:   "prune",
+			Usage:  "Remove object versions which fall outside of the retention policies",
+			Action: pruneVersions,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report the versions which would be removed",
 				},
 			},
 		},
 	}
 }
 
+// setupOutput - Check the output format, keeping log messages out of machine readable output
+func setupOutput(c *cli.Context) error {
+	if err := checkOutput(c); err != nil {
+		return err
+	}
+	if !humanOutput(c) {
+		log.SetOutput(os.Stderr)
+	}
+	return nil
+}
+
 func parseFlags(c *cli.Context) error {
 	// Enable debug log output
 	if c.Bool("debug") {
@@ -97,7 +357,7 @@ func parseFlags(c *cli.Context) error {
 	// Start daemon
 	if c.Bool("daemon") {
 		log.Println("Launching daemon")
-		daemon.Start(c.String("config"))
+		daemon.Start(c.String("config"), Version)
 	} else {
 		rpcClient = &RPC{}
 	}
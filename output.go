@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/nickrobison/backer/client"
+	"github.com/olekukonko/tablewriter"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats accepted by --output
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+)
+
+// Exit codes, so scripts can tell a problem the command found from a command which couldn't run
+const (
+	exitProblems    = 1 // The command ran, and found something wrong, such as failed uploads or an unhealthy daemon
+	exitUsage       = 2 // The command line was invalid
+	exitUnreachable = 3 // The daemon couldn't be reached, or speaks another protocol version
+	exitFailed      = 4 // The daemon was reached, but couldn't carry out the command
+)
+
+// table - Header and rows of a single table, for the table and CSV formats
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+func newTable(header ...string) *table {
+	return &table{header: header}
+}
+
+func (t *table) append(row ...string) {
+	t.rows = append(t.rows, row)
+}
+
+// checkOutput - Make sure the format given with --output is one we know
+func checkOutput(c *cli.Context) error {
+	switch c.GlobalString("output") {
+	case outputTable, outputJSON, outputYAML, outputCSV:
+		return nil
+	}
+	return cli.NewExitError("Unknown output format: "+c.GlobalString("output"), exitUsage)
+}
+
+// humanOutput - Whether to print tables and messages meant for people, rather than scripts
+func humanOutput(c *cli.Context) bool {
+	return c.GlobalString("output") == outputTable
+}
+
+// printResult - Print the result of a command in the format chosen with --output
+// JSON and YAML print the reply itself, with the same field names as the HTTP API. Tables and CSV print the given tables
+func printResult(c *cli.Context, reply interface{}, tables ...*table) error {
+	switch c.GlobalString("output") {
+	case outputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reply)
+	case outputYAML:
+		return printYAML(reply)
+	case outputCSV:
+		writer := csv.NewWriter(os.Stdout)
+		for i, t := range tables {
+			// Separate tables with an empty line
+			if i > 0 {
+				writer.Write([]string{})
+			}
+			writer.Write(t.header)
+			writer.WriteAll(t.rows)
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		for _, t := range tables {
+			writer := tablewriter.NewWriter(os.Stdout)
+			writer.SetHeader(t.header)
+			writer.AppendBulk(t.rows)
+			writer.Render()
+		}
+		return nil
+	}
+}
+
+// flatten - Turn a nested value into a table of settings and their values, keyed by their JSON path
+func flatten(value interface{}) (*table, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+	table := newTable("Key", "Value")
+	flattenInto(table, "", decoded)
+	return table, nil
+}
+
+func flattenInto(t *table, path string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			flattenInto(t, child, value[key])
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			t.append(path, "")
+		}
+		for idx, element := range value {
+			flattenInto(t, fmt.Sprintf("%s[%d]", path, idx), element)
+		}
+	case nil:
+		t.append(path, "")
+	default:
+		t.append(path, fmt.Sprint(value))
+	}
+}
+
+// printYAML - Print the reply as YAML, going through JSON so the field names match
+func printYAML(reply interface{}) error {
+	encoded, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err = yaml.Unmarshal(encoded, &value); err != nil {
+		return err
+	}
+	encoded, err = yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(encoded)
+	return err
+}
+
+// printMessage - Print a message for people, which scripts don't need
+func printMessage(c *cli.Context, format string, args ...interface{}) {
+	if humanOutput(c) {
+		fmt.Printf(format, args...)
+	}
+}
+
+// daemonError - Exit with the code for a failed call to the daemon
+func daemonError(err error) error {
+	return cli.NewExitError(err.Error(), exitCode(err))
+}
+
+// exitCode - Whether the daemon refused the call, or couldn't be reached at all
+func exitCode(err error) int {
+	if client.IsServerError(err) {
+		return exitFailed
+	}
+	return exitUnreachable
+}
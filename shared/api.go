@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// APIVersion - Version of the HTTP API, which prefixes every path
+const APIVersion = "v1"
+
+// APIConfig - Optional loopback TCP listener for the HTTP API
+// The API is always available on the control socket
+type APIConfig struct {
+	Listen    string `json:"listen"`    // Loopback address to listen on, such as 127.0.0.1:7117
+	Access    string `json:"access"`    // Access granted to TCP clients, either read (the default) or write
+	TokenFile string `json:"tokenFile"` // File holding the bearer token TCP clients have to send, only readable by its owner
+}
+
+// Validate - Ensure that the listener is only reachable from this machine
+func (a *APIConfig) Validate() error {
+	switch a.Access {
+	case "", "read", "write":
+	default:
+		return errors.New("API access must be read or write")
+	}
+	if a.Listen == "" {
+		return nil
+	}
+	if a.TokenFile == "" {
+		return errors.New("API needs a token file to listen on " + a.Listen)
+	}
+	host, _, err := net.SplitHostPort(a.Listen)
+	if err != nil {
+		return err
+	}
+	if !IsLoopbackHost(host) {
+		return errors.New("API must listen on a loopback address, not " + a.Listen)
+	}
+	return nil
+}
+
+// ReadToken - Returns the bearer token, as long as nobody but the owner of the file can read it
+func (a *APIConfig) ReadToken() (string, error) {
+	info, err := os.Stat(a.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("API token file %s can be read by other users, it needs to be 0600", a.TokenFile)
+	}
+	data, err := ioutil.ReadFile(a.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("API token file %s is empty", a.TokenFile)
+	}
+	return token, nil
+}
+
+// IsLoopbackHost - Returns whether or not the host name or address only refers to this machine
+func IsLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// APIError - Body of every unsuccessful API response
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// APISchema - Description of every operation supported by the API
+type APISchema struct {
+	Version    string         `json:"version"`
+	Operations []APIOperation `json:"operations"`
+}
+
+// APIOperation - A single operation, its arguments are sent as the JSON body of a POST
+// Operations without arguments can also be called with GET
+type APIOperation struct {
+	Name    string      `json:"name"`
+	Path    string      `json:"path"`
+	Methods []string    `json:"methods"`
+	Args    *TypeSchema `json:"args,omitempty"`
+	Result  *TypeSchema `json:"result"`
+}
+
+// TypeSchema - JSON schema of a request or response body
+type TypeSchema struct {
+	Type        string                 `json:"type"`
+	Format      string                 `json:"format,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Properties  map[string]*TypeSchema `json:"properties,omitempty"`
+	Items       *TypeSchema            `json:"items,omitempty"`
+}
@@ -1,8 +1,29 @@
 package shared
 
+import (
+	"time"
+
+	"github.com/nickrobison/backer/backends"
+)
+
+// ProtocolVersion - Version of the RPC types in this package
+// Bump it whenever a change would break clients built against an earlier version
+const ProtocolVersion = 2
+
+// VersionArgs - Identifies the client to the daemon
+type VersionArgs struct {
+	Protocol int
+}
+
+// VersionInfo - Protocol and release of the daemon
+type VersionInfo struct {
+	Protocol int
+	Backer   string
+}
+
 // Args - simple args struct
 type Args struct {
-	objectKey string
+	Path string
 }
 
 // FileWatchers - List of current file paths
@@ -10,15 +31,295 @@ type FileWatchers struct {
 	Paths []string
 }
 
+// ObjectInfo - The current version of a stored object, along with its provenance
+type ObjectInfo struct {
+	backends.ObjectMetadata
+	Backend      string
+	Key          string
+	VersionID    string
+	LastModified time.Time
+	Size         int64
+}
+
+// ListArgs - Arguments for listing the stored objects
+type ListArgs struct {
+	Metadata bool // Fetch the provenance of each object, which costs a request per object
+}
+
+// ObjectList - All the objects stored by the watchers
+type ObjectList struct {
+	Objects []ObjectInfo
+}
+
 // BucketObjects - An object and its given versions
 type BucketObjects struct {
 	Key     string
 	Version []string
 }
 
+// PruneArgs - Arguments for enforcing the retention policies
+type PruneArgs struct {
+	DryRun bool
+}
+
+// PrunedVersion - An object version which has been (or would be) removed by the retention policies
+type PrunedVersion struct {
+	Backend      string
+	Key          string
+	VersionID    string
+	LastModified time.Time
+	DeleteMarker bool
+}
+
+// PruneResult - Versions removed while enforcing the retention policies
+type PruneResult struct {
+	DryRun   bool
+	Versions []PrunedVersion
+}
+
+// DiffArgs - Arguments for comparing a file against its stored versions
+// An empty FromVersion refers to the latest remote copy, an empty ToVersion refers to the local file
+type DiffArgs struct {
+	Path        string
+	FromVersion string
+	ToVersion   string
+}
+
+// DiffResult - Unified diff between two copies of a file
+// Binary files are only summarised
+type DiffResult struct {
+	From    string
+	To      string
+	Binary  bool
+	Changed bool
+	Diff    string
+	Summary string
+}
+
+// LogArgs - Arguments for retrieving the version history of a file
+type LogArgs struct {
+	Path     string
+	Patch    bool
+	Metadata bool // Fetch the provenance of each version, which costs a request per version. Patches always include it
+}
+
+// FileVersion - A single entry in the version history of a file
+type FileVersion struct {
+	backends.ObjectMetadata
+	VersionID    string
+	LastModified time.Time
+	Size         int64
+	IsLatest     bool
+	DeleteMarker bool
+	Patch        string
+}
+
+// FileLog - Version history of a file, newest first
+type FileLog struct {
+	Path     string
+	Backend  string
+	Versions []FileVersion
+}
+
+// MigrateArgs - Arguments for moving objects from a previous key template to the current one
+type MigrateArgs struct {
+	FromTemplate string
+	DryRun       bool
+}
+
+// KeyMove - A single object moved to the current key layout
+type KeyMove struct {
+	Backend  string
+	Path     string
+	From     string
+	To       string
+	Versions int    // Number of versions moved
+	Error    string // Set when the object was left under its previous key, in part or in full
+}
+
+// MigrateResult - Objects moved to the current key layout
+type MigrateResult struct {
+	DryRun bool
+	Moves  []KeyMove
+}
+
+// WatcherStatus - Health of a single watcher
+type WatcherStatus struct {
+	Path          string
+	BucketPath    string
+	Alive         bool
+	Healthy       bool
+	FileCount     int
+	LastSync      time.Time
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// BackendStatus - Health of a single backend
+type BackendStatus struct {
+	Name             string
+	Healthy          bool
+	InFlight         int
+	BytesTransferred int64
+	LastSuccess      time.Time
+	LastError        string
+	LastErrorTime    time.Time
+}
+
+// QueueStatus - Number of events waiting in a queue
+type QueueStatus struct {
+	Name  string
+	Depth int
+}
+
+// StatusReport - Health of the daemon, Healthy is false if any watcher or backend is unhealthy
+type StatusReport struct {
+	Healthy        bool
+	Watchers       []WatcherStatus
+	Backends       []BackendStatus
+	Queues         []QueueStatus
+	EventOverflows int       // Number of times the kernel dropped file events
+	LastReconcile  time.Time // When every watcher was last compared with the backends
+	Paused         bool      // Uploads are paused, events are queued until they're resumed
+	PausedUntil    time.Time // When a timed pause will end, zero if it lasts until resumed
+}
+
+// WatchArgs - Arguments for adding or removing a watcher at runtime
+type WatchArgs struct {
+	Path       string
+	BucketPath string
+	Sync       bool
+}
+
+// ReloadResult - Changes applied by reloading the config file
+type ReloadResult struct {
+	Added    []string // Newly watched paths
+	Removed  []string // Paths which are no longer watched
+	Updated  []string // Paths whose bucket path changed
+	Backends bool     // Whether or not the backends were rebuilt
+}
+
+// Results of reconciling a single file with a single backend
+const (
+	SyncUploaded  = "uploaded"
+	SyncUnchanged = "unchanged"
+	SyncFailed    = "failed"
+	SyncOrphaned  = "orphaned" // Stored object whose local file no longer exists
+	SyncDeleted   = "deleted"  // Orphaned object which has been removed from the backend
+)
+
+// SyncArgs - Arguments for reconciling local files with the backends
+type SyncArgs struct {
+	Path   string // File, directory or watcher root to reconcile
+	All    bool   // Reconcile every watcher
+	DryRun bool   // Only report what would change
+}
+
+// SyncJob - Handle to a running reconciliation
+type SyncJob struct {
+	ID string
+}
+
+// SyncProgressArgs - Request the results of a reconciliation, starting at the given offset
+type SyncProgressArgs struct {
+	ID     string
+	Offset int
+}
+
+// SyncFile - Result of reconciling a single file with a single backend
+type SyncFile struct {
+	Backend string
+	Path    string // Empty for orphaned objects
+	Key     string
+	Status  string
+	Error   string
+}
+
+// SyncSummary - Number of files with each result
+type SyncSummary struct {
+	Uploaded  int
+	Unchanged int
+	Failed    int
+	Orphaned  int
+}
+
+// SyncProgress - Results of a reconciliation since the requested offset
+type SyncProgress struct {
+	Files   []SyncFile
+	Done    bool
+	DryRun  bool
+	Summary SyncSummary
+}
+
+// Stages of the upload pipeline reported by the event feed
+const (
+	EventReceived    = "received"    // File event from the kernel
+	EventFiltered    = "filtered"    // File event which was ignored
+	EventBatched     = "batched"     // Coalesced event which has left the backlog
+	EventChecksummed = "checksummed" // File has been hashed
+	EventUploaded    = "uploaded"    // File has been stored by a backend
+	EventFailed      = "failed"      // Operation against a backend failed
+	EventDeleted     = "deleted"     // File has been removed from a backend
+)
+
+// PipelineEvent - A single step taken by the daemon while handling a file
+type PipelineEvent struct {
+	Seq      uint64        `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Stage    string        `json:"stage"`
+	Path     string        `json:"path"`
+	Backend  string        `json:"backend,omitempty"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// EventWait - How long a follower waits for new events before it's sent an empty batch
+const EventWait = 30 * time.Second
+
+// EventsArgs - Request the pipeline events after the given sequence number
+// Wait blocks until there's at least one new event, or the daemon gives up waiting
+type EventsArgs struct {
+	After uint64
+	Wait  bool
+}
+
+// EventBatch - Pipeline events, oldest first
+type EventBatch struct {
+	Events []PipelineEvent
+	Last   uint64 // Sequence number of the latest event, whether or not it was returned
+	Missed uint64 // Number of requested events which have already fallen out of the history
+}
+
+// PauseArgs - Arguments for pausing uploads, a zero duration pauses until resumed
+type PauseArgs struct {
+	Duration time.Duration
+}
+
+// PauseStatus - Whether or not uploads are paused, along with the number of queued events
+type PauseStatus struct {
+	Paused bool
+	Until  time.Time
+	Queued int
+}
+
 // CLICommunication - basic interface for communicating between the cli and the backend
 type CLICommunication interface {
+	Version(args *VersionArgs, info *VersionInfo) error
 	ListWatchers(args int, watchers *FileWatchers) error
-	ListObjects(objects *[]BucketObjects) error
+	ListObjects(args *ListArgs, objects *ObjectList) error
 	ListObjectVersions(args *Args, object *BucketObjects) error
+	Prune(args *PruneArgs, result *PruneResult) error
+	Diff(args *DiffArgs, result *DiffResult) error
+	Log(args *LogArgs, result *FileLog) error
+	MigrateKeys(args *MigrateArgs, result *MigrateResult) error
+	Status(args int, report *StatusReport) error
+	AddWatcher(args *WatchArgs, watchers *FileWatchers) error
+	RemoveWatcher(args *WatchArgs, watchers *FileWatchers) error
+	Reload(args int, result *ReloadResult) error
+	Sync(args *SyncArgs, job *SyncJob) error
+	SyncProgress(args *SyncProgressArgs, progress *SyncProgress) error
+	Events(args *EventsArgs, batch *EventBatch) error
+	Pause(args *PauseArgs, status *PauseStatus) error
+	Resume(args int, status *PauseStatus) error
 }
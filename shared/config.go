@@ -1,8 +1,13 @@
 package shared
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/nickrobison/backer/backends"
 )
@@ -15,10 +20,21 @@ func (e *pathError) Error() string {
 	return "Resource: " + e.location + " does not exist"
 }
 
+type notWatchedError struct {
+	location string
+}
+
+func (e *notWatchedError) Error() string {
+	return "Resource: " + e.location + " is not watched"
+}
+
 // Watcher - Configuration struct for watching a specific file path
 type Watcher struct {
-	BucketPath string `json:"bucketPath"`
-	Path       string `json:"path"`
+	BucketPath   string                    `json:"bucketPath"`
+	Path         string                    `json:"path"`
+	Retention    *backends.RetentionPolicy `json:"retention,omitempty"`
+	StorageClass string                    `json:"storageClass,omitempty"` // Overrides the storage class of every backend
+	Source       string                    `json:"-"`                      // Fragment which defined the watcher, empty for the main config file
 }
 
 // GetPath - Returns the absolute Path of the Watcher
@@ -33,12 +49,21 @@ func (w *Watcher) GetPath() (string, error) {
 
 // BackerConfig - Main configuration struct
 type BackerConfig struct {
-	SyncOnStartup    bool               `json:"syncOnStartup"`
-	DeleteOnRemove   bool               `json:"deleteOnRemove"`
-	DeleteOnShutdown bool               `json:"deleteOnShutdown"`
-	Watchers         []Watcher          `json:"watchers"`
-	S3               backends.S3Options `json:"s3"`
-	Backends         []backends.Uploader
+	SyncOnStartup      bool                 `json:"syncOnStartup"`
+	DeleteOnRemove     bool                 `json:"deleteOnRemove"`
+	DeleteOnShutdown   bool                 `json:"deleteOnShutdown"`
+	PruneInterval      string               `json:"pruneInterval"`
+	ReconcileInterval  string               `json:"reconcileInterval"`
+	KeyTemplate        string               `json:"keyTemplate"`
+	Watchers           []Watcher            `json:"watchers"`
+	S3                 backends.S3Options   `json:"s3"`
+	AdditionalBackends []backends.S3Options `json:"backends"` // Further buckets which every file is uploaded to
+	Include            string               `json:"include"`  // Directory of fragments which add watchers and backends, defaults to conf.d
+	Socket             SocketConfig         `json:"socket"`
+	API                APIConfig            `json:"api"`
+	Remote             RemoteConfig         `json:"remote"`
+	Backends           []backends.Uploader  `json:"-"`
+	Keys               *KeyBuilder          `json:"-"`
 }
 
 // ValidateWatcherPaths - Ensure that each path in the config file is valid and exists
@@ -58,3 +83,215 @@ func (c *BackerConfig) ValidateWatcherPaths() error {
 	}
 	return nil
 }
+
+// FindWatcher - Returns the Watcher responsible for the given file path
+func (c *BackerConfig) FindWatcher(file string) (*Watcher, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range c.Watchers {
+		path, err := c.Watchers[idx].GetPath()
+		if err != nil {
+			return nil, err
+		}
+		if file == path || strings.HasPrefix(file, path+string(filepath.Separator)) {
+			return &c.Watchers[idx], nil
+		}
+	}
+	return nil, &notWatchedError{
+		location: file,
+	}
+}
+
+// ObjectKey - Returns the object key of the given file, using the key template of the config
+func (c *BackerConfig) ObjectKey(file string) (string, error) {
+	watcher, err := c.FindWatcher(file)
+	if err != nil {
+		return "", err
+	}
+	root, err := watcher.GetPath()
+	if err != nil {
+		return "", err
+	}
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	return c.Keys.ObjectKey(root, watcher.BucketPath, file)
+}
+
+// GetPruneInterval - Returns how often the daemon should enforce the retention policies, zero means never
+func (c *BackerConfig) GetPruneInterval() (time.Duration, error) {
+	if c.PruneInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.PruneInterval)
+}
+
+// GetReconcileInterval - Returns how often the daemon should compare every watcher with the backends, zero means never
+func (c *BackerConfig) GetReconcileInterval() (time.Duration, error) {
+	if c.ReconcileInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.ReconcileInterval)
+}
+
+// Save - Atomically write the watchers back to the config file, in the format it's written in
+// Watchers from fragments aren't saved, and the rest of the file is kept as written, without expanding any variables.
+// The file is decoded and encoded again, so comments are lost and keys are sorted.
+// The file is written to a temporary file in the same directory, which then replaces the original
+func (c *BackerConfig) Save(location string) error {
+	tree, err := decodeConfigFile(location)
+	if err != nil {
+		if _, statErr := os.Stat(location); !os.IsNotExist(statErr) {
+			return err
+		}
+		tree = make(map[string]interface{})
+	}
+
+	var watchers []Watcher
+	for _, watcher := range c.Watchers {
+		if watcher.Source == "" {
+			watchers = append(watchers, watcher)
+		}
+	}
+	// Keys are matched without case when loading, so replace whichever spelling is there
+	for key := range tree {
+		if strings.EqualFold(key, "watchers") {
+			delete(tree, key)
+		}
+	}
+	encoded, err := json.Marshal(watchers)
+	if err != nil {
+		return err
+	}
+	var watcherTree []interface{}
+	if err = json.Unmarshal(encoded, &watcherTree); err != nil {
+		return err
+	}
+	tree["watchers"] = watcherTree
+
+	data, err := encodeConfigFile(location, tree)
+	if err != nil {
+		return err
+	}
+
+	// Keep the permissions of the existing file, it may contain credentials
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(location); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(location), "."+filepath.Base(location)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), location)
+}
+
+// Shown in place of secrets
+const maskedSecret = "********"
+
+// Resolved - Returns a copy of the config with every default filled in and secrets masked, for display
+func (c *BackerConfig) Resolved() *BackerConfig {
+	resolved := *c
+	if resolved.KeyTemplate == "" {
+		resolved.KeyTemplate = DefaultKeyTemplate
+	}
+	if resolved.Include == "" {
+		resolved.Include = DefaultInclude
+	}
+
+	resolved.Watchers = make([]Watcher, len(c.Watchers))
+	for idx, watcher := range c.Watchers {
+		if path, err := watcher.GetPath(); err == nil {
+			watcher.Path = path
+		}
+		if watcher.Retention == nil {
+			watcher.Retention = c.S3.Retention
+		}
+		resolved.Watchers[idx] = watcher
+	}
+
+	maskBackend(&resolved.S3)
+	resolved.AdditionalBackends = append([]backends.S3Options(nil), c.AdditionalBackends...)
+	for idx := range resolved.AdditionalBackends {
+		maskBackend(&resolved.AdditionalBackends[idx])
+	}
+
+	resolved.Socket.Path = c.Socket.GetPath()
+	if mode, err := c.Socket.GetMode(); err == nil {
+		resolved.Socket.Mode = fmt.Sprintf("%04o", mode)
+	}
+	if resolved.Socket.AllowUnidentified == "" {
+		resolved.Socket.AllowUnidentified = "none"
+	}
+	if resolved.API.Access == "" {
+		resolved.API.Access = "read"
+	}
+	return &resolved
+}
+
+// maskBackend - Mask the secrets of a copied backend, without touching the original
+func maskBackend(options *backends.S3Options) {
+	credentials := &options.Credentials
+	if len(credentials.AccessKeyID) > 4 {
+		credentials.AccessKeyID = credentials.AccessKeyID[:4] + maskedSecret
+	}
+	credentials.SecretAccessKey = maskSecret(credentials.SecretAccessKey)
+	credentials.SessionToken = maskSecret(credentials.SessionToken)
+	if options.Encryption != nil {
+		encryption := *options.Encryption
+		encryption.CustomerKey = maskSecret(encryption.CustomerKey)
+		options.Encryption = &encryption
+	}
+}
+
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return maskedSecret
+}
+
+// HasWatcher - Returns whether or not a watcher is registered for exactly the given path
+func (c *BackerConfig) HasWatcher(path string) bool {
+	return c.watcherIndex(path) != -1
+}
+
+// RemoveWatcher - Remove the watcher registered for the given path, returns false if there isn't one
+func (c *BackerConfig) RemoveWatcher(path string) bool {
+	idx := c.watcherIndex(path)
+	if idx == -1 {
+		return false
+	}
+	c.Watchers = append(c.Watchers[:idx], c.Watchers[idx+1:]...)
+	return true
+}
+
+func (c *BackerConfig) watcherIndex(path string) int {
+	for idx := range c.Watchers {
+		watcherPath, err := c.Watchers[idx].GetPath()
+		if err == nil && watcherPath == path {
+			return idx
+		}
+	}
+	return -1
+}
@@ -0,0 +1,93 @@
+package shared
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveWatchers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backer-config")
+	assert.Nil(t, err, "Should create temp dir")
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(location, []byte("{}"), 0640)
+	assert.Nil(t, err, "Should write config")
+
+	config := &BackerConfig{
+		Watchers: []Watcher{
+			{BucketPath: "first", Path: "/tmp/first"},
+			{BucketPath: "second", Path: "/tmp/second"},
+		},
+	}
+	assert.True(t, config.HasWatcher("/tmp/first"), "Should have first watcher")
+	assert.False(t, config.RemoveWatcher("/tmp/missing"), "Should not remove unknown watcher")
+	assert.True(t, config.RemoveWatcher("/tmp/first"), "Should remove first watcher")
+	assert.False(t, config.HasWatcher("/tmp/first"), "Should no longer have first watcher")
+	_, err = config.FindWatcher("/tmp/first/file")
+	assert.EqualError(t, err, "Resource: /tmp/first/file is not watched", "Should say the file isn't watched")
+
+	err = config.Save(location)
+	assert.Nil(t, err, "Should save config")
+
+	info, err := os.Stat(location)
+	assert.Nil(t, err, "Should stat config")
+	assert.Equal(t, os.FileMode(0640), info.Mode(), "Should keep the file mode")
+
+	data, err := ioutil.ReadFile(location)
+	assert.Nil(t, err, "Should read config")
+	var saved BackerConfig
+	err = json.Unmarshal(data, &saved)
+	assert.Nil(t, err, "Should parse saved config")
+	assert.Equal(t, config.Watchers, saved.Watchers, "Should save the remaining watchers")
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "Should not leave temp files behind")
+}
+
+func TestAPIConfig(t *testing.T) {
+	assert.Nil(t, (&APIConfig{}).Validate(), "Should allow the API to be disabled")
+	assert.Nil(t, (&APIConfig{Listen: "127.0.0.1:7117", Access: "write", TokenFile: "token"}).Validate(), "Should allow loopback addresses")
+	assert.Nil(t, (&APIConfig{Listen: "[::1]:7117", TokenFile: "token"}).Validate(), "Should allow IPv6 loopback")
+	assert.NotNil(t, (&APIConfig{Listen: "0.0.0.0:7117", TokenFile: "token"}).Validate(), "Should reject public addresses")
+	assert.NotNil(t, (&APIConfig{Listen: "127.0.0.1:7117"}).Validate(), "Should need a token")
+	assert.NotNil(t, (&APIConfig{Access: "admin"}).Validate(), "Should reject unknown access")
+
+	dir, err := ioutil.TempDir("", "backer-config")
+	assert.Nil(t, err, "Should create temp dir")
+	defer os.RemoveAll(dir)
+	api := &APIConfig{TokenFile: filepath.Join(dir, "token")}
+	assert.Nil(t, ioutil.WriteFile(api.TokenFile, []byte("secret\n"), 0644), "Should write the token")
+	_, err = api.ReadToken()
+	assert.NotNil(t, err, "Should reject tokens other users can read")
+	assert.Nil(t, os.Chmod(api.TokenFile, 0600), "Should restrict the token")
+	token, err := api.ReadToken()
+	assert.Nil(t, err, "Should read the token")
+	assert.Equal(t, "secret", token, "Should trim the token")
+}
+
+func TestResolvedConfig(t *testing.T) {
+	config := &BackerConfig{
+		Watchers: []Watcher{{Path: ".", BucketPath: "here"}},
+	}
+	config.S3.Credentials.AccessKeyID = "AKIAEXAMPLE"
+	config.S3.Credentials.SecretAccessKey = "secret"
+
+	resolved := config.Resolved()
+	assert.Equal(t, DefaultKeyTemplate, resolved.KeyTemplate, "Should fill in the key template")
+	assert.Equal(t, DefaultSocket, resolved.Socket.Path, "Should fill in the socket")
+	assert.Equal(t, "0660", resolved.Socket.Mode, "Should fill in the socket mode")
+	assert.Equal(t, "none", resolved.Socket.AllowUnidentified, "Should fill in the access of unidentified peers")
+	assert.Equal(t, "read", resolved.API.Access, "Should fill in the API access")
+	assert.True(t, filepath.IsAbs(resolved.Watchers[0].Path), "Should resolve watcher paths")
+	assert.Equal(t, "AKIA"+maskedSecret, resolved.S3.Credentials.AccessKeyID, "Should mask the access key")
+	assert.Equal(t, maskedSecret, resolved.S3.Credentials.SecretAccessKey, "Should mask the secret")
+	assert.Equal(t, "", resolved.S3.Credentials.SessionToken, "Should leave empty secrets empty")
+	assert.Equal(t, "secret", config.S3.Credentials.SecretAccessKey, "Should leave the original alone")
+	assert.Equal(t, ".", config.Watchers[0].Path, "Should leave the original watchers alone")
+}
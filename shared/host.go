@@ -0,0 +1,20 @@
+package shared
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// Locations of the systemd/dbus machine ID, in order of preference
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// GetMachineID - Returns the unique ID of this machine, or an empty string if it can't be determined
+func GetMachineID() string {
+	for _, file := range machineIDFiles {
+		id, err := ioutil.ReadFile(file)
+		if err == nil {
+			return strings.TrimSpace(string(id))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HostKeyTemplate - Host scoped layout, so that multiple hosts can safely share a bucket
+const HostKeyTemplate = "{{.Host}}/{{.Watcher}}/{{.RelPath}}"
+
+// LegacyKeyTemplate - Layout used before key templates were configurable
+const LegacyKeyTemplate = "{{.Watcher}}/{{.Base}}"
+
+// DefaultKeyTemplate - Used when the config doesn't set a template
+// Buckets written by earlier versions have to be migrated, or set the legacy template explicitly
+const DefaultKeyTemplate = HostKeyTemplate
+
+// Placeholder used to find the part of a key which is shared by every file of a watcher
+const prefixSentinel = "\x00"
+
+// KeyVariables - Variables available to key templates
+type KeyVariables struct {
+	Host      string // Hostname of this machine
+	MachineID string // Unique ID of this machine
+	Watcher   string // Bucket path of the watcher
+	RelPath   string // Path of the file, relative to the watcher root
+	AbsPath   string // Absolute path of the file, without the leading slash
+	Base      string // File name
+}
+
+// KeyBuilder - Builds object keys from the configured key template
+type KeyBuilder struct {
+	template  *template.Template
+	host      string
+	machineID string
+}
+
+// NewKeyBuilder - Parse the key template, an empty template uses the DefaultKeyTemplate
+func NewKeyBuilder(keyTemplate string) (*KeyBuilder, error) {
+	if keyTemplate == "" {
+		keyTemplate = DefaultKeyTemplate
+	}
+	tmpl, err := template.New("key").Parse(keyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		log.Warnln("Unable to determine hostname:", err)
+	}
+
+	return &KeyBuilder{
+		template:  tmpl,
+		host:      host,
+		machineID: GetMachineID(),
+	}, nil
+}
+
+// ObjectKey - Returns the object key for a file belonging to the watcher with the given root and name
+func (k *KeyBuilder) ObjectKey(root string, watcher string, file string) (string, error) {
+	relPath := filepath.Base(file)
+	if root != file {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return "", err
+		}
+		relPath = rel
+	}
+
+	key, err := k.render(KeyVariables{
+		Host:      k.host,
+		MachineID: k.machineID,
+		Watcher:   watcher,
+		RelPath:   filepath.ToSlash(relPath),
+		AbsPath:   strings.TrimPrefix(filepath.ToSlash(file), "/"),
+		Base:      filepath.Base(file),
+	})
+	if err != nil {
+		return "", err
+	}
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	if key == "" {
+		return "", errors.New("key template produced an empty key for " + file)
+	}
+	return key, nil
+}
+
+// WatcherPrefix - Returns the key prefix shared by every file of the watcher, may be empty
+func (k *KeyBuilder) WatcherPrefix(watcher string) (string, error) {
+	key, err := k.render(KeyVariables{
+		Host:      k.host,
+		MachineID: k.machineID,
+		Watcher:   watcher,
+		RelPath:   prefixSentinel,
+		AbsPath:   prefixSentinel,
+		Base:      prefixSentinel,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Only keep the directories before the first file specific variable
+	if idx := strings.Index(key, prefixSentinel); idx != -1 {
+		key = key[:idx]
+	}
+	if idx := strings.LastIndex(key, "/"); idx != -1 {
+		return strings.TrimPrefix(path.Clean("/"+key[:idx]), "/"), nil
+	}
+	return "", nil
+}
+
+func (k *KeyBuilder) render(variables KeyVariables) (string, error) {
+	var buffer bytes.Buffer
+	err := k.template.Execute(&buffer, variables)
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
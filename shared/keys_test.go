@@ -0,0 +1,52 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyTemplates(t *testing.T) {
+	keys, err := NewKeyBuilder(HostKeyTemplate)
+	assert.Nil(t, err, "Should parse the host template")
+	keys.host = "web-1"
+
+	key, err := keys.ObjectKey("/etc/nginx", "nginx", "/etc/nginx/nginx.conf")
+	assert.Nil(t, err, "Should build the key")
+	assert.Equal(t, "web-1/nginx/nginx.conf", key, "Should be host scoped")
+
+	// Watchers of a single file use the file name
+	key, err = keys.ObjectKey("/etc/hosts", "hosts", "/etc/hosts")
+	assert.Nil(t, err, "Should build the key")
+	assert.Equal(t, "web-1/hosts/hosts", key, "Should use the file name")
+
+	prefix, err := keys.WatcherPrefix("nginx")
+	assert.Nil(t, err, "Should build the prefix")
+	assert.Equal(t, "web-1/nginx", prefix, "Should stop before the file path")
+
+	defaults, err := NewKeyBuilder("")
+	assert.Nil(t, err, "Should parse the default template")
+	defaults.host = "web-1"
+	key, err = defaults.ObjectKey("/etc/nginx", "nginx", "/etc/nginx/nginx.conf")
+	assert.Nil(t, err, "Should build the key")
+	assert.Equal(t, "web-1/nginx/nginx.conf", key, "Should default to the host scoped layout")
+
+	legacy, err := NewKeyBuilder(LegacyKeyTemplate)
+	assert.Nil(t, err, "Should parse the legacy template")
+	key, err = legacy.ObjectKey("/etc/nginx", "nginx", "/etc/nginx/nginx.conf")
+	assert.Nil(t, err, "Should build the key")
+	assert.Equal(t, "nginx/nginx.conf", key, "Should use the old layout")
+
+	absolute, err := NewKeyBuilder("{{.MachineID}}{{.AbsPath}}")
+	assert.Nil(t, err, "Should parse the template")
+	absolute.machineID = "abc/"
+	key, err = absolute.ObjectKey("/etc/nginx", "nginx", "/etc/nginx/nginx.conf")
+	assert.Nil(t, err, "Should build the key")
+	assert.Equal(t, "abc/etc/nginx/nginx.conf", key, "Should use the absolute path")
+	prefix, err = absolute.WatcherPrefix("nginx")
+	assert.Nil(t, err, "Should build the prefix")
+	assert.Equal(t, "abc", prefix, "Should stop before the file path")
+
+	_, err = NewKeyBuilder("{{.Missing")
+	assert.NotNil(t, err, "Should fail to parse")
+}
@@ -0,0 +1,261 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nickrobison/backer/backends"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultInclude - Directory of config fragments, relative to the main config file
+const DefaultInclude = "conf.d"
+
+// Config file formats, picked by the extension of the file
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// ${ENV_VAR} or ${file:/path}, $${ is a literal ${
+var configVariable = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// configFragment - The settings a file in the include directory may add to the config
+type configFragment struct {
+	Watchers []Watcher            `json:"watchers"`
+	Backends []backends.S3Options `json:"backends"`
+}
+
+// LoadConfig - Read a config file, along with any fragments in its include directory
+// Variables in the files are expanded, but the config isn't validated
+func LoadConfig(location string) (*BackerConfig, error) {
+	tree, err := ReadConfigTree(location)
+	if err != nil {
+		return nil, err
+	}
+	var config BackerConfig
+	if err = decodeTree(tree, &config, false); err != nil {
+		return nil, fmt.Errorf("%s: %s", location, err)
+	}
+	if err = config.loadFragments(location); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ReadConfigTree - Read a single config file, in any of the supported formats, and expand its variables
+func ReadConfigTree(location string) (map[string]interface{}, error) {
+	tree, err := decodeConfigFile(location)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := expandVariables(tree, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", location, err)
+	}
+	return expanded.(map[string]interface{}), nil
+}
+
+// loadFragments - Add the watchers and backends from the files in the include directory
+// The default directory is optional, one which is configured must exist
+func (c *BackerConfig) loadFragments(location string) error {
+	dir := c.Include
+	if dir == "" {
+		dir = DefaultInclude
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(location), dir)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if c.Include == "" && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Fragments are applied in name order, so packages can use a numeric prefix
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !isConfigFile(entry.Name()) {
+			continue
+		}
+		fragmentLocation := filepath.Join(dir, entry.Name())
+		tree, err := ReadConfigTree(fragmentLocation)
+		if err != nil {
+			return err
+		}
+		var fragment configFragment
+		if err = decodeTree(tree, &fragment, true); err != nil {
+			return fmt.Errorf("%s: fragments may only contain watchers and backends: %s", fragmentLocation, err)
+		}
+		for _, watcher := range fragment.Watchers {
+			watcher.Source = fragmentLocation
+			c.Watchers = append(c.Watchers, watcher)
+		}
+		c.AdditionalBackends = append(c.AdditionalBackends, fragment.Backends...)
+	}
+	return nil
+}
+
+func isConfigFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+func configFormat(location string) string {
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatJSON
+}
+
+// decodeConfigFile - Decode a config file into a generic tree, without expanding any variables
+func decodeConfigFile(location string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]interface{})
+	switch configFormat(location) {
+	case formatYAML:
+		var value interface{}
+		err = yaml.Unmarshal(data, &value)
+		if err == nil && value != nil {
+			var ok bool
+			if tree, ok = normalizeYAML(value).(map[string]interface{}); !ok {
+				err = fmt.Errorf("expected a mapping at the top level")
+			}
+		}
+	case formatTOML:
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		err = json.Unmarshal(data, &tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", location, err)
+	}
+	return tree, nil
+}
+
+// encodeConfigFile - Encode a generic tree in the format of the given config file
+func encodeConfigFile(location string, tree map[string]interface{}) ([]byte, error) {
+	switch configFormat(location) {
+	case formatYAML:
+		return yaml.Marshal(tree)
+	case formatTOML:
+		var buffer bytes.Buffer
+		err := toml.NewEncoder(&buffer).Encode(tree)
+		return buffer.Bytes(), err
+	}
+	return json.MarshalIndent(tree, "", "    ")
+}
+
+// normalizeYAML - YAML mappings decode with interface keys, which can't be encoded as JSON
+func normalizeYAML(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			normalized[fmt.Sprint(key)] = normalizeYAML(element)
+		}
+		return normalized
+	case []interface{}:
+		for idx, element := range value {
+			value[idx] = normalizeYAML(element)
+		}
+	}
+	return value
+}
+
+// decodeTree - Decode a generic tree into a struct, using its JSON field names
+func decodeTree(tree interface{}, value interface{}, strict bool) error {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(value)
+}
+
+// expandVariables - Replace ${ENV_VAR} and ${file:/path} in every string of the tree
+func expandVariables(value interface{}, path string) (interface{}, error) {
+	var err error
+	switch value := value.(type) {
+	case string:
+		return expandString(value, path)
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			if expanded[key], err = expandVariables(element, joinField(path, key)); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		expanded := make([]interface{}, len(value))
+		for idx, element := range value {
+			if expanded[idx], err = expandVariables(element, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case []interface{}:
+		expanded := make([]interface{}, len(value))
+		for idx, element := range value {
+			if expanded[idx], err = expandVariables(element, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	}
+	return value, nil
+}
+
+func expandString(value string, path string) (string, error) {
+	var err error
+	expanded := configVariable.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		if strings.HasPrefix(name, "file:") {
+			data, readErr := ioutil.ReadFile(strings.TrimPrefix(name, "file:"))
+			if readErr != nil && err == nil {
+				err = fmt.Errorf("%s: %s", path, readErr)
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("%s: environment variable %s is not set", path, name)
+		}
+		return env
+	})
+	return expanded, err
+}
+
+func joinField(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
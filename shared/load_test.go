@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backer-load")
+	assert.Nil(t, err, "Should create temp dir")
+	defer os.RemoveAll(dir)
+
+	os.Setenv("BACKER_TEST_KEY", "AKIAEXAMPLE")
+	defer os.Unsetenv("BACKER_TEST_KEY")
+	secret := filepath.Join(dir, "secret")
+	assert.Nil(t, ioutil.WriteFile(secret, []byte("from-file\n"), 0600), "Should write secret")
+
+	files := map[string]string{
+		"config.yaml": `
+watchers:
+  - path: /etc/nginx
+    bucketPath: nginx
+s3:
+  region: us-east-1
+  bucket: backups
+  credentials:
+    AccessKeyID: ${BACKER_TEST_KEY}
+    SecretAccessKey: ${file:` + secret + `}
+keyTemplate: "$${literal}/{{.RelPath}}"
+`,
+		"config.toml": `
+keyTemplate = "$${literal}/{{.RelPath}}"
+
+[s3]
+region = "us-east-1"
+bucket = "backups"
+
+[s3.credentials]
+AccessKeyID = "${BACKER_TEST_KEY}"
+SecretAccessKey = "${file:` + secret + `}"
+
+[[watchers]]
+path = "/etc/nginx"
+bucketPath = "nginx"
+`,
+	}
+	for name, contents := range files {
+		location := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(location, []byte(contents), 0600), "Should write "+name)
+
+		config, err := LoadConfig(location)
+		assert.Nil(t, err, "Should load "+name)
+		assert.Equal(t, "backups", config.S3.Bucket, "Should decode "+name)
+		assert.Equal(t, []Watcher{{Path: "/etc/nginx", BucketPath: "nginx"}}, config.Watchers, "Should decode watchers from "+name)
+		assert.Equal(t, "AKIAEXAMPLE", config.S3.Credentials.AccessKeyID, "Should expand environment variables in "+name)
+		assert.Equal(t, "from-file", config.S3.Credentials.SecretAccessKey, "Should expand files in "+name)
+		assert.Equal(t, "${literal}/{{.RelPath}}", config.KeyTemplate, "Should unescape literals in "+name)
+
+		// Saving keeps the format, and doesn't write the expanded secrets
+		config.Watchers = append(config.Watchers, Watcher{Path: "/etc/ssh", BucketPath: "ssh"})
+		assert.Nil(t, config.Save(location), "Should save "+name)
+		tree, err := decodeConfigFile(location)
+		assert.Nil(t, err, "Should decode saved "+name)
+		assert.Len(t, tree["watchers"], 2, "Should save the new watcher to "+name)
+		saved, err := LoadConfig(location)
+		assert.Nil(t, err, "Should load saved "+name)
+		assert.Equal(t, config.Watchers, saved.Watchers, "Should save watchers to "+name)
+		data, err := ioutil.ReadFile(location)
+		assert.Nil(t, err, "Should read saved "+name)
+		assert.Contains(t, string(data), "${BACKER_TEST_KEY}", "Should keep variables in "+name)
+	}
+
+	location := filepath.Join(dir, "missing.json")
+	assert.Nil(t, ioutil.WriteFile(location, []byte(`{"s3": {"bucket": "${BACKER_TEST_MISSING}"}}`), 0600), "Should write config")
+	_, err = LoadConfig(location)
+	assert.Contains(t, err.Error(), "s3.bucket: environment variable BACKER_TEST_MISSING is not set", "Should report missing variables")
+}
+
+func TestLoadFragments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backer-fragments")
+	assert.Nil(t, err, "Should create temp dir")
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "config.json")
+	assert.Nil(t, ioutil.WriteFile(location, []byte(`{"watchers": [{"path": "/etc/backer", "bucketPath": "backer"}]}`), 0600), "Should write config")
+	include := filepath.Join(dir, DefaultInclude)
+	assert.Nil(t, os.Mkdir(include, 0700), "Should create include directory")
+	fragments := map[string]string{
+		"10-nginx.yaml":   "watchers:\n  - path: /etc/nginx\n    bucketPath: nginx\n",
+		"20-archive.json": `{"backends": [{"name": "archive", "region": "eu-west-1", "bucket": "archive"}]}`,
+		"README":          "Not a config file",
+	}
+	for name, contents := range fragments {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(include, name), []byte(contents), 0600), "Should write "+name)
+	}
+
+	config, err := LoadConfig(location)
+	assert.Nil(t, err, "Should load config")
+	assert.Len(t, config.Watchers, 2, "Should add watchers from fragments")
+	assert.Equal(t, filepath.Join(include, "10-nginx.yaml"), config.Watchers[1].Source, "Should remember where the watcher came from")
+	assert.Equal(t, "archive", config.AdditionalBackends[0].Name, "Should add backends from fragments")
+
+	// Fragment watchers stay in their fragment
+	assert.Nil(t, config.Save(location), "Should save config")
+	tree, err := decodeConfigFile(location)
+	assert.Nil(t, err, "Should decode saved config")
+	assert.Len(t, tree["watchers"], 1, "Should only save watchers from the main file")
+
+	// Fragments can't change anything else
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(include, "30-bad.json"), []byte(`{"deleteOnRemove": true}`), 0600), "Should write fragment")
+	_, err = LoadConfig(location)
+	assert.NotNil(t, err, "Should reject other settings in fragments")
+
+	// Configured include directories must exist
+	assert.Nil(t, ioutil.WriteFile(location, []byte(`{"include": "missing.d"}`), 0600), "Should write config")
+	_, err = LoadConfig(location)
+	assert.NotNil(t, err, "Should require the configured include directory")
+}
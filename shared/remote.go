@@ -0,0 +1,41 @@
+package shared
+
+import "errors"
+
+// RemoteConfig - Optional TCP listener for managing the daemon from other machines
+// Clients must present a certificate signed by the CA, and are given a role based on the name in their certificate
+type RemoteConfig struct {
+	Listen  string   `json:"listen"`  // Address to listen on, such as :7118
+	CA      string   `json:"ca"`      // PEM file of the CA which signs client certificates
+	Cert    string   `json:"cert"`    // PEM file of the certificate presented by the daemon
+	Key     string   `json:"key"`     // PEM file of the private key of the certificate
+	Admins  []string `json:"admins"`  // Certificate names which may run every command
+	Readers []string `json:"readers"` // Certificate names which may only run read only commands
+	// Which name of the certificate is matched, either commonName (the default) or dnsName
+	MatchName string `json:"matchName"`
+}
+
+// Names of the certificate which can be matched against the admins and readers
+const (
+	MatchCommonName = "commonName"
+	MatchDNSName    = "dnsName"
+)
+
+// Validate - Ensure that everything needed for mutual TLS has been configured
+func (r *RemoteConfig) Validate() error {
+	if r.Listen == "" {
+		return nil
+	}
+	if r.CA == "" || r.Cert == "" || r.Key == "" {
+		return errors.New("remote management requires a CA, certificate and key")
+	}
+	switch r.MatchName {
+	case "", MatchCommonName, MatchDNSName:
+	default:
+		return errors.New("remote matchName must be commonName or dnsName")
+	}
+	if len(r.Admins) == 0 && len(r.Readers) == 0 {
+		return errors.New("remote management requires at least one admin or reader")
+	}
+	return nil
+}
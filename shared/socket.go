@@ -0,0 +1,59 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// DefaultSocket - Location of the control socket, unless configured otherwise
+const DefaultSocket = "/run/backer/backer.sock"
+
+// Permissions of the control socket, unless configured otherwise
+const defaultSocketMode = 0660
+
+// SocketConfig - Location and permissions of the control socket, along with who may use it
+// Users and groups may be given as names or numeric IDs.
+// Root, the user running the daemon and the owner of the socket can always use every command, nobody else can use any
+// unless they're listed.
+type SocketConfig struct {
+	Path        string   `json:"path"`
+	Owner       string   `json:"owner"`
+	Group       string   `json:"group"`
+	Mode        string   `json:"mode"`        // Octal permissions, such as 0660
+	ReadUsers   []string `json:"readUsers"`   // May run read only commands
+	ReadGroups  []string `json:"readGroups"`  // Members may run read only commands
+	WriteUsers  []string `json:"writeUsers"`  // May run every command
+	WriteGroups []string `json:"writeGroups"` // Members may run every command
+	// Access of peers on platforms where they can't be identified, none (the default) or read
+	AllowUnidentified string `json:"allowUnidentified"`
+}
+
+// GetPath - Returns the location of the control socket
+func (s *SocketConfig) GetPath() string {
+	if s.Path == "" {
+		return DefaultSocket
+	}
+	return s.Path
+}
+
+// GetMode - Returns the permissions of the control socket
+func (s *SocketConfig) GetMode() (os.FileMode, error) {
+	if s.Mode == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(mode).Perm(), nil
+}
+
+// Validate - Ensure that peers which can't be identified are given an access level the daemon understands
+func (s *SocketConfig) Validate() error {
+	switch s.AllowUnidentified {
+	case "", "none", "read":
+		return nil
+	}
+	return errors.New("unidentified peers may only be given none or read access")
+}
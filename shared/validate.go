@@ -0,0 +1,47 @@
+package shared
+
+import "github.com/nickrobison/backer/backends"
+
+// ConfigProblem - Something wrong with a config file, warnings don't stop the daemon from starting
+type ConfigProblem struct {
+	Field   string // Location of the problem, such as watchers[1].path
+	Message string
+	Warning bool
+}
+
+func (p ConfigProblem) Error() string {
+	if p.Field == "" {
+		return p.Message
+	}
+	return p.Field + ": " + p.Message
+}
+
+// ConfigReport - Every problem found while validating a config file
+type ConfigReport struct {
+	Location string
+	Valid    bool // Only warnings were found, if any
+	Problems []ConfigProblem
+}
+
+// Add - Record a problem, errors make the config invalid
+func (r *ConfigReport) Add(problem ConfigProblem) {
+	r.Problems = append(r.Problems, problem)
+	if !problem.Warning {
+		r.Valid = false
+	}
+}
+
+// BackendCheck - Bucket settings of a single backend, compared against the config
+type BackendCheck struct {
+	Backend  string
+	Bucket   string
+	Settings []backends.BucketSetting
+	Error    string // Set when the bucket couldn't be checked
+}
+
+// BackendReport - Bucket settings of every backend in a config file
+type BackendReport struct {
+	Location string
+	InSync   bool // Every managed setting matches the config
+	Backends []BackendCheck
+}